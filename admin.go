@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/ChristopherRabotin/gin-contrib-headerauth"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/redis.v3"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// The roles of the admin users, each of which grants access to some admin routes.
+const (
+	RoleReadMetrics     = "read-metrics"
+	RoleRevokeTokens    = "revoke-tokens"
+	RoleManageProviders = "manage-providers"
+)
+
+// AdminRoles lists all the admin roles.
+var AdminRoles = []string{RoleReadMetrics, RoleRevokeTokens, RoleManageProviders}
+
+// AdminContextKey is the gin context key where the AdminIdentity is stored.
+const AdminContextKey = "admin"
+
+// MinAdminKeyLength is the minimum length of the admin API keys and of the JWT secrets.
+const MinAdminKeyLength = 32
+
+// AdminKey is a scoped admin API key. Only the SHA-256 of the key is configured.
+type AdminKey struct {
+	Name  string
+	Hash  []byte
+	Roles []string
+}
+
+// AdminSettings are the credentials accepted by the admin routes: API keys and JWTs signed with one of the JWT keys,
+// which must have the JWT issuer and audience.
+type AdminSettings struct {
+	Keys        []AdminKey
+	JWTKeys     map[string][]byte // JWT HS256 secrets by key ID.
+	JWTIssuer   string
+	JWTAudience string
+}
+
+// Enabled returns whether any credentials are configured, which enables the admin routes.
+func (s AdminSettings) Enabled() bool {
+	return len(s.Keys) > 0 || len(s.JWTKeys) > 0
+}
+
+// AdminIdentity is an authenticated admin user.
+type AdminIdentity struct {
+	Name  string
+	Roles []string
+}
+
+// HasRole returns whether the admin user has the role.
+func (i *AdminIdentity) HasRole(role string) bool {
+	for _, granted := range i.Roles {
+		if granted == role {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminAuth defines a header auth manager for the admin users, who authenticate with a scoped API key or a JWT.
+type AdminAuth struct {
+	settings AdminSettings
+	verified *verifiedAuths
+	*headerauth.TokenManager
+}
+
+// identify returns the admin user of the API key or JWT. The JWTs with a role which is not an admin role are
+// rejected, since they were not issued for goswift.
+func (m AdminAuth) identify(token string) (*AdminIdentity, error) {
+	if isJWT(token) {
+		claims, err := VerifyHS256JWT(token, m.settings.JWTKeys, m.settings.JWTIssuer, m.settings.JWTAudience, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		for _, role := range claims.Roles {
+			if !isAdminRole(role) {
+				return nil, fmt.Errorf("unknown admin role `%s`", role)
+			}
+		}
+		return &AdminIdentity{"jwt:" + claims.Subject, claims.Roles}, nil
+	}
+	hash := sha256.Sum256([]byte(token))
+	for _, key := range m.settings.Keys {
+		if subtle.ConstantTimeCompare(hash[:], key.Hash) == 1 {
+			return &AdminIdentity{"key:" + key.Name, key.Roles}, nil
+		}
+	}
+	return nil, errors.New("unknown admin key")
+}
+
+// CheckHeader checks the API key or the JWT, and keeps the admin user for Authorize.
+func (m AdminAuth) CheckHeader(auth *headerauth.AuthInfo, req *http.Request) (err *headerauth.AuthErr) {
+	auth.Secret = ""     // There is no secret key, just an access key.
+	auth.DataToSign = "" // There is no data to sign.
+	identity, idErr := m.identify(auth.AccessKey)
+	if idErr != nil {
+		return NewAuthErr(Status401, idErr)
+	}
+	m.verified.store(auth, identity)
+	return
+}
+
+// Authorize sets the specified context key to the AdminIdentity identified by CheckHeader.
+func (m AdminAuth) Authorize(auth *headerauth.AuthInfo) (val interface{}, err *headerauth.AuthErr) {
+	if identity, verified := m.verified.take(auth); verified {
+		return identity, nil
+	}
+	identity, idErr := m.identify(auth.AccessKey)
+	if idErr != nil {
+		return nil, NewAuthErr(Status401, idErr)
+	}
+	return identity, nil
+}
+
+// PreAbort responds with the status of the AuthErr, without any detail on why the API key or the JWT was rejected.
+func (m AdminAuth) PreAbort(c *gin.Context, auth *headerauth.AuthInfo, err *headerauth.AuthErr) {
+	StatusForAuthErr(err).Respond(c, nil)
+}
+
+// NewAdminAuthMgr returns a new AdminAuth auth manager. API keys and JWTs both use the Bearer prefix.
+func NewAdminAuthMgr(settings AdminSettings, contextKey string) *AdminAuth {
+	return &AdminAuth{settings, &verifiedAuths{}, headerauth.NewTokenManager("Authorization", "Bearer", contextKey)}
+}
+
+// RequireRole only lets through the admin users who have the role. It must follow the HeaderAuth of AdminAuth.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if identity, exists := c.Get(AdminContextKey); exists && identity.(*AdminIdentity).HasRole(role) {
+			return
+		}
+		Status403.Respond(c, gin.H{"detail": fmt.Sprintf("The %s role is required.", role)})
+		c.Abort()
+	}
+}
+
+// adminName returns the name of the admin user of the request, for the logs.
+func adminName(c *gin.Context) string {
+	if identity, exists := c.Get(AdminContextKey); exists {
+		return identity.(*AdminIdentity).Name
+	}
+	return "unknown"
+}
+
+// ProviderKeysAdmin serves the admin routes which manage the content provider keys.
+// All the changes are published so that every instance drops the access key from its caches.
+// The secrets replaced by a rotation stay valid for the overlap, unless the rotation sets another one.
+type ProviderKeysAdmin struct {
+	store       ProviderKeyStore
+	redisClient *redis.Client
+	overlap     time.Duration
+}
+
+// NewProviderKeysAdmin returns the admin of the keys of the store.
+func NewProviderKeysAdmin(store ProviderKeyStore, client *redis.Client, overlap time.Duration) *ProviderKeysAdmin {
+	return &ProviderKeysAdmin{store, client, overlap}
+}
+
+// ListKeys returns the keys of the provider, without their secrets.
+func (a *ProviderKeysAdmin) ListKeys(c *gin.Context) {
+	providerID, valid := providerIDParam(c)
+	if !valid {
+		return
+	}
+	keys, err := a.store.ListKeys(providerID)
+	if err != nil {
+		a.respondErr(c, err)
+		return
+	}
+	Render(c, 200, gin.H{"keys": keys})
+}
+
+// CreateKey creates a new key pair for the provider. This is the only time its secret is returned, with RotateKey.
+func (a *ProviderKeysAdmin) CreateKey(c *gin.Context) {
+	providerID, valid := providerIDParam(c)
+	if !valid {
+		return
+	}
+	key, err := NewProviderKey(providerID)
+	if err == nil {
+		err = a.store.CreateKey(key)
+	}
+	if err != nil {
+		a.respondErr(c, err)
+		return
+	}
+	// The access key may have been tried before it existed.
+	a.invalidate(key.AccessKey)
+	log.Notice("%s created the key %s of the provider %d.", adminName(c), key.AccessKey, providerID)
+	Render(c, 201, key)
+}
+
+// DisableKey disables the access key, which is rejected by all the instances from then on.
+func (a *ProviderKeysAdmin) DisableKey(c *gin.Context) {
+	accessKey := c.Params.ByName("access_key")
+	if err := a.store.DisableKey(accessKey); err != nil {
+		a.respondErr(c, err)
+		return
+	}
+	a.invalidate(accessKey)
+	log.Notice("%s disabled the key %s.", adminName(c), accessKey)
+	Render(c, 200, gin.H{"access_key": accessKey, "disabled": true})
+}
+
+// RotateKey replaces the secret of the access key, and returns the new secret. The previous secret stays valid
+// for the overlap, which the overlap query parameter may change, e.g. to 0s when the previous secret leaked.
+func (a *ProviderKeysAdmin) RotateKey(c *gin.Context) {
+	accessKey := c.Params.ByName("access_key")
+	overlap := a.overlap
+	if raw := c.Query("overlap"); raw != "" {
+		var err error
+		if overlap, err = time.ParseDuration(raw); err != nil || overlap < 0 {
+			Status400.Respond(c, gin.H{"detail": "The overlap must be a duration, e.g. 72h."})
+			return
+		}
+	}
+	previousExpires := time.Now().Add(overlap).UTC()
+	secretKey, err := NewSecretKey()
+	if err == nil {
+		err = a.store.RotateKey(accessKey, secretKey, previousExpires)
+	}
+	if err != nil {
+		a.respondErr(c, err)
+		return
+	}
+	a.invalidate(accessKey)
+	log.Notice("%s rotated the secret of the key %s, the previous one expires on %s.", adminName(c), accessKey,
+		previousExpires.Format(time.RFC3339))
+	Render(c, 200, gin.H{"access_key": accessKey, "secret_key": secretKey, "previous_secret_expires": previousExpires.Format(time.RFC3339)})
+}
+
+// invalidate publishes the change of the access key. Failing to publish is logged, since the store was already changed.
+func (a *ProviderKeysAdmin) invalidate(accessKey string) {
+	if err := PublishInvalidation(a.redisClient, ProviderInvalidationChannel, accessKey); err != nil {
+		log.Error("could not publish the invalidation of %s: %s", accessKey, err)
+	}
+}
+
+// respondErr responds with the error of the store.
+func (a *ProviderKeysAdmin) respondErr(c *gin.Context, err error) {
+	switch err {
+	case ErrKeyNotFound, ErrProviderNotFound:
+		Status404.Respond(c, gin.H{"detail": err.Error()})
+	default:
+		log.Error("provider keys store failed: %s", err)
+		Status503.Respond(c, nil)
+	}
+}
+
+// providerIDParam returns the provider ID of the route, or responds with a 404 if it is not an ID.
+func providerIDParam(c *gin.Context) (int, bool) {
+	providerID, err := strconv.Atoi(c.Params.ByName("id"))
+	if err != nil || providerID <= 0 {
+		Status404.Respond(c, gin.H{"detail": ErrProviderNotFound.Error()})
+		return 0, false
+	}
+	return providerID, true
+}
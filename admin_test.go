@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/Sparrho/goswift/client"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestAdmin tests the admin authentication, roles and routes.
+func TestAdmin(t *testing.T) {
+	Convey("The admin tests, ", t, func() {
+		redisServer := newFakeRedis()
+		defer redisServer.Close()
+		opsKey := strings.Repeat("a", MinAdminKeyLength)
+		viewerKey := strings.Repeat("v", MinAdminKeyLength)
+		jwtSecret := strings.Repeat("s", MinAdminKeyLength)
+		values := testConfigValues()
+		values["ADMIN_KEYS"] = "ops:" + sha256Hex(opsKey) + ":manage-providers|revoke-tokens|read-metrics," +
+			"viewer:" + sha256Hex(viewerKey) + ":read-metrics"
+		values["ADMIN_JWT_KEYS"] = "k1:" + jwtSecret
+		values["ADMIN_JWT_ISSUER"] = "https://ops.sparrho.com"
+		values["ADMIN_JWT_AUDIENCE"] = "goswift-admin"
+		cfg, err := ParseConfig(values)
+		So(err, ShouldBeNil)
+		store := newMemoryProviderStore(1)
+		server, err := NewServer(cfg, Dependencies{Redis: redisServer.Client(), Bucket: newMemoryBucket(), Providers: store})
+		So(err, ShouldBeNil)
+		defer server.Close()
+		e := server.Engine
+		headers := bearerHeaders(opsKey)
+
+		Convey("The admin routes need admin credentials", func() {
+			So(performRequest(e, "GET", "/admin/providers/1/keys", nil, nil).Code, ShouldEqual, 401)
+			wrong := bearerHeaders(strings.Repeat("b", MinAdminKeyLength))
+			So(performRequest(e, "GET", "/admin/providers/1/keys", wrong, nil).Code, ShouldEqual, 401)
+			So(performRequest(e, "GET", "/admin/providers/1/keys", headers, nil).Code, ShouldEqual, 200)
+		})
+
+		Convey("Each route requires its role", func() {
+			viewer := bearerHeaders(viewerKey)
+			req := performRequest(e, "GET", "/admin/metrics", viewer, nil)
+			So(req.Code, ShouldEqual, 200)
+			So(req.Body.String(), ShouldContainSubstring, "# TYPE goswift_persist_queue_depth gauge")
+			So(req.Body.String(), ShouldContainSubstring, "goswift_http_requests_total{")
+			So(performRequest(e, "GET", "/admin/providers/1/keys", viewer, nil).Code, ShouldEqual, 403)
+			So(performRequest(e, "DELETE", "/admin/tokens/someToken", viewer, nil).Code, ShouldEqual, 403)
+		})
+
+		Convey("JWTs signed with an admin JWT key are accepted until they expire", func() {
+			header := map[string]interface{}{"alg": "HS256", "kid": "k1"}
+			claims := map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Minute).Unix(),
+				"iss": "https://ops.sparrho.com", "aud": "goswift-admin", "roles": []string{RoleManageProviders}}
+			jwt := bearerHeaders(signTestJWT(header, claims, jwtSecret))
+			So(performRequest(e, "GET", "/admin/providers/1/keys", jwt, nil).Code, ShouldEqual, 200)
+			So(performRequest(e, "GET", "/admin/metrics", jwt, nil).Code, ShouldEqual, 403)
+			forged := bearerHeaders(signTestJWT(header, claims, strings.Repeat("f", MinAdminKeyLength)))
+			So(performRequest(e, "GET", "/admin/providers/1/keys", forged, nil).Code, ShouldEqual, 401)
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			expired := bearerHeaders(signTestJWT(header, claims, jwtSecret))
+			So(performRequest(e, "GET", "/admin/providers/1/keys", expired, nil).Code, ShouldEqual, 401)
+		})
+
+		Convey("The admin JWTs need the issuer, the audience and known roles", func() {
+			header := map[string]interface{}{"alg": "HS256", "kid": "k1"}
+			validClaims := func() map[string]interface{} {
+				return map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Minute).Unix(),
+					"iss": "https://ops.sparrho.com", "aud": "goswift-admin", "roles": []string{RoleReadMetrics}}
+			}
+			So(performRequest(e, "GET", "/admin/metrics", bearerHeaders(signTestJWT(header, validClaims(), jwtSecret)), nil).Code, ShouldEqual, 200)
+			for claim, val := range map[string]interface{}{"iss": "https://other.sparrho.com", "aud": "other-service",
+				"roles": []string{RoleReadMetrics, "superuser"}} {
+				claims := validClaims()
+				claims[claim] = val
+				jwt := bearerHeaders(signTestJWT(header, claims, jwtSecret))
+				So(performRequest(e, "GET", "/admin/metrics", jwt, nil).Code, ShouldEqual, 401)
+			}
+			withoutAudience := validClaims()
+			delete(withoutAudience, "aud")
+			jwt := bearerHeaders(signTestJWT(header, withoutAudience, jwtSecret))
+			So(performRequest(e, "GET", "/admin/metrics", jwt, nil).Code, ShouldEqual, 401)
+
+			delete(values, "ADMIN_JWT_AUDIENCE")
+			_, err := ParseConfig(values)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "ADMIN_JWT_AUDIENCE")
+		})
+
+		Convey("Perishable tokens are revoked", func() {
+			token := "revokedToken"
+			server.Redis.Set(PerishableRedisKey(token), 0, NonceTTL)
+			perishableCache.Set(token, &PerishableInfo{0, time.Now().Add(NonceTTL)}, NonceTTL)
+			So(performRequest(e, "DELETE", "/admin/tokens/"+token, headers, nil).Code, ShouldEqual, 200)
+			_, cached := perishableCache.Get(token)
+			So(cached, ShouldBeFalse)
+			So(server.Redis.Get(PerishableRedisKey(token)).Err(), ShouldNotBeNil)
+			So(performRequest(e, "DELETE", "/admin/tokens/"+token, headers, nil).Code, ShouldEqual, 404)
+		})
+
+		Convey("Keys are created, listed, rotated and disabled", func() {
+			req := performRequest(e, "POST", "/admin/providers/1/keys", headers, nil)
+			So(req.Code, ShouldEqual, 201)
+			var key ProviderKey
+			json.Unmarshal(req.Body.Bytes(), &key)
+			So(len(key.AccessKey), ShouldEqual, AccessKeyLength)
+			So(len(key.SecretKey), ShouldEqual, SecretKeyLength)
+
+			req = performRequest(e, "GET", "/admin/providers/1/keys", headers, nil)
+			var list struct{ Keys []ProviderKey }
+			json.Unmarshal(req.Body.Bytes(), &list)
+			So(len(list.Keys), ShouldEqual, 1)
+			So(list.Keys[0].AccessKey, ShouldEqual, key.AccessKey)
+			So(list.Keys[0].SecretKey, ShouldBeBlank)
+
+			// The provider auth loads the key from the store.
+			m := ContentProviderMgr{Store: store}
+			signed, auth := signedProviderRequest(client.NewSigner(key.AccessKey, key.SecretKey), "signed data")
+			So(m.CheckHeader(auth, signed), ShouldBeNil)
+
+			req = performRequest(e, "POST", "/admin/keys/"+key.AccessKey+"/rotate", headers, nil)
+			So(req.Code, ShouldEqual, 200)
+			var rotated ProviderKey
+			json.Unmarshal(req.Body.Bytes(), &rotated)
+			So(rotated.SecretKey, ShouldNotEqual, key.SecretKey)
+			_, cached := providerCache.Get(key.AccessKey)
+			So(cached, ShouldBeFalse)
+			signed, auth = signedProviderRequest(client.NewSigner(key.AccessKey, rotated.SecretKey), "signed data")
+			So(m.CheckHeader(auth, signed), ShouldBeNil)
+
+			So(performRequest(e, "POST", "/admin/keys/"+key.AccessKey+"/disable", headers, nil).Code, ShouldEqual, 200)
+			signed, auth = signedProviderRequest(client.NewSigner(key.AccessKey, rotated.SecretKey), "signed data")
+			So(m.CheckHeader(auth, signed), ShouldNotBeNil)
+			So(performRequest(e, "POST", "/admin/keys/"+key.AccessKey+"/rotate", headers, nil).Code, ShouldEqual, 404)
+			invalidAccessCache.Delete(key.AccessKey)
+		})
+
+		Convey("Rotated keys accept their previous secret for the overlap", func() {
+			req := performRequest(e, "POST", "/admin/providers/1/keys", headers, nil)
+			var key ProviderKey
+			json.Unmarshal(req.Body.Bytes(), &key)
+			defer invalidateProviderKey(key.AccessKey)
+			m := ContentProviderMgr{Store: store}
+			accepts := func(secret string) bool {
+				signed, auth := signedProviderRequest(client.NewSigner(key.AccessKey, secret), "signed data")
+				return m.CheckHeader(auth, signed) == nil
+			}
+
+			req = performRequest(e, "POST", "/admin/keys/"+key.AccessKey+"/rotate", headers, nil)
+			So(req.Code, ShouldEqual, 200)
+			var rotated struct {
+				SecretKey       string    `json:"secret_key"`
+				PreviousExpires time.Time `json:"previous_secret_expires"`
+			}
+			json.Unmarshal(req.Body.Bytes(), &rotated)
+			So(rotated.PreviousExpires.After(time.Now().Add(DefaultSecretOverlap-time.Minute)), ShouldBeTrue)
+			So(accepts(key.SecretKey), ShouldBeTrue)
+			So(accepts(rotated.SecretKey), ShouldBeTrue)
+			req = performRequest(e, "GET", "/admin/providers/1/keys", headers, nil)
+			So(req.Body.String(), ShouldContainSubstring, "previous_secret_expires")
+
+			// A leaked secret is rotated without any overlap.
+			So(performRequest(e, "POST", "/admin/keys/"+key.AccessKey+"/rotate?overlap=forever", headers, nil).Code, ShouldEqual, 400)
+			req = performRequest(e, "POST", "/admin/keys/"+key.AccessKey+"/rotate?overlap=0s", headers, nil)
+			So(req.Code, ShouldEqual, 200)
+			previousSecret := rotated.SecretKey
+			json.Unmarshal(req.Body.Bytes(), &rotated)
+			So(accepts(previousSecret), ShouldBeFalse)
+			So(accepts(key.SecretKey), ShouldBeFalse)
+			So(accepts(rotated.SecretKey), ShouldBeTrue)
+		})
+
+		Convey("Unknown providers and keys are not found", func() {
+			So(performRequest(e, "POST", "/admin/providers/2/keys", headers, nil).Code, ShouldEqual, 404)
+			So(performRequest(e, "GET", "/admin/providers/first/keys", headers, nil).Code, ShouldEqual, 404)
+			So(performRequest(e, "POST", "/admin/keys/unknown/disable", headers, nil).Code, ShouldEqual, 404)
+		})
+
+		Convey("The invalidations published by the other instances are applied", func() {
+			providerCache.Set("otherAccessKey", &ContentProviderInfo{id: 1, secret: "otherSecret"}, 0)
+			other := redisServer.Client()
+			defer other.Close()
+			// Leaves time to the watcher of the server to subscribe.
+			time.Sleep(time.Millisecond * 50)
+			So(other.Publish(ProviderInvalidationChannel, "otherAccessKey").Err(), ShouldBeNil)
+			time.Sleep(time.Millisecond * 50)
+			_, cached := providerCache.Get("otherAccessKey")
+			So(cached, ShouldBeFalse)
+		})
+
+		Convey("A closed server stops watching the invalidations without flushing the caches", func() {
+			done := make(chan struct{})
+			stopped := make(chan struct{})
+			watcher := redisServer.Client()
+			defer watcher.Close()
+			go func() {
+				watchInvalidations(watcher, done)
+				close(stopped)
+			}()
+			time.Sleep(time.Millisecond * 50)
+			providerCache.Set("keptAccessKey", &ContentProviderInfo{id: 1, secret: "keptSecret"}, 0)
+			defer providerCache.Delete("keptAccessKey")
+			close(done)
+			select {
+			case <-stopped:
+			case <-time.After(time.Second):
+				t.Error("the invalidations watcher did not stop")
+			}
+			_, cached := providerCache.Get("keptAccessKey")
+			So(cached, ShouldBeTrue)
+		})
+	})
+}
+
+// sha256Hex returns the hex encoded SHA-256 hash of the admin key, as expected in ADMIN_KEYS.
+func sha256Hex(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// bearerHeaders returns the request headers which authenticate with the provided admin credentials.
+func bearerHeaders(credentials string) map[string][]string {
+	return map[string][]string{"Authorization": {"Bearer " + credentials}}
+}
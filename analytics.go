@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"regexp"
+	"sort"
+	"time"
+)
+
+const (
+	// SerializedKey is the gin context key where handlers store the serialized data to persist.
+	SerializedKey = "serialized"
+	// maxEventTypeLen is the maximum length of an event type.
+	maxEventTypeLen = 64
+	// maxSessionIDLen is the maximum length of a session ID.
+	maxSessionIDLen = 128
+	// maxEventProperties is the maximum number of properties of an event.
+	maxEventProperties = 64
+	// timestampFormat is the format of all the timestamps goswift persists.
+	timestampFormat = "2006-01-02T15:04:05.000Z"
+	// MaxBatchEvents is the maximum number of events in a single batch.
+	MaxBatchEvents = 500
+)
+
+// eventTypeRegexp defines which event types are valid, e.g. "page_view" or "search.submit".
+var eventTypeRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_.\-]*$`)
+
+// AnalyticsEvent is an analytics event as sent by the clients on PUT /analytics/record.
+type AnalyticsEvent struct {
+	EventType  string                 `json:"event_type"`
+	Timestamp  time.Time              `json:"timestamp"`
+	SessionID  string                 `json:"session_id"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+// PersistedEvent is an accepted analytics event, enriched with server side information.
+type PersistedEvent struct {
+	EventType       string                 `json:"event_type"`
+	Timestamp       string                 `json:"timestamp"`
+	SessionID       string                 `json:"session_id"`
+	Properties      map[string]interface{} `json:"properties"`
+	ServerTimestamp string                 `json:"server_timestamp"`
+	ClientIP        string                 `json:"client_ip"`
+	Token           string                 `json:"token"`
+}
+
+// FieldErrors maps each invalid field to the reason why it is invalid.
+type FieldErrors map[string]string
+
+// ParseAnalyticsEvent parses and validates an analytics event. All the invalid fields are returned at once.
+func ParseAnalyticsEvent(body []byte) (*AnalyticsEvent, FieldErrors) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, FieldErrors{"body": "must be a JSON object"}
+	}
+	event := &AnalyticsEvent{}
+	errs := FieldErrors{}
+
+	if msg, exists := raw["event_type"]; !exists {
+		errs["event_type"] = "is required"
+	} else if err := json.Unmarshal(msg, &event.EventType); err != nil {
+		errs["event_type"] = "must be a string"
+	} else if len(event.EventType) == 0 || len(event.EventType) > maxEventTypeLen {
+		errs["event_type"] = fmt.Sprintf("must be between 1 and %d characters", maxEventTypeLen)
+	} else if !eventTypeRegexp.MatchString(event.EventType) {
+		errs["event_type"] = "must only contain lowercase letters, digits, '_', '.' and '-'"
+	}
+
+	var timestamp string
+	if msg, exists := raw["timestamp"]; !exists {
+		errs["timestamp"] = "is required"
+	} else if err := json.Unmarshal(msg, &timestamp); err != nil {
+		errs["timestamp"] = "must be a string"
+	} else if event.Timestamp, err = time.Parse(time.RFC3339Nano, timestamp); err != nil {
+		errs["timestamp"] = "must be an RFC 3339 date"
+	}
+
+	if msg, exists := raw["session_id"]; !exists {
+		errs["session_id"] = "is required"
+	} else if err := json.Unmarshal(msg, &event.SessionID); err != nil {
+		errs["session_id"] = "must be a string"
+	} else if len(event.SessionID) == 0 || len(event.SessionID) > maxSessionIDLen {
+		errs["session_id"] = fmt.Sprintf("must be between 1 and %d characters", maxSessionIDLen)
+	}
+
+	if msg, exists := raw["properties"]; exists {
+		if err := json.Unmarshal(msg, &event.Properties); err != nil {
+			errs["properties"] = "must be an object"
+		} else if len(event.Properties) > maxEventProperties {
+			errs["properties"] = fmt.Sprintf("must have at most %d properties", maxEventProperties)
+		}
+	}
+	if event.Properties == nil {
+		event.Properties = map[string]interface{}{}
+	}
+
+	// Unknown fields are rejected so that typos in the clients are noticed.
+	unknown := make([]string, 0)
+	for key := range raw {
+		switch key {
+		case "event_type", "timestamp", "session_id", "properties":
+		default:
+			unknown = append(unknown, key)
+		}
+	}
+	sort.Strings(unknown)
+	for _, key := range unknown {
+		errs[key] = "is not a known field"
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return event, nil
+}
+
+// Serialize returns the event as a normalized JSON line, enriched with the server time, the client IP and the token.
+func (e AnalyticsEvent) Serialize(clientIP string, token string) string {
+	persisted := PersistedEvent{EventType: e.EventType, Timestamp: e.Timestamp.UTC().Format(timestampFormat),
+		SessionID: e.SessionID, Properties: e.Properties, ServerTimestamp: time.Now().UTC().Format(timestampFormat),
+		ClientIP: clientIP, Token: token}
+	data, err := json.Marshal(&persisted)
+	if err != nil {
+		// All the values come from a JSON decoding, so they can always be encoded back.
+		panic(fmt.Errorf("could not serialize event %+v: %s", e, err))
+	}
+	return string(data)
+}
+
+// BatchResult is the outcome of a single event of a batch.
+type BatchResult struct {
+	Index  int         `json:"index"`
+	Status string      `json:"status"`
+	Fields FieldErrors `json:"fields,omitempty"`
+}
+
+// ParseAnalyticsBatch parses a batch of events, sent either as a JSON array or as newline delimited JSON.
+// It returns the valid events and the result of each event, or an error on the body if the batch itself is invalid.
+func ParseAnalyticsBatch(body []byte) ([]*AnalyticsEvent, []*BatchResult, FieldErrors) {
+	var items []json.RawMessage
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, nil, FieldErrors{"body": "must be a JSON array or newline delimited JSON"}
+		}
+	} else {
+		for _, line := range bytes.Split(trimmed, []byte("\n")) {
+			if line = bytes.TrimSpace(line); len(line) > 0 {
+				items = append(items, json.RawMessage(line))
+			}
+		}
+	}
+	if len(items) == 0 {
+		return nil, nil, FieldErrors{"body": "must contain at least one event"}
+	}
+	if len(items) > MaxBatchEvents {
+		return nil, nil, FieldErrors{"body": fmt.Sprintf("must contain at most %d events", MaxBatchEvents)}
+	}
+	events := make([]*AnalyticsEvent, 0, len(items))
+	results := make([]*BatchResult, len(items))
+	for i, item := range items {
+		event, errs := ParseAnalyticsEvent(item)
+		if errs != nil {
+			results[i] = &BatchResult{Index: i, Status: "rejected", Fields: errs}
+			continue
+		}
+		events = append(events, event)
+		results[i] = &BatchResult{Index: i, Status: "accepted"}
+	}
+	return events, results, nil
+}
+
+// readAnalyticsEvent reads and validates the event in the request body. The body is restored afterwards.
+func readAnalyticsEvent(c *gin.Context) (*AnalyticsEvent, *RequestErr) {
+	body, reqErr := readBody(c)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	event, errs := ParseAnalyticsEvent(body)
+	if errs != nil {
+		return nil, &RequestErr{400, errs}
+	}
+	return event, nil
+}
+
+// readAnalyticsBatch reads and validates the batch of events in the request body. The body is restored afterwards.
+func readAnalyticsBatch(c *gin.Context) ([]*AnalyticsEvent, []*BatchResult, *RequestErr) {
+	body, reqErr := readBody(c)
+	if reqErr != nil {
+		return nil, nil, reqErr
+	}
+	events, results, errs := ParseAnalyticsBatch(body)
+	if errs != nil {
+		return nil, nil, &RequestErr{400, errs}
+	}
+	return events, results, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+// TestAnalytics tests the validation and serialization of analytics events.
+func TestAnalytics(t *testing.T) {
+	Convey("The analytics event tests, ", t, func() {
+		Convey("A valid event is parsed", func() {
+			event, errs := ParseAnalyticsEvent([]byte(`{"event_type": "page_view", "timestamp": "2015-08-01T10:00:00+02:00",
+				"session_id": "abc", "properties": {"url": "/a", "position": 3}}`))
+			So(errs, ShouldBeNil)
+			So(event.EventType, ShouldEqual, "page_view")
+			So(event.Properties["position"], ShouldEqual, 3)
+
+			Convey("And serialized as a normalized and enriched line", func() {
+				var persisted PersistedEvent
+				So(json.Unmarshal([]byte(event.Serialize("10.0.0.1", "sometoken")), &persisted), ShouldBeNil)
+				So(persisted.Timestamp, ShouldEqual, "2015-08-01T08:00:00.000Z")
+				So(persisted.ClientIP, ShouldEqual, "10.0.0.1")
+				So(persisted.Token, ShouldEqual, "sometoken")
+				So(persisted.ServerTimestamp, ShouldNotBeBlank)
+			})
+		})
+
+		Convey("The properties are optional", func() {
+			event, errs := ParseAnalyticsEvent([]byte(`{"event_type": "click", "timestamp": "2015-08-01T10:00:00Z", "session_id": "abc"}`))
+			So(errs, ShouldBeNil)
+			So(event.Properties, ShouldNotBeNil)
+		})
+
+		Convey("A body which is not a JSON object is rejected", func() {
+			_, errs := ParseAnalyticsEvent([]byte(`[1, 2]`))
+			So(errs["body"], ShouldNotBeBlank)
+		})
+
+		Convey("A batch can be a JSON array", func() {
+			events, results, errs := ParseAnalyticsBatch([]byte(`[{"event_type": "click", "timestamp": "2015-08-01T10:00:00Z", "session_id": "a"},
+				{"event_type": "click"}]`))
+			So(errs, ShouldBeNil)
+			So(len(events), ShouldEqual, 1)
+			So(results[0].Status, ShouldEqual, "accepted")
+			So(results[1].Status, ShouldEqual, "rejected")
+			So(results[1].Fields["session_id"], ShouldEqual, "is required")
+		})
+
+		Convey("A batch can be newline delimited JSON", func() {
+			events, results, errs := ParseAnalyticsBatch([]byte(`{"event_type": "click", "timestamp": "2015-08-01T10:00:00Z", "session_id": "a"}
+
+{"event_type": "scroll", "timestamp": "2015-08-01T10:00:01Z", "session_id": "a"}
+`))
+			So(errs, ShouldBeNil)
+			So(len(events), ShouldEqual, 2)
+			So(len(results), ShouldEqual, 2)
+			So(events[1].EventType, ShouldEqual, "scroll")
+		})
+
+		Convey("An empty batch is rejected", func() {
+			_, _, errs := ParseAnalyticsBatch([]byte("  \n"))
+			So(errs["body"], ShouldNotBeBlank)
+		})
+
+		Convey("A batch with too many events is rejected", func() {
+			_, _, errs := ParseAnalyticsBatch([]byte(strings.Repeat("{}\n", MaxBatchEvents+1)))
+			So(errs["body"], ShouldNotBeBlank)
+		})
+
+		Convey("All the invalid fields are reported at once", func() {
+			_, errs := ParseAnalyticsEvent([]byte(`{"event_type": "Page View", "timestamp": 12, "properties": [], "referer": "x"}`))
+			So(errs["event_type"], ShouldNotBeBlank)
+			So(errs["timestamp"], ShouldEqual, "must be a string")
+			So(errs["session_id"], ShouldEqual, "is required")
+			So(errs["properties"], ShouldEqual, "must be an object")
+			So(errs["referer"], ShouldEqual, "is not a known field")
+		})
+	})
+}
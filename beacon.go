@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"github.com/ChristopherRabotin/gin-contrib-headerauth"
+	"github.com/gin-gonic/gin"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// BeaconTokenParam is the query parameter, or form field, which carries the token of beacon requests.
+	BeaconTokenParam = "token"
+	// BeaconEventField is the form field which carries the event JSON of form encoded beacon requests.
+	BeaconEventField = "event"
+)
+
+// BeaconAuth supports navigator.sendBeacon, which can neither set headers nor use another method than POST.
+// The token is taken from the query string or from the form, and set in the header of the manager, so that the
+// manager validates it exactly like for the other requests. When the body is a form, the event JSON is taken from
+// its "event" field and replaces the captured body, so the manager reads the event as usual.
+// This must run after CaptureBody and before the HeaderAuth of the same manager.
+func BeaconAuth(m headerauth.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query(BeaconTokenParam)
+		if token != "" {
+			// The token is a credential, so it must not end up in the logs with the request URI.
+			stripQueryParam(c.Request, BeaconTokenParam)
+		}
+		form, reqErr := beaconForm(c)
+		if reqErr != nil {
+			reqErr.Respond(c)
+			return
+		}
+		if form != nil {
+			if token == "" {
+				token = form.Get(BeaconTokenParam)
+			}
+			event := newCapturedBody([]byte(form.Get(BeaconEventField)))
+			c.Set(BodyKey, event)
+			c.Request.Body = event
+		}
+		if c.Request.Header == nil {
+			c.Request.Header = make(http.Header)
+		}
+		if token != "" && c.Request.Header.Get(m.HeaderKey()) == "" {
+			c.Request.Header.Set(m.HeaderKey(), m.HeaderPrefix()+" "+token)
+		}
+	}
+}
+
+// beaconForm returns the fields of a form encoded body, or nil if the body is not a form (e.g. a JSON Blob).
+func beaconForm(c *gin.Context) (url.Values, *RequestErr) {
+	mediaType, params, _ := mime.ParseMediaType(c.Request.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data" {
+		return nil, nil
+	}
+	body, reqErr := readBody(c)
+	if reqErr != nil {
+		return nil, reqErr
+	}
+	if mediaType == "application/x-www-form-urlencoded" {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, &RequestErr{400, FieldErrors{"body": "could not be parsed as a form"}}
+		}
+		return form, nil
+	}
+	// The body is already in memory and limited, so the whole form can be kept in memory too.
+	form, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).ReadForm(int64(len(body)) + 1)
+	if err != nil {
+		return nil, &RequestErr{400, FieldErrors{"body": "could not be parsed as a form"}}
+	}
+	defer form.RemoveAll()
+	return url.Values(form.Value), nil
+}
+
+// stripQueryParam removes a parameter from the query string of the request.
+func stripQueryParam(req *http.Request, param string) {
+	query := req.URL.Query()
+	query.Del(param)
+	req.URL.RawQuery = query.Encode()
+	req.RequestURI = req.URL.RequestURI()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestBeacon tests how beacon requests are turned into usual token requests.
+func TestBeacon(t *testing.T) {
+	Convey("The beacon tests, ", t, func() {
+		engine := gin.New()
+		engine.POST("/beacon", CaptureBody(0), BeaconAuth(NewPerishableTokenMgr("DecayingToken", "token", nil)), func(c *gin.Context) {
+			body, _ := readBody(c)
+			c.String(http.StatusOK, c.Request.Header.Get("Authorization")+"|"+string(body)+"|"+c.Request.RequestURI)
+		})
+		event := `{"event_type":"unload"}`
+
+		Convey("The token can be in the query string", func() {
+			headers := map[string][]string{"Content-Type": {"text/plain;charset=UTF-8"}}
+			req := performRequest(engine, "POST", "/beacon?token=abc&v=1", headers, strings.NewReader(event))
+			So(req.Code, ShouldEqual, 200)
+			So(req.Body.String(), ShouldEqual, "DecayingToken abc|"+event+"|/beacon?v=1")
+		})
+
+		Convey("The token and the event can be in an URL encoded form", func() {
+			form := url.Values{BeaconTokenParam: {"abc"}, BeaconEventField: {event}}
+			headers := map[string][]string{"Content-Type": {"application/x-www-form-urlencoded"}}
+			req := performRequest(engine, "POST", "/beacon", headers, strings.NewReader(form.Encode()))
+			So(req.Body.String(), ShouldEqual, "DecayingToken abc|"+event+"|/beacon")
+		})
+
+		Convey("The token and the event can be in a multipart form", func() {
+			var body bytes.Buffer
+			writer := multipart.NewWriter(&body)
+			writer.WriteField(BeaconTokenParam, "abc")
+			writer.WriteField(BeaconEventField, event)
+			writer.Close()
+			headers := map[string][]string{"Content-Type": {writer.FormDataContentType()}}
+			req := performRequest(engine, "POST", "/beacon", headers, &body)
+			So(req.Body.String(), ShouldEqual, "DecayingToken abc|"+event+"|/beacon")
+		})
+
+		Convey("An existing header is not overridden", func() {
+			headers := map[string][]string{"Authorization": {"DecayingToken header"}}
+			req := performRequest(engine, "POST", "/beacon?token=query", headers, strings.NewReader(event))
+			So(req.Body.String(), ShouldStartWith, "DecayingToken header|")
+		})
+
+		Convey("An invalid multipart form is rejected", func() {
+			headers := map[string][]string{"Content-Type": {"multipart/form-data; boundary=nope"}}
+			req := performRequest(engine, "POST", "/beacon", headers, strings.NewReader("not a form"))
+			So(req.Code, ShouldEqual, 400)
+		})
+	})
+}
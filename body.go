@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+// Default maximum body sizes per route group, in bytes. Each can be overridden with MAX_BODY_<GROUP>, e.g. MAX_BODY_ANALYTICS.
+const (
+	DefaultMaxBodyAnalytics = 64 << 10
+	DefaultMaxBodyBatch     = 5 << 20
+	DefaultMaxBodyProvider  = 50 << 20
+	DefaultMaxBody          = 1 << 20
+)
+
+// ErrBodyTooLarge is returned when reading more than the allowed body size.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// RequestErr is a client error on the request, with the status to respond with.
+type RequestErr struct {
+	Status int
+	Fields FieldErrors
+}
+
+// Respond writes the error JSON and aborts the request.
+func (e *RequestErr) Respond(c *gin.Context) {
+	if len(e.Fields) == 0 {
+		StatusFor(e.Status).Respond(c, nil)
+	} else if e.Status == 400 {
+		StatusValidationFailed.Respond(c, gin.H{"fields": e.Fields})
+	} else {
+		StatusFor(e.Status).Respond(c, gin.H{"fields": e.Fields})
+	}
+	c.Abort()
+}
+
+// bodyReadErr returns the RequestErr matching an error which happened while reading the body.
+func bodyReadErr(err error) *RequestErr {
+	if err == ErrBodyTooLarge {
+		return &RequestErr{413, nil}
+	}
+	log.Error("could not read the body: %s", err)
+	return &RequestErr{400, FieldErrors{"body": "could not be read"}}
+}
+
+// limitedBody is a request body which fails with ErrBodyTooLarge when more than the limit is read.
+// Unlike io.LimitReader, this tells a body of exactly the limit from a larger one.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+// Read reads from the body until the limit is reached.
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		var probe [1]byte
+		n, err := b.ReadCloser.Read(probe[:])
+		if n > 0 {
+			return 0, ErrBodyTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// LimitBody rejects requests whose body is larger than maxSize with a 413. Bodies with a Content-Length are
+// rejected immediately, and the others fail with ErrBodyTooLarge when they are read, so bodies are never fully
+// buffered just to know their size.
+func LimitBody(maxSize int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil {
+			return
+		}
+		if c.Request.ContentLength > maxSize {
+			(&RequestErr{413, nil}).Respond(c)
+			return
+		}
+		c.Request.Body = &limitedBody{c.Request.Body, maxSize}
+	}
+}
+
+// BodyKey is the gin context key where the captured request body is stored.
+const BodyKey = "body"
+
+// DefaultSpoolThreshold is the size above which CaptureBody spools the body to disk rather than keeping it in memory.
+const DefaultSpoolThreshold = 1 << 20
+
+// CapturedBody is a request body which was read once. Its content stays available to the auth managers (through
+// the request), the handlers and the persister (through the context) after it has been read. Small bodies are
+// kept in memory, and large ones may be spooled to disk.
+type CapturedBody struct {
+	io.ReadSeeker
+	data      []byte
+	spool     *os.File
+	size      int64
+	handedOff bool // Whether a persistence took the spool over, which it then removes.
+}
+
+// newCapturedBody returns a new captured body of the provided data.
+func newCapturedBody(data []byte) *CapturedBody {
+	return &CapturedBody{ReadSeeker: bytes.NewReader(data), data: data, size: int64(len(data))}
+}
+
+// newSpooledBody returns a new captured body of the spooled file.
+func newSpooledBody(spool *os.File, size int64) *CapturedBody {
+	return &CapturedBody{ReadSeeker: io.NewSectionReader(spool, 0, size), spool: spool, size: size}
+}
+
+// Close does nothing, the original body was closed when it was captured.
+func (b *CapturedBody) Close() error {
+	return nil
+}
+
+// Size returns the size of the whole body.
+func (b *CapturedBody) Size() int64 {
+	return b.size
+}
+
+// Spooled returns whether the body is stored on disk.
+func (b *CapturedBody) Spooled() bool {
+	return b.spool != nil
+}
+
+// NewReader returns a reader of the whole body, regardless of how much of it was read.
+// Spooled bodies are read with ReadAt, so the readers do not interfere with each other.
+func (b *CapturedBody) NewReader() io.Reader {
+	if b.spool != nil {
+		return io.NewSectionReader(b.spool, 0, b.size)
+	}
+	return bytes.NewReader(b.data)
+}
+
+// Bytes returns the whole body, which is loaded in memory if it was spooled.
+func (b *CapturedBody) Bytes() ([]byte, error) {
+	if b.spool == nil {
+		return b.data, nil
+	}
+	return ioutil.ReadAll(b.NewReader())
+}
+
+// handOff hands the spooled file over to a persistence, which must remove it once done.
+func (b *CapturedBody) handOff() (*os.File, int64) {
+	b.handedOff = true
+	return b.spool, b.size
+}
+
+// release removes the spooled file, unless it was handed over.
+func (b *CapturedBody) release() {
+	if b.spool != nil && !b.handedOff {
+		b.spool.Close()
+		os.Remove(b.spool.Name())
+	}
+}
+
+// captureRequestBody reads the request body and replaces it with a CapturedBody. The body is only read once,
+// so all the following calls return the same body. Bodies larger than the spool threshold are spooled to disk,
+// and must then be released by the caller; a threshold of 0 keeps all the bodies in memory.
+func captureRequestBody(req *http.Request, spoolThreshold int64) (*CapturedBody, error) {
+	if captured, ok := req.Body.(*CapturedBody); ok {
+		return captured, nil
+	}
+	defer req.Body.Close()
+	var head io.Reader = req.Body
+	if spoolThreshold > 0 {
+		head = io.LimitReader(req.Body, spoolThreshold+1)
+	}
+	data, err := ioutil.ReadAll(head)
+	if err != nil {
+		return nil, err
+	}
+	if spoolThreshold <= 0 || int64(len(data)) <= spoolThreshold {
+		req.Body = newCapturedBody(data)
+	} else {
+		spool, size, err := spoolBody(io.MultiReader(bytes.NewReader(data), req.Body))
+		if err != nil {
+			return nil, err
+		}
+		req.Body = newSpooledBody(spool, size)
+	}
+	return req.Body.(*CapturedBody), nil
+}
+
+// CaptureBody reads the request body once and stores it in the context at BodyKey. Bodies larger than the spool
+// threshold are spooled to disk, and removed once the request is done unless a persistence took them over.
+// It must run after LimitBody and DecompressBody, and before the auth managers.
+func CaptureBody(spoolThreshold int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Body == nil {
+			return
+		}
+		body, err := captureRequestBody(c.Request, spoolThreshold)
+		if err != nil {
+			bodyReadErr(err).Respond(c)
+			return
+		}
+		c.Set(BodyKey, body)
+		c.Next()
+		body.release()
+	}
+}
+
+// capturedBody returns the captured request body, capturing it in memory if CaptureBody did not already do so,
+// or nil if the request has no body.
+func capturedBody(c *gin.Context) (*CapturedBody, error) {
+	if bodyItf, exists := c.Get(BodyKey); exists {
+		if body, ok := bodyItf.(*CapturedBody); ok {
+			return body, nil
+		}
+	}
+	if c.Request.Body == nil {
+		return nil, nil
+	}
+	body, err := captureRequestBody(c.Request, 0)
+	if err != nil {
+		return nil, err
+	}
+	c.Set(BodyKey, body)
+	return body, nil
+}
+
+// readBody returns the whole request body, capturing it if CaptureBody did not already do so.
+func readBody(c *gin.Context) ([]byte, *RequestErr) {
+	body, err := capturedBody(c)
+	if err != nil {
+		return nil, bodyReadErr(err)
+	}
+	if body == nil {
+		return nil, &RequestErr{400, FieldErrors{"body": "is required"}}
+	}
+	data, err := body.Bytes()
+	if err != nil {
+		return nil, bodyReadErr(err)
+	}
+	return data, nil
+}
+
+// spoolBody copies the reader to a temporary file, so that large bodies are not kept in memory.
+// The returned file is positioned at its start and must be removed by the caller.
+func spoolBody(r io.Reader) (*os.File, int64, error) {
+	file, err := ioutil.TempFile("", "goswift-body-")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(file, r)
+	if err == nil {
+		_, err = file.Seek(0, 0)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+	return file, size, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"github.com/Sparrho/goswift/client"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestBody tests the body size limits.
+func TestBody(t *testing.T) {
+	Convey("The body limit tests, ", t, func() {
+		engine := gin.New()
+		engine.PUT("/echo", LimitBody(10), func(c *gin.Context) {
+			body, reqErr := readBody(c)
+			if reqErr != nil {
+				reqErr.Respond(c)
+				return
+			}
+			c.String(http.StatusOK, string(body))
+		})
+
+		Convey("A body of exactly the limit is accepted", func() {
+			req := performRequest(engine, "PUT", "/echo", nil, strings.NewReader("0123456789"))
+			So(req.Code, ShouldEqual, 200)
+			So(req.Body.String(), ShouldEqual, "0123456789")
+		})
+
+		Convey("A body with a Content-Length above the limit is rejected", func() {
+			req := performRequest(engine, "PUT", "/echo", nil, strings.NewReader("0123456789a"))
+			So(req.Code, ShouldEqual, 413)
+			So(req.Body.String(), ShouldContainSubstring, "request entity too large")
+		})
+
+		Convey("A body without a Content-Length is rejected when read above the limit", func() {
+			// Wrapping the reader hides its length from http.NewRequest.
+			req := performRequest(engine, "PUT", "/echo", nil, ioutil.NopCloser(strings.NewReader("0123456789a")))
+			So(req.Code, ShouldEqual, 413)
+		})
+
+		Convey("A captured body can be read by everyone down the chain", func() {
+			captureEngine := gin.New()
+			captureEngine.PUT("/capture", CaptureBody(0), func(c *gin.Context) {
+				first, _ := ioutil.ReadAll(c.Request.Body)
+				second, _ := readBody(c)
+				third, _ := c.Request.Body.(*CapturedBody).Bytes()
+				c.String(http.StatusOK, string(first)+"|"+string(second)+"|"+string(third))
+			})
+			req := performRequest(captureEngine, "PUT", "/capture", nil, strings.NewReader("data"))
+			So(req.Body.String(), ShouldEqual, "data|data|data")
+		})
+
+		Convey("The captured bodies above the threshold are spooled until the end of the request", func() {
+			var spooled []*CapturedBody
+			spoolEngine := gin.New()
+			spoolEngine.PUT("/capture", CaptureBody(8), func(c *gin.Context) {
+				body := c.Request.Body.(*CapturedBody)
+				spooled = append(spooled, body)
+				first, _ := ioutil.ReadAll(c.Request.Body)
+				second, _ := readBody(c)
+				third, _ := ioutil.ReadAll(body.NewReader())
+				c.String(http.StatusOK, string(first)+"|"+string(second)+"|"+string(third))
+			})
+			req := performRequest(spoolEngine, "PUT", "/capture", nil, strings.NewReader("12345678"))
+			So(req.Body.String(), ShouldEqual, "12345678|12345678|12345678")
+			So(spooled[0].Spooled(), ShouldBeFalse)
+
+			req = performRequest(spoolEngine, "PUT", "/capture", nil, strings.NewReader("large payload"))
+			So(req.Body.String(), ShouldEqual, "large payload|large payload|large payload")
+			So(spooled[1].Spooled(), ShouldBeTrue)
+			So(spooled[1].Size(), ShouldEqual, 13)
+			_, err := os.Stat(spooled[1].spool.Name())
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("The spooled indexed bodies are taken over by their persistence", func() {
+			var persist *S3Persist
+			spoolEngine := gin.New()
+			spoolEngine.PUT("/persist", CaptureBody(8), func(c *gin.Context) {
+				persist, _ = NewS3Persist("content", true, c)
+			})
+			performRequest(spoolEngine, "PUT", "/persist", nil, strings.NewReader("large payload"))
+			So(persist.spool, ShouldNotBeNil)
+			So(persist.spoolSize, ShouldEqual, 13)
+			So(persist.Checksum, ShouldEqual, "a315c4b0810a28f638248a8221d9bfdcc83b11799dd14f3a69d2aacfcaf73273eea616b0e0c3fb3b9d1f97a1232db518")
+			// The request is over, but the spool stays until the persistence is done.
+			data, _ := ioutil.ReadAll(persist.spool)
+			So(string(data), ShouldEqual, "large payload")
+			spoolName := persist.spool.Name()
+			persist.release()
+			_, err := os.Stat(spoolName)
+			So(os.IsNotExist(err), ShouldBeTrue)
+		})
+
+		Convey("The content provider auth does not consume the body", func() {
+			providerCache.Set("testAccessKey", &ContentProviderInfo{id: 1, secret: "testSecret"}, 0)
+			req, auth := signedProviderRequest(client.NewSigner("testAccessKey", "testSecret"), "signed data")
+			So(ContentProviderMgr{}.CheckHeader(auth, req), ShouldBeNil)
+			body, _ := ioutil.ReadAll(req.Body)
+			So(string(body), ShouldEqual, "signed data")
+			providerCache.Delete("testAccessKey")
+		})
+
+		Convey("The limit of each group comes from the configuration", func() {
+			cfg := &Config{BodyLimits: map[string]int64{"analytics": 2048}}
+			So(cfg.BodyLimit("analytics"), ShouldEqual, 2048)
+			So(cfg.BodyLimit("unknown"), ShouldEqual, DefaultMaxBody)
+		})
+
+		Convey("Spooled bodies can be read back", func() {
+			file, size, err := spoolBody(strings.NewReader("large payload"))
+			So(err, ShouldBeNil)
+			So(size, ShouldEqual, 13)
+			data, _ := ioutil.ReadAll(file)
+			So(string(data), ShouldEqual, "large payload")
+			file.Close()
+			os.Remove(file.Name())
+		})
+	})
+}
@@ -0,0 +1,190 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// MaxBatchEvents is the maximum number of events which goswift accepts in a single batch.
+	MaxBatchEvents = 500
+	// DefaultMaxRetries is how many times a failed request is retried by default.
+	DefaultMaxRetries = 3
+	// DefaultBackoff is the wait before the first retry by default. It doubles at each retry.
+	DefaultBackoff = time.Millisecond * 500
+)
+
+// Event is an analytics event, as accepted by PUT /analytics/record and PUT /analytics/batch.
+type Event struct {
+	EventType  string                 `json:"event_type"`
+	Timestamp  time.Time              `json:"timestamp"`
+	SessionID  string                 `json:"session_id"`
+	Properties map[string]interface{} `json:"properties,omitempty"`
+}
+
+// BatchResult is the outcome of a single event of a batch.
+type BatchResult struct {
+	Index  int               `json:"index"`
+	Status string            `json:"status"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// BatchResponse is the response of PUT /analytics/batch.
+type BatchResponse struct {
+	Accepted int            `json:"accepted"`
+	Rejected int            `json:"rejected"`
+	Results  []*BatchResult `json:"results"`
+}
+
+// APIError is an error response of goswift.
+type APIError struct {
+	Status     int
+	Code       string            `json:"code"`
+	Detail     string            `json:"detail"`
+	Fields     map[string]string `json:"fields"`
+	RetryAfter time.Duration     // From the Retry-After header, if any.
+	Body       []byte            // Raw response, which may carry more details, e.g. the results of a rejected batch.
+}
+
+// newAPIError returns the APIError of the response, whose body was already read.
+func newAPIError(resp *http.Response, body []byte) *APIError {
+	apiErr := &APIError{Status: resp.StatusCode, Body: body}
+	json.Unmarshal(body, apiErr)
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+	return apiErr
+}
+
+// Error returns the status, the code and the detail of the error.
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("goswift: %d %s", e.Status, e.Code)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	return msg
+}
+
+// Temporary returns whether the request may succeed if retried as is.
+func (e *APIError) Temporary() bool {
+	return e.Status >= 500 || e.Status == http.StatusTooManyRequests
+}
+
+// TokenRejected returns whether the perishable token was rejected, in which case another token may succeed.
+func (e *APIError) TokenRejected() bool {
+	return e.Status == http.StatusUnauthorized && strings.HasPrefix(e.Code, "token_")
+}
+
+// Client sends analytics events to goswift, authenticated with the tokens of its TokenSource.
+// The requests which fail on the network, on a temporary error or on a rejected token are retried.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	Tokens     *TokenSource
+	MaxRetries int
+	Backoff    time.Duration
+}
+
+// NewClient returns a Client of the goswift at baseURL, with its own TokenSource.
+func NewClient(baseURL string) *Client {
+	tokens := NewTokenSource(baseURL, nil)
+	return &Client{BaseURL: tokens.BaseURL, HTTPClient: tokens.HTTPClient, Tokens: tokens,
+		MaxRetries: DefaultMaxRetries, Backoff: DefaultBackoff}
+}
+
+// Record sends a single event to PUT /analytics/record.
+func (c *Client) Record(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return c.do("PUT", "/analytics/record", body, nil)
+}
+
+// SendBatch sends the events to PUT /analytics/batch, which only spends one use of the token.
+// The events which goswift rejects are reported in the results. If it rejects all of them, the results
+// are returned along with the APIError.
+func (c *Client) SendBatch(events []*Event) (*BatchResponse, error) {
+	if len(events) > MaxBatchEvents {
+		return nil, fmt.Errorf("a batch must contain at most %d events", MaxBatchEvents)
+	}
+	body, err := json.Marshal(events)
+	if err != nil {
+		return nil, err
+	}
+	resp := &BatchResponse{}
+	if err := c.do("PUT", "/analytics/batch", body, resp); err != nil {
+		if apiErr, ok := err.(*APIError); ok && apiErr.Code == "validation_failed" {
+			json.Unmarshal(apiErr.Body, resp)
+			return resp, err
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// do sends the request, and retries it with an exponential backoff while the failure is retryable.
+// A rejected token is replaced and retried at once. goswift persists the events of a rejected token too,
+// as unauthenticated, so they may be recorded twice.
+func (c *Client) do(method string, path string, body []byte, out interface{}) error {
+	for attempt := 0; ; attempt++ {
+		retry, err := c.attempt(method, path, body, out)
+		if err == nil || !retry || attempt >= c.MaxRetries {
+			return err
+		}
+		apiErr, isAPIErr := err.(*APIError)
+		if isAPIErr && apiErr.TokenRejected() {
+			continue
+		}
+		wait := c.Backoff << uint(attempt)
+		if isAPIErr && apiErr.RetryAfter > wait {
+			wait = apiErr.RetryAfter
+		}
+		time.Sleep(wait)
+	}
+}
+
+// attempt sends the request once, and returns whether it may be retried if it failed.
+func (c *Client) attempt(method string, path string, body []byte, out interface{}) (retry bool, err error) {
+	token, err := c.Tokens.Use()
+	if err != nil {
+		apiErr, isAPIErr := err.(*APIError)
+		return !isAPIErr || apiErr.Temporary(), err
+	}
+	req, err := http.NewRequest(method, c.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Authorization", TokenPrefix+" "+token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return true, err
+	}
+	if resp.StatusCode >= 300 {
+		apiErr := newAPIError(resp, data)
+		if apiErr.TokenRejected() {
+			c.Tokens.Invalidate(token)
+			return true, apiErr
+		}
+		return apiErr.Temporary(), apiErr
+	}
+	if out != nil && len(data) > 0 {
+		if err := json.Unmarshal(data, out); err != nil {
+			return false, fmt.Errorf("invalid response: %s", err)
+		}
+	}
+	return false, nil
+}
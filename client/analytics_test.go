@@ -0,0 +1,91 @@
+package client
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testEvent returns a valid analytics event of the session.
+func testEvent(sessionID string) *Event {
+	return &Event{EventType: "page_view", Timestamp: time.Now(), SessionID: sessionID,
+		Properties: map[string]interface{}{"url_path": "/awesome/link"}}
+}
+
+// TestClient tests the analytics requests and their retries.
+func TestClient(t *testing.T) {
+	Convey("The client tests, ", t, func() {
+		fake := newFakeGoswift(3)
+		server := httptest.NewServer(fake)
+		defer server.Close()
+		client := NewClient(server.URL)
+		client.Backoff = time.Millisecond
+
+		Convey("The events are recorded one by one or in batches", func() {
+			So(client.Record(testEvent("s1")), ShouldBeNil)
+			resp, err := client.SendBatch([]*Event{testEvent("s2"), testEvent("s3")})
+			So(err, ShouldBeNil)
+			So(resp.Accepted, ShouldEqual, 2)
+			So(len(resp.Results), ShouldEqual, 2)
+			So(len(fake.events), ShouldEqual, 3)
+			So(fake.events[2].SessionID, ShouldEqual, "s3")
+			So(fake.uses["token1"], ShouldEqual, 2)
+
+			tooMany := make([]*Event, MaxBatchEvents+1)
+			_, err = client.SendBatch(tooMany)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The tokens are rotated before their limit", func() {
+			for i := 0; i < 4; i++ {
+				So(client.Record(testEvent("s1")), ShouldBeNil)
+			}
+			So(fake.issued, ShouldEqual, 2)
+			So(fake.uses["token2"], ShouldEqual, 1)
+		})
+
+		Convey("A rejected token is replaced and the request retried", func() {
+			So(client.Record(testEvent("s1")), ShouldBeNil)
+			// The token was revoked or used elsewhere.
+			fake.uses["token1"] = fake.limit
+			So(client.Record(testEvent("s2")), ShouldBeNil)
+			So(fake.issued, ShouldEqual, 2)
+			So(len(fake.events), ShouldEqual, 2)
+		})
+
+		Convey("The temporary errors are retried with a backoff", func() {
+			fake.failures = 2
+			So(client.Record(testEvent("s1")), ShouldBeNil)
+			So(len(fake.events), ShouldEqual, 1)
+
+			fake.failures = client.MaxRetries + 1
+			err := client.Record(testEvent("s2"))
+			So(err, ShouldNotBeNil)
+			So(err.(*APIError).Status, ShouldEqual, 503)
+			So(len(fake.events), ShouldEqual, 1)
+		})
+
+		Convey("The client errors are not retried", func() {
+			calls := 0
+			rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/auth/token" {
+					fake.ServeHTTP(w, r)
+					return
+				}
+				calls++
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": "client error", "code": "validation_failed", "accepted": 0, "rejected": 1,
+					"results": [{"index": 0, "status": "rejected", "fields": {"session_id": "is required"}}]}`))
+			}))
+			defer rejecting.Close()
+			client = NewClient(rejecting.URL)
+			resp, err := client.SendBatch([]*Event{testEvent("")})
+			So(err, ShouldNotBeNil)
+			So(calls, ShouldEqual, 1)
+			So(resp.Rejected, ShouldEqual, 1)
+			So(resp.Results[0].Fields["session_id"], ShouldEqual, "is required")
+		})
+	})
+}
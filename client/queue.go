@@ -0,0 +1,133 @@
+package client
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultFlushInterval is how often an EventQueue sends its events when it is given no positive interval.
+const DefaultFlushInterval = time.Second * 5
+
+var (
+	// ErrQueueFull is returned when an event is recorded faster than the queue can send it.
+	ErrQueueFull = errors.New("the event queue is full")
+	// ErrQueueClosed is returned when an event is recorded after the queue was closed.
+	ErrQueueClosed = errors.New("the event queue is closed")
+)
+
+// EventQueue queues analytics events and sends them in batches from a background goroutine, as soon as
+// a batch is full and at least every interval. The batches which still fail after the retries of the
+// client are passed to the error handler, if any.
+type EventQueue struct {
+	client    *Client
+	batchSize int
+	interval  time.Duration
+	onError   func(events []*Event, err error)
+	events    chan *Event
+	flushes   chan chan struct{}
+	done      chan struct{}
+	mu        sync.RWMutex
+	closed    bool
+}
+
+// NewEventQueue returns a started EventQueue which sends its events with the client. The batch size is capped
+// to MaxBatchEvents, and up to ten batches may wait in the queue. An interval which is not positive is replaced
+// by DefaultFlushInterval.
+func NewEventQueue(client *Client, batchSize int, interval time.Duration, onError func(events []*Event, err error)) *EventQueue {
+	if batchSize <= 0 || batchSize > MaxBatchEvents {
+		batchSize = MaxBatchEvents
+	}
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	q := &EventQueue{client: client, batchSize: batchSize, interval: interval, onError: onError,
+		events: make(chan *Event, batchSize*10), flushes: make(chan chan struct{}), done: make(chan struct{})}
+	go q.run()
+	return q
+}
+
+// Record queues the event, whose timestamp is set to now if it is not set. It does not block.
+func (q *EventQueue) Record(event *Event) error {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	select {
+	case q.events <- event:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Flush sends all the queued events, and returns once they are sent or have failed.
+func (q *EventQueue) Flush() {
+	reply := make(chan struct{})
+	select {
+	case q.flushes <- reply:
+		<-reply
+	case <-q.done:
+	}
+}
+
+// Close sends the remaining events, and stops the queue.
+func (q *EventQueue) Close() {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.mu.Unlock()
+	<-q.done
+}
+
+// run batches the queued events until the queue is closed.
+func (q *EventQueue) run() {
+	defer close(q.done)
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+	var pending []*Event
+	for {
+		select {
+		case event, open := <-q.events:
+			if !open {
+				q.send(pending)
+				return
+			}
+			pending = append(pending, event)
+			if len(pending) >= q.batchSize {
+				q.send(pending)
+				pending = nil
+			}
+		case <-ticker.C:
+			q.send(pending)
+			pending = nil
+		case reply := <-q.flushes:
+			for queued := len(q.events); queued > 0; queued-- {
+				pending = append(pending, <-q.events)
+			}
+			q.send(pending)
+			pending = nil
+			close(reply)
+		}
+	}
+}
+
+// send sends the events in batches of at most the batch size.
+func (q *EventQueue) send(events []*Event) {
+	for len(events) > 0 {
+		batch := events
+		if len(batch) > q.batchSize {
+			batch = events[:q.batchSize]
+		}
+		events = events[len(batch):]
+		if _, err := q.client.SendBatch(batch); err != nil && q.onError != nil {
+			q.onError(batch, err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestEventQueue tests the batching of the queued events.
+func TestEventQueue(t *testing.T) {
+	Convey("The event queue tests, ", t, func() {
+		fake := newFakeGoswift(15)
+		server := httptest.NewServer(fake)
+		defer server.Close()
+		client := NewClient(server.URL)
+		client.Backoff = time.Millisecond
+
+		Convey("The events are sent in full batches, and the rest when closed", func() {
+			queue := NewEventQueue(client, 2, time.Hour, nil)
+			for i := 0; i < 5; i++ {
+				So(queue.Record(testEvent("s1")), ShouldBeNil)
+			}
+			queue.Close()
+			So(len(fake.events), ShouldEqual, 5)
+			So(fake.batches, ShouldEqual, 3)
+			So(queue.Record(testEvent("s1")), ShouldEqual, ErrQueueClosed)
+		})
+
+		Convey("The events are sent on flush and every interval", func() {
+			queue := NewEventQueue(client, 10, time.Millisecond*20, nil)
+			defer queue.Close()
+			queue.Record(&Event{EventType: "page_view", SessionID: "s1"})
+			queue.Flush()
+			So(len(fake.events), ShouldEqual, 1)
+			So(fake.events[0].Timestamp.IsZero(), ShouldBeFalse)
+
+			queue.Record(testEvent("s2"))
+			time.Sleep(time.Millisecond * 100)
+			fake.mu.Lock()
+			So(len(fake.events), ShouldEqual, 2)
+			fake.mu.Unlock()
+		})
+
+		Convey("A queue without a positive interval flushes every DefaultFlushInterval", func() {
+			queue := NewEventQueue(client, 10, 0, nil)
+			So(queue.interval, ShouldEqual, DefaultFlushInterval)
+			queue.Record(testEvent("s1"))
+			queue.Close()
+			So(len(fake.events), ShouldEqual, 1)
+		})
+
+		Convey("The batches which fail are passed to the error handler", func() {
+			var failed []*Event
+			fake.failures = client.MaxRetries + 1
+			queue := NewEventQueue(client, 10, time.Hour, func(events []*Event, err error) {
+				failed = append(failed, events...)
+			})
+			queue.Record(testEvent("s1"))
+			queue.Close()
+			So(len(failed), ShouldEqual, 1)
+			So(len(fake.events), ShouldEqual, 0)
+		})
+	})
+}
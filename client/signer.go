@@ -0,0 +1,248 @@
+// Package client is the Go client of goswift. It sends analytics events with perishable tokens, which it
+// rotates, and signs the requests of the content providers.
+//
+// A signed request carries the date of the request and an Authorization header:
+//
+//	X-GoSwift-Date: 20261019T120000Z
+//	Authorization: GoSwift HMAC-SHA256:<access key>:<signed headers>:<signature>
+//
+// The algorithm is HMAC-SHA256, HMAC-SHA384 or HMAC-SHA512, among those allowed for the provider. The signed
+// headers are the lowercase names of the signed headers, sorted and separated by semicolons. They must include
+// host and x-goswift-date. The signature is the lowercase hex HMAC of the string to sign with the secret key:
+//
+//	<algorithm>\n
+//	<value of X-GoSwift-Date>\n
+//	<hex hash of the canonical request>
+//
+// The canonical request is, with the hash function of the algorithm for the hashes:
+//
+//	<method>\n
+//	<escaped path, or / if empty>\n
+//	<query parameters, escaped and sorted by name then value, as name=value separated by &>\n
+//	<one name:value line for each signed header, in the order of the signed headers>\n
+//	<signed headers>\n
+//	<hex hash of the body>
+//
+// The values of the headers are trimmed, their inner spaces collapsed, and the values of a repeated header are
+// separated by commas. The value of host is the host of the request, as received by goswift.
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// AuthScheme is the prefix of the Authorization header of the signed requests.
+	AuthScheme = "GoSwift"
+	// DateHeader is the header with the date of the signed requests.
+	DateHeader = "X-GoSwift-Date"
+	// DateFormat is the format of the date header, always in UTC.
+	DateFormat = "20060102T150405Z"
+	// DefaultAlgorithm is the algorithm used unless another one is chosen.
+	DefaultAlgorithm = "HMAC-SHA256"
+)
+
+// Algorithms are the hash functions of the supported signing algorithms.
+var Algorithms = map[string]func() hash.Hash{
+	"HMAC-SHA256": sha256.New,
+	"HMAC-SHA384": sha512.New384,
+	"HMAC-SHA512": sha512.New,
+}
+
+// RequiredHeaders are the headers which every signature must cover.
+var RequiredHeaders = []string{"host", "x-goswift-date"}
+
+// Credential is the content of the Authorization header of a signed request, after the scheme.
+type Credential struct {
+	Algorithm     string
+	AccessKey     string
+	SignedHeaders []string
+	Signature     string
+}
+
+// String returns the credential as it is written in the Authorization header.
+func (c *Credential) String() string {
+	return strings.Join([]string{c.Algorithm, c.AccessKey, strings.Join(c.SignedHeaders, ";"), c.Signature}, ":")
+}
+
+// ParseCredential parses the credential of the Authorization header, without the scheme.
+// It checks the format only: the algorithm may still not be allowed and the signature may be wrong.
+func ParseCredential(raw string) (*Credential, error) {
+	parts := strings.Split(raw, ":")
+	if len(parts) != 4 {
+		return nil, errors.New("the credential must be algorithm:access-key:signed-headers:signature")
+	}
+	cred := &Credential{parts[0], parts[1], strings.Split(parts[2], ";"), strings.ToLower(parts[3])}
+	if _, supported := Algorithms[cred.Algorithm]; !supported {
+		return nil, fmt.Errorf("unsupported algorithm `%s`", cred.Algorithm)
+	}
+	if cred.AccessKey == "" || cred.Signature == "" {
+		return nil, errors.New("the access key and the signature are required")
+	}
+	for i, name := range cred.SignedHeaders {
+		if name == "" || name != strings.ToLower(name) || (i > 0 && name <= cred.SignedHeaders[i-1]) {
+			return nil, errors.New("the signed headers must be lowercase, sorted and unique")
+		}
+	}
+	for _, required := range RequiredHeaders {
+		if !cred.Signs(required) {
+			return nil, fmt.Errorf("the signed headers must include %s", required)
+		}
+	}
+	return cred, nil
+}
+
+// Signs returns whether the header is one of the signed headers.
+func (c *Credential) Signs(name string) bool {
+	for _, signed := range c.SignedHeaders {
+		if signed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Hash returns the lowercase hex hash of the data with the hash function of the algorithm.
+func Hash(algorithm string, data []byte) (string, error) {
+	hashFunction, supported := Algorithms[algorithm]
+	if !supported {
+		return "", fmt.Errorf("unsupported algorithm `%s`", algorithm)
+	}
+	h := hashFunction()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Signature returns the lowercase hex HMAC of the string to sign with the secret key.
+func Signature(algorithm string, secret string, stringToSign string) (string, error) {
+	hashFunction, supported := Algorithms[algorithm]
+	if !supported {
+		return "", fmt.Errorf("unsupported algorithm `%s`", algorithm)
+	}
+	mac := hmac.New(hashFunction, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// CanonicalRequest returns the canonical request of the request, whose body has the provided hash.
+// The signed headers must be lowercase and sorted, as they are in a Credential.
+func CanonicalRequest(req *http.Request, signedHeaders []string, bodyHash string) string {
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var params []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(value))
+		}
+	}
+	var headers []string
+	for _, name := range signedHeaders {
+		headers = append(headers, name+":"+canonicalHeaderValue(req, name))
+	}
+	return strings.Join([]string{strings.ToUpper(req.Method), path, strings.Join(params, "&"),
+		strings.Join(headers, "\n"), strings.Join(signedHeaders, ";"), bodyHash}, "\n")
+}
+
+// canonicalHeaderValue returns the trimmed values of the header, with their inner spaces collapsed.
+func canonicalHeaderValue(req *http.Request, name string) string {
+	values := req.Header[http.CanonicalHeaderKey(name)]
+	if name == "host" {
+		host := req.Host
+		if host == "" {
+			host = req.URL.Host
+		}
+		values = []string{host}
+	}
+	canonical := make([]string, len(values))
+	for i, value := range values {
+		canonical[i] = strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(canonical, ",")
+}
+
+// StringToSign returns the string whose HMAC is the signature of the request.
+func StringToSign(algorithm string, date string, canonicalRequest string) (string, error) {
+	canonicalHash, err := Hash(algorithm, []byte(canonicalRequest))
+	if err != nil {
+		return "", err
+	}
+	return algorithm + "\n" + date + "\n" + canonicalHash, nil
+}
+
+// Signer signs the requests of a content provider.
+type Signer struct {
+	AccessKey string
+	SecretKey string
+	Algorithm string
+	// Headers are the headers to sign in addition to the required ones, e.g. content-type.
+	Headers []string
+	// Now returns the date of the requests. It is time.Now unless set.
+	Now func() time.Time
+}
+
+// NewSigner returns a Signer of the provider key, which signs with DefaultAlgorithm.
+func NewSigner(accessKey string, secretKey string) *Signer {
+	return &Signer{AccessKey: accessKey, SecretKey: secretKey, Algorithm: DefaultAlgorithm}
+}
+
+// Sign sets the date and the Authorization header of the request, whose body is provided since it cannot be
+// read back from the request. The request must not be modified afterwards.
+func (s *Signer) Sign(req *http.Request, body []byte) error {
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	date := now().UTC().Format(DateFormat)
+	req.Header.Set(DateHeader, date)
+
+	signedHeaders := append([]string(nil), RequiredHeaders...)
+	for _, name := range s.Headers {
+		name = strings.ToLower(name)
+		if !containsString(signedHeaders, name) {
+			signedHeaders = append(signedHeaders, name)
+			sort.Strings(signedHeaders)
+		}
+	}
+	bodyHash, err := Hash(s.Algorithm, body)
+	if err != nil {
+		return err
+	}
+	stringToSign, err := StringToSign(s.Algorithm, date, CanonicalRequest(req, signedHeaders, bodyHash))
+	if err != nil {
+		return err
+	}
+	signature, err := Signature(s.Algorithm, s.SecretKey, stringToSign)
+	if err != nil {
+		return err
+	}
+	cred := &Credential{s.Algorithm, s.AccessKey, signedHeaders, signature}
+	req.Header.Set("Authorization", AuthScheme+" "+cred.String())
+	return nil
+}
+
+// containsString returns whether the sorted list contains the value.
+func containsString(sorted []string, value string) bool {
+	i := sort.SearchStrings(sorted, value)
+	return i < len(sorted) && sorted[i] == value
+}
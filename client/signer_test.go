@@ -0,0 +1,71 @@
+package client
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSigner tests the signatures against the documented format.
+func TestSigner(t *testing.T) {
+	Convey("The signer tests, ", t, func() {
+		body := `{"id":1}`
+		newRequest := func() *http.Request {
+			req, _ := http.NewRequest("PUT", "https://goswift.example.com/content/items?b=2&a=1", strings.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			return req
+		}
+		signer := NewSigner("AK", "secret")
+		signer.Headers = []string{"Content-Type"}
+		signer.Now = func() time.Time { return time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC) }
+
+		Convey("The canonical request follows the documented format", func() {
+			req := newRequest()
+			req.Header.Set(DateHeader, "20261019T120000Z")
+			req.Header.Add("X-Multi", "  first   value ")
+			req.Header.Add("X-Multi", "second")
+			bodyHash, _ := Hash("HMAC-SHA256", []byte(body))
+			So(CanonicalRequest(req, []string{"content-type", "host", "x-goswift-date", "x-multi"}, bodyHash), ShouldEqual,
+				"PUT\n/content/items\na=1&b=2\ncontent-type:application/json\nhost:goswift.example.com\n"+
+					"x-goswift-date:20261019T120000Z\nx-multi:first value,second\ncontent-type;host;x-goswift-date;x-multi\n"+bodyHash)
+		})
+
+		Convey("The signatures match the reference signatures", func() {
+			expected := map[string]string{
+				"HMAC-SHA256": "0b442982701265f20fcd6db93ee1d6330d2036cb1e2e13ab6b70ad81b99c9233",
+				"HMAC-SHA512": "1fa69779b6973a86463f31d602b0025315a533c0b9f919068f4d9de8b83dab42" +
+					"62e34c86a0dee53d208f661cba1ec536362586eb68831abd2a380f0d8452143b",
+			}
+			for algorithm, signature := range expected {
+				signer.Algorithm = algorithm
+				req := newRequest()
+				So(signer.Sign(req, []byte(body)), ShouldBeNil)
+				So(req.Header.Get(DateHeader), ShouldEqual, "20261019T120000Z")
+				So(req.Header.Get("Authorization"), ShouldEqual,
+					"GoSwift "+algorithm+":AK:content-type;host;x-goswift-date:"+signature)
+			}
+			signer.Algorithm = "HMAC-MD5"
+			So(signer.Sign(newRequest(), []byte(body)), ShouldNotBeNil)
+		})
+
+		Convey("The credentials are parsed back", func() {
+			req := newRequest()
+			signer.Sign(req, []byte(body))
+			cred, err := ParseCredential(strings.TrimPrefix(req.Header.Get("Authorization"), AuthScheme+" "))
+			So(err, ShouldBeNil)
+			So(cred.Algorithm, ShouldEqual, DefaultAlgorithm)
+			So(cred.AccessKey, ShouldEqual, "AK")
+			So(cred.SignedHeaders, ShouldResemble, []string{"content-type", "host", "x-goswift-date"})
+			So(cred.Signs("content-type"), ShouldBeTrue)
+
+			for _, invalid := range []string{"", "HMAC-SHA256:AK:host;x-goswift-date", "HMAC-SHA1:AK:host;x-goswift-date:abc",
+				"HMAC-SHA256::host;x-goswift-date:abc", "HMAC-SHA256:AK:Host;x-goswift-date:abc",
+				"HMAC-SHA256:AK:x-goswift-date;host:abc", "HMAC-SHA256:AK:content-type;host:abc"} {
+				_, err = ParseCredential(invalid)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// TokenPrefix is the prefix of the Authorization header of the requests authenticated with a perishable token.
+	TokenPrefix = "DecayingToken"
+	// DefaultTokenMargin is how long before its expiry a token is replaced by default.
+	DefaultTokenMargin = time.Minute
+)
+
+// Token is a perishable token, as returned by GET /auth/token.
+type Token struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+	Limit   int       `json:"limit"` // Number of uses of the token.
+}
+
+// TokenSource hands out the perishable tokens of goswift, and replaces them before their limit or their expiry.
+// It is safe for concurrent use.
+type TokenSource struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Margin is how long before its expiry a token is replaced, so that it does not expire in flight.
+	Margin time.Duration
+	// Now returns the current time. It is time.Now unless set.
+	Now func() time.Time
+
+	mu    sync.Mutex
+	token *Token
+	uses  int
+}
+
+// NewTokenSource returns a TokenSource of the goswift at baseURL, e.g. https://goswift.sparrho.com.
+func NewTokenSource(baseURL string, httpClient *http.Client) *TokenSource {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &TokenSource{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTPClient: httpClient, Margin: DefaultTokenMargin}
+}
+
+// Fetch returns a new token from GET /auth/token. It does not replace the current token.
+func (s *TokenSource) Fetch() (*Token, error) {
+	req, err := http.NewRequest("GET", s.BaseURL+"/auth/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp, data)
+	}
+	token := &Token{}
+	if err := json.Unmarshal(data, token); err != nil || token.Token == "" {
+		return nil, fmt.Errorf("invalid token response: %s", data)
+	}
+	return token, nil
+}
+
+// Use returns the current token and counts one use of it. The token is replaced first if it has no use left,
+// or if it expires within the margin. A limit of 0 means unlimited uses.
+func (s *TokenSource) Use() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now
+	if s.Now != nil {
+		now = s.Now
+	}
+	if s.token == nil || (s.token.Limit > 0 && s.uses >= s.token.Limit) || !now().Add(s.Margin).Before(s.token.Expires) {
+		token, err := s.Fetch()
+		if err != nil {
+			return "", err
+		}
+		s.token, s.uses = token, 0
+	}
+	s.uses++
+	return s.token.Token, nil
+}
+
+// Invalidate drops the token if it is still the current one, e.g. after goswift rejected it, so that
+// the next use fetches a new token.
+func (s *TokenSource) Invalidate(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.token != nil && s.token.Token == token {
+		s.token = nil
+	}
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGoswift is an http.Handler which issues perishable tokens and records the analytics events like goswift.
+type fakeGoswift struct {
+	mu       sync.Mutex
+	limit    int
+	issued   int
+	uses     map[string]int
+	failures int // Number of the next analytics requests which fail with a 503.
+	events   []*Event
+	batches  int
+}
+
+// newFakeGoswift returns a fakeGoswift whose tokens have the provided limit of uses.
+func newFakeGoswift(limit int) *fakeGoswift {
+	return &fakeGoswift{limit: limit, uses: make(map[string]int)}
+}
+
+// ServeHTTP serves GET /auth/token, PUT /analytics/record and PUT /analytics/batch.
+func (f *fakeGoswift) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	if r.URL.Path == "/auth/token" {
+		f.issued++
+		token := fmt.Sprintf("token%d", f.issued)
+		f.uses[token] = 0
+		json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "limit": f.limit,
+			"expires": time.Now().Add(time.Minute * 15).Format(time.RFC3339)})
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), TokenPrefix+" ")
+	uses, exists := f.uses[token]
+	switch {
+	case !exists:
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "unauthorized", "code": "token_unknown"}`))
+		return
+	case uses >= f.limit:
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "unauthorized", "code": "token_exhausted"}`))
+		return
+	}
+	f.uses[token]++
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error": "service unavailable", "code": "service_unavailable"}`))
+		return
+	}
+	var events []*Event
+	if r.URL.Path == "/analytics/batch" {
+		json.NewDecoder(r.Body).Decode(&events)
+		f.batches++
+	} else {
+		event := &Event{}
+		json.NewDecoder(r.Body).Decode(event)
+		events = []*Event{event}
+	}
+	f.events = append(f.events, events...)
+	w.WriteHeader(http.StatusAccepted)
+	results := make([]*BatchResult, len(events))
+	for i := range events {
+		results[i] = &BatchResult{Index: i, Status: "accepted"}
+	}
+	json.NewEncoder(w).Encode(&BatchResponse{Accepted: len(events), Results: results})
+}
+
+// TestTokenSource tests the rotation of the perishable tokens.
+func TestTokenSource(t *testing.T) {
+	Convey("The token source tests, ", t, func() {
+		fake := newFakeGoswift(3)
+		server := httptest.NewServer(fake)
+		defer server.Close()
+		tokens := NewTokenSource(server.URL+"/", nil)
+
+		Convey("The tokens are fetched with their expiry and limit", func() {
+			token, err := tokens.Fetch()
+			So(err, ShouldBeNil)
+			So(token.Token, ShouldEqual, "token1")
+			So(token.Limit, ShouldEqual, 3)
+			So(token.Expires.After(time.Now()), ShouldBeTrue)
+		})
+
+		Convey("A token is replaced when it has no use left", func() {
+			for i := 0; i < 3; i++ {
+				token, err := tokens.Use()
+				So(err, ShouldBeNil)
+				So(token, ShouldEqual, "token1")
+			}
+			token, _ := tokens.Use()
+			So(token, ShouldEqual, "token2")
+		})
+
+		Convey("A token is replaced before it expires", func() {
+			token, _ := tokens.Use()
+			So(token, ShouldEqual, "token1")
+			tokens.Now = func() time.Time { return time.Now().Add(time.Minute * 14) }
+			token, _ = tokens.Use()
+			So(token, ShouldEqual, "token2")
+		})
+
+		Convey("An invalidated token is replaced", func() {
+			token, _ := tokens.Use()
+			tokens.Invalidate("another")
+			next, _ := tokens.Use()
+			So(next, ShouldEqual, token)
+			tokens.Invalidate(token)
+			next, _ = tokens.Use()
+			So(next, ShouldEqual, "token2")
+		})
+
+		Convey("The errors of goswift are returned", func() {
+			failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte(`{"error": "service unavailable", "code": "service_unavailable"}`))
+			}))
+			defer failing.Close()
+			_, err := NewTokenSource(failing.URL, nil).Use()
+			So(err, ShouldNotBeNil)
+			So(err.(*APIError).Code, ShouldEqual, "service_unavailable")
+			So(err.(*APIError).Temporary(), ShouldBeTrue)
+		})
+	})
+}
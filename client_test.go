@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/Sparrho/goswift/client"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// persistedTokenUses returns the number of persisted events of each token in the bucket.
+func persistedTokenUses(bucket *memoryBucket) map[string]int {
+	bucket.mu.Lock()
+	defer bucket.mu.Unlock()
+	uses := make(map[string]int)
+	for _, data := range bucket.objects {
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var persisted PersistedEvent
+			if json.Unmarshal([]byte(line), &persisted) == nil && persisted.EventType != "" {
+				uses[persisted.Token]++
+			}
+		}
+	}
+	return uses
+}
+
+// TestClientPackage tests the client package against the goswift routes.
+func TestClientPackage(t *testing.T) {
+	Convey("The client package tests, ", t, func() {
+		redisServer := newFakeRedis()
+		defer redisServer.Close()
+		bucket := newMemoryBucket()
+		cfg, err := ParseConfig(testConfigValues())
+		So(err, ShouldBeNil)
+		server, err := NewServer(cfg, Dependencies{Redis: redisServer.Client(), Bucket: bucket, Providers: newMemoryProviderStore()})
+		So(err, ShouldBeNil)
+		defer server.Close()
+		httpServer := httptest.NewServer(server.Engine)
+		defer httpServer.Close()
+		c := client.NewClient(httpServer.URL)
+		c.Backoff = time.Millisecond
+		event := func() *client.Event {
+			return &client.Event{EventType: "page_view", Timestamp: time.Now(), SessionID: "session",
+				Properties: map[string]interface{}{"url_path": "/awesome/link"}}
+		}
+
+		Convey("The tokens are rotated before goswift rejects them", func() {
+			for i := 0; i < NonceLimit+1; i++ {
+				So(c.Record(event()), ShouldBeNil)
+			}
+			server.persisterWg.Wait()
+			uses := persistedTokenUses(bucket)
+			So(len(uses), ShouldEqual, 2)
+			for _, count := range uses {
+				So(count == NonceLimit || count == 1, ShouldBeTrue)
+			}
+		})
+
+		Convey("A revoked token is replaced", func() {
+			token, err := c.Tokens.Use()
+			So(err, ShouldBeNil)
+			server.Redis.Del(PerishableRedisKey(token))
+			revokeCachedToken(token)
+			So(c.Record(event()), ShouldBeNil)
+			server.persisterWg.Wait()
+			uses := persistedTokenUses(bucket)
+			So(len(uses), ShouldEqual, 2)
+		})
+
+		Convey("The queued events are sent in batches with one token use each", func() {
+			var failed []*client.Event
+			queue := client.NewEventQueue(c, 2, time.Hour, func(events []*client.Event, err error) {
+				failed = append(failed, events...)
+			})
+			for i := 0; i < 5; i++ {
+				So(queue.Record(event()), ShouldBeNil)
+			}
+			queue.Record(&client.Event{EventType: "Invalid Type", SessionID: "session"})
+			queue.Close()
+			So(len(failed), ShouldEqual, 0)
+			server.persisterWg.Wait()
+			uses := persistedTokenUses(bucket)
+			So(len(uses), ShouldEqual, 1)
+			for token, count := range uses {
+				So(count, ShouldEqual, 5)
+				cached, _ := perishableCache.Get(token)
+				So(cached.(*PerishableInfo).Hits, ShouldEqual, 3)
+			}
+
+			resp, err := c.SendBatch([]*client.Event{{EventType: "Invalid Type", SessionID: "session"}})
+			So(err, ShouldNotBeNil)
+			So(resp.Rejected, ShouldEqual, 1)
+			So(resp.Results[0].Fields["event_type"], ShouldNotBeBlank)
+		})
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"sync"
 )
 
 // IndexGet redirects to sparrho.com
@@ -10,12 +11,58 @@ func IndexGet(c *gin.Context) {
 	c.Redirect(http.StatusSeeOther, "http://www.sparrho.com/")
 }
 
-// SuccessJSON returns a JSON saying which method was used.
+// SuccessJSON returns a JSON (or the negotiated encoding) saying which method was used.
 func SuccessJSON(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{"method": c.Request.Method})
+	Render(c, http.StatusOK, gin.H{"method": c.Request.Method})
 }
 
-// RecordAnalytics handles the recording of an analytics event.
-func RecordAnalytics(c *gin.Context) {
-	c.String(http.StatusAccepted, "")
+// NewRecordAnalyticsHandler returns the handler which validates the analytics event and starts its persistence.
+func NewRecordAnalyticsHandler(persistChan chan<- *S3Persist, wg *sync.WaitGroup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		event, reqErr := readAnalyticsEvent(c)
+		if reqErr == nil {
+			reqErr = persistAnalytics(c, persistChan, wg, []*AnalyticsEvent{event})
+		}
+		if reqErr != nil {
+			reqErr.Respond(c)
+			return
+		}
+		c.String(http.StatusAccepted, "")
+	}
+}
+
+// NewRecordAnalyticsBatchHandler returns the handler which validates the events of a batch, starts the persistence
+// of the valid ones and returns the result of each event. The batch is rejected if no event is valid.
+func NewRecordAnalyticsBatchHandler(persistChan chan<- *S3Persist, wg *sync.WaitGroup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		events, results, reqErr := readAnalyticsBatch(c)
+		if reqErr != nil {
+			reqErr.Respond(c)
+			return
+		}
+		if len(events) == 0 {
+			StatusValidationFailed.Respond(c, gin.H{"accepted": 0, "rejected": len(results), "results": results})
+			return
+		}
+		if reqErr := persistAnalytics(c, persistChan, wg, events); reqErr != nil {
+			reqErr.Respond(c)
+			return
+		}
+		Render(c, http.StatusAccepted, gin.H{"accepted": len(events), "rejected": len(results) - len(events), "results": results})
+	}
+}
+
+// NewRecordContentHandler returns the handler which starts the persistence of the payload of a content provider.
+// Payloads are indexed by their checksum, so that the same payload is only stored once.
+func NewRecordContentHandler(persistChan chan<- *S3Persist, wg *sync.WaitGroup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		persist, reqErr := NewS3Persist("content", true, c)
+		if reqErr != nil {
+			reqErr.Respond(c)
+			return
+		}
+		wg.Add(1)
+		persistChan <- persist
+		Render(c, http.StatusAccepted, gin.H{"checksum": persist.Checksum})
+	}
 }
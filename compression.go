@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// zstdMaxWindow is the largest zstd window accepted in the request bodies.
+const zstdMaxWindow = 8 << 20
+
+// BodyDecoder returns a reader which decompresses the provided reader.
+type BodyDecoder func(io.Reader) (io.ReadCloser, error)
+
+// bodyDecoders stores the supported request Content-Encodings. Any other encoding gets a 415.
+var bodyDecoders = map[string]BodyDecoder{
+	"gzip": func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	},
+	// The window is capped to the 8 MB which the encoders use by default, so that a frame cannot make the server
+	// allocate more. An invalid frame fails either here or in DecompressBody's ReadAll.
+	"zstd": func(r io.Reader) (io.ReadCloser, error) {
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(zstdMaxWindow))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	},
+}
+
+// DecompressBody decompresses the request body according to its Content-Encoding, which must therefore run
+// before the auth managers read the body. The decompressed body is limited to maxSize bytes, which stops zip bombs.
+func DecompressBody(maxSize int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		encoding := strings.ToLower(strings.TrimSpace(c.Request.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" || c.Request.Body == nil {
+			return
+		}
+		decoder, supported := bodyDecoders[encoding]
+		if !supported {
+			(&RequestErr{415, nil}).Respond(c)
+			return
+		}
+		reader, err := decoder(c.Request.Body)
+		if err != nil {
+			decompressErr(err).Respond(c)
+			return
+		}
+		defer reader.Close()
+		defer c.Request.Body.Close()
+		body, err := ioutil.ReadAll(&limitedBody{reader, maxSize})
+		if err != nil {
+			decompressErr(err).Respond(c)
+			return
+		}
+		c.Request.Body = newCapturedBody(body)
+		c.Request.ContentLength = int64(len(body))
+		c.Request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		c.Request.Header.Del("Content-Encoding")
+	}
+}
+
+// decompressErr returns the RequestErr matching an error which happened while decompressing the body.
+// The compressed body itself may also be too large, hence the check on ErrBodyTooLarge.
+func decompressErr(err error) *RequestErr {
+	if err == ErrBodyTooLarge {
+		return &RequestErr{413, nil}
+	}
+	return &RequestErr{400, FieldErrors{"body": "could not be decompressed"}}
+}
+
+// encodeObject compresses the data with the provided encoding, or returns it as is if there is no encoding.
+func encodeObject(data []byte, encoding string) ([]byte, error) {
+	if encoding != "gzip" {
+		return data, nil
+	}
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeObject returns the plain data of an object which may have been stored compressed.
+// Objects are detected by their gzip magic number, because the HTTP client may have already decompressed them.
+func decodeObject(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/zstd"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// zstdCompress returns the data compressed in a single zstd frame.
+func zstdCompress(data []byte) []byte {
+	encoder, _ := zstd.NewWriter(nil)
+	defer encoder.Close()
+	return encoder.EncodeAll(data, nil)
+}
+
+// TestCompression tests the decompression of request bodies and the compression of persisted objects.
+func TestCompression(t *testing.T) {
+	Convey("The compression tests, ", t, func() {
+		engine := gin.New()
+		engine.PUT("/echo", DecompressBody(64), func(c *gin.Context) {
+			body, _ := ioutil.ReadAll(c.Request.Body)
+			c.String(http.StatusOK, string(body))
+		})
+
+		Convey("A gzip body is decompressed", func() {
+			data, _ := encodeObject([]byte("some event"), "gzip")
+			headers := map[string][]string{"Content-Encoding": {"gzip"}}
+			req := performRequest(engine, "PUT", "/echo", headers, bytes.NewReader(data))
+			So(req.Code, ShouldEqual, 200)
+			So(req.Body.String(), ShouldEqual, "some event")
+		})
+
+		Convey("A zstd body is decompressed", func() {
+			data := zstdCompress([]byte("some event"))
+			headers := map[string][]string{"Content-Encoding": {"zstd"}}
+			req := performRequest(engine, "PUT", "/echo", headers, bytes.NewReader(data))
+			So(req.Code, ShouldEqual, 200)
+			So(req.Body.String(), ShouldEqual, "some event")
+		})
+
+		Convey("A plain body is left untouched", func() {
+			req := performRequest(engine, "PUT", "/echo", map[string][]string{}, strings.NewReader("some event"))
+			So(req.Code, ShouldEqual, 200)
+			So(req.Body.String(), ShouldEqual, "some event")
+		})
+
+		Convey("A body which decompresses above the limit is rejected", func() {
+			data, _ := encodeObject(bytes.Repeat([]byte("a"), 65), "gzip")
+			headers := map[string][]string{"Content-Encoding": {"gzip"}}
+			So(performRequest(engine, "PUT", "/echo", headers, bytes.NewReader(data)).Code, ShouldEqual, 413)
+		})
+
+		Convey("A zstd body which decompresses above the limit is rejected", func() {
+			data := zstdCompress(bytes.Repeat([]byte("a"), 65))
+			headers := map[string][]string{"Content-Encoding": {"zstd"}}
+			So(performRequest(engine, "PUT", "/echo", headers, bytes.NewReader(data)).Code, ShouldEqual, 413)
+		})
+
+		Convey("An invalid gzip body is rejected", func() {
+			headers := map[string][]string{"Content-Encoding": {"gzip"}}
+			So(performRequest(engine, "PUT", "/echo", headers, strings.NewReader("not gzip")).Code, ShouldEqual, 400)
+		})
+
+		Convey("An invalid zstd body is rejected", func() {
+			headers := map[string][]string{"Content-Encoding": {"zstd"}}
+			So(performRequest(engine, "PUT", "/echo", headers, strings.NewReader("not zstd")).Code, ShouldEqual, 400)
+		})
+
+		Convey("A zstd frame with a window above the cap is rejected", func() {
+			// The frame header declares a 16 MB window, then a single raw block.
+			data := append([]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x70, 0x51, 0x00, 0x00}, "some event"...)
+			headers := map[string][]string{"Content-Encoding": {"zstd"}}
+			So(performRequest(engine, "PUT", "/echo", headers, bytes.NewReader(data)).Code, ShouldEqual, 400)
+		})
+
+		Convey("An unknown encoding is rejected", func() {
+			headers := map[string][]string{"Content-Encoding": {"br"}}
+			So(performRequest(engine, "PUT", "/echo", headers, strings.NewReader("data")).Code, ShouldEqual, 415)
+		})
+
+		Convey("Objects can be compressed and decoded back", func() {
+			data, err := encodeObject([]byte("line\n"), "gzip")
+			So(err, ShouldBeNil)
+			reader, err := gzip.NewReader(bytes.NewReader(data))
+			So(err, ShouldBeNil)
+			plain, _ := ioutil.ReadAll(reader)
+			So(string(plain), ShouldEqual, "line\n")
+			decoded, err := decodeObject(data)
+			So(err, ShouldBeNil)
+			So(string(decoded), ShouldEqual, "line\n")
+		})
+
+		Convey("Plain objects are decoded as is", func() {
+			decoded, err := decodeObject([]byte("line\n"))
+			So(err, ShouldBeNil)
+			So(string(decoded), ShouldEqual, "line\n")
+		})
+	})
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"github.com/op/go-logging"
+	"math"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Config is the whole Goswift configuration. It is loaded once on startup by LoadConfig, then passed to NewServer.
+type Config struct {
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
+	StorageBucket      string
+	RedisURL           string
+	DatabaseURL        string
+	MaxCPUs            int // 0 means all the CPUs.
+	LogLevel           logging.Level
+	LogFormat          string
+	ServerMode         string
+	Server             ServerSettings
+	TLS                TLSSettings
+	CORS               CORSConfig
+	BodyLimits         map[string]int64 // Maximum body size by route group.
+	PersistEncoding    string
+	Admin              AdminSettings
+	JWT                JWTSettings
+	Quotas             QuotaSettings
+	SecretOverlap      time.Duration // How long the previous secret of a rotated provider key stays valid.
+	Signing            SigningSettings
+}
+
+// BodyLimit returns the maximum body size of the provided route group.
+func (cfg *Config) BodyLimit(group string) int64 {
+	if limit, exists := cfg.BodyLimits[group]; exists {
+		return limit
+	}
+	return DefaultMaxBody
+}
+
+// configKeys lists all the configuration keys with their usage. Each key is the name of its environment variable,
+// its lower case version is its key in the configuration file, and with dashes instead of underscores it is its flag.
+var configKeys = []struct{ name, usage string }{
+	{"AWS_ACCESS_KEY_ID", "AWS access key (required)"},
+	{"AWS_SECRET_ACCESS_KEY", "AWS secret key (required)"},
+	{"AWS_STORAGE_BUCKET_NAME", "S3 bucket where the data is persisted (required)"},
+	{"REDIS_URL", "Redis URL, e.g. redis://:password@host:6379 (required)"},
+	{"DATABASE_URL", "Postgres URL (required)"},
+	{"MAX_CPUS", "number of CPUs to use, all of them by default"},
+	{"LOG_LEVEL", "log level, INFO by default"},
+	{"LOG_FORMAT", "log format: text (default) or json"},
+	{"SERVER_MODE", "gin mode: debug (default), release or test"},
+	{"SERVER_ADDR", "address to listen on"},
+	{"SERVER_PORT", "port to listen on, " + DefaultPort + " by default"},
+	{"SERVER_SOCKET", "Unix socket to listen on instead of the address and port"},
+	{"SERVER_SOCKET_MODE", "permissions of the Unix socket, in octal"},
+	{"SERVER_READ_TIMEOUT", "maximum duration to read a request, e.g. 30s"},
+	{"SERVER_READ_HEADER_TIMEOUT", "maximum duration to read the request headers"},
+	{"SERVER_WRITE_TIMEOUT", "maximum duration to write a response"},
+	{"SERVER_IDLE_TIMEOUT", "maximum duration of an idle keep-alive connection"},
+	{"SERVER_MAX_HEADER_BYTES", "maximum size of the request headers"},
+	{"SERVER_MAX_CONNS", "maximum number of concurrent connections, 0 for no limit"},
+	{"SERVER_KEEPALIVE", "whether keep-alives are enabled"},
+	{"SERVER_KEEPALIVE_PERIOD", "period of the TCP keep-alives"},
+	{"TLS_CERT_FILE", "TLS certificate file, which enables TLS along with the key"},
+	{"TLS_KEY_FILE", "TLS key file"},
+	{"TLS_MIN_VERSION", "minimum TLS version, from 1.0 to 1.3"},
+	{"TLS_CIPHER_SUITES", "comma separated TLS 1.0-1.2 cipher suites"},
+	{"HTTP2", "whether HTTP/2 is offered over TLS"},
+	{"CORS_ALLOWED_ORIGINS", "comma separated origins allowed by CORS, which is disabled without any"},
+	{"CORS_ALLOWED_METHODS", "comma separated methods allowed by CORS"},
+	{"CORS_ALLOWED_HEADERS", "comma separated request headers allowed by CORS"},
+	{"CORS_MAX_AGE", "how long browsers may cache preflights, in seconds"},
+	{"MAX_BODY_AUTH", "maximum body size on the auth routes, in bytes"},
+	{"MAX_BODY_ANALYTICS", "maximum body size of an analytics event, in bytes"},
+	{"MAX_BODY_BATCH", "maximum body size of a batch of analytics events, in bytes"},
+	{"MAX_BODY_PROVIDER", "maximum body size on the provider routes, in bytes"},
+	{"PERSIST_ENCODING", "encoding of the persisted objects: none (default) or gzip"},
+	{"ADMIN_KEYS", "comma separated admin API keys as name:sha256-hex-of-key:role|role, roles being " + strings.Join(AdminRoles, ", ")},
+	{"ADMIN_JWT_KEYS", "comma separated HS256 keys of the admin JWTs, as key-id:secret"},
+	{"ADMIN_JWT_ISSUER", "expected iss of the admin JWTs (required with ADMIN_JWT_KEYS)"},
+	{"ADMIN_JWT_AUDIENCE", "expected aud of the admin JWTs (required with ADMIN_JWT_KEYS)"},
+	{"JWT_JWKS", "file or URL of the JWKS of the identity service, which enables JWT bearer tokens on the analytics routes"},
+	{"JWT_JWKS_REFRESH", "how often the JWKS is loaded again"},
+	{"JWT_ISSUER", "expected iss of the JWTs (required with JWT_JWKS)"},
+	{"JWT_AUDIENCE", "expected aud of the JWTs (required with JWT_JWKS)"},
+	{"JWT_LEEWAY", "allowed clock skew on the exp and nbf of the JWTs, 0s allowing none"},
+	{"PROVIDER_QUOTA", "default quota of the content providers, as requests-per-minute:bytes-per-minute:requests-per-day:bytes-per-day, 0 meaning unlimited"},
+	{"PROVIDER_SECRET_OVERLAP", "how long the previous secret of a rotated provider key stays valid, e.g. 168h, 0s expiring it on rotation"},
+	{"SIGNING_ALGORITHMS", "comma separated signing algorithms allowed for the content providers, among HMAC-SHA256, HMAC-SHA384 and HMAC-SHA512 (default all)"},
+	{"PROVIDER_SIGNING_ALGORITHMS", "comma separated signing algorithms of specific content providers, as provider-id=algorithm|algorithm"},
+	{"SIGNING_MAX_SKEW", "how far the date of a signed request may be from the server time"},
+}
+
+// ConfigValues stores the raw configuration values by key.
+type ConfigValues map[string]string
+
+// ConfigErrors stores all the problems found in the configuration.
+type ConfigErrors []string
+
+// Error returns all the problems, one per line.
+func (e ConfigErrors) Error() string {
+	return "invalid configuration:\n\t" + strings.Join(e, "\n\t")
+}
+
+// LoadConfig loads the configuration from the environment variables, then from the optional configuration file
+// (set with -config or CONFIG_FILE), then from the command line flags. Each source overrides the previous one.
+// All the problems are returned at once as ConfigErrors.
+func LoadConfig(args []string) (*Config, error) {
+	values := make(ConfigValues)
+	for _, key := range configKeys {
+		if val, ok := syscall.Getenv(key.name); ok {
+			values[key.name] = val
+		}
+	}
+	flags := flag.NewFlagSet("goswift", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "optional YAML or TOML configuration file")
+	for _, key := range configKeys {
+		flags.String(configFlag(key.name), "", key.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	var errs ConfigErrors
+	if *configFile != "" {
+		fileValues, err := ReadConfigFile(*configFile)
+		if err != nil {
+			errs = append(errs, err.(ConfigErrors)...)
+		}
+		for key, val := range fileValues {
+			values[key] = val
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			values[strings.ToUpper(strings.Replace(f.Name, "-", "_", -1))] = f.Value.String()
+		}
+	})
+	cfg, err := ParseConfig(values)
+	if err != nil {
+		errs = append(errs, err.(ConfigErrors)...)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	return cfg, nil
+}
+
+// configFlag returns the flag name of a configuration key.
+func configFlag(key string) string {
+	return strings.ToLower(strings.Replace(key, "_", "-", -1))
+}
+
+// isConfigKey returns whether the key is a known configuration key.
+func isConfigKey(key string) bool {
+	for _, known := range configKeys {
+		if known.name == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadConfigFile reads a flat YAML (key: value) or TOML (key = value) configuration file, depending on its extension.
+// Only top level keys with scalar values are supported, which is all the configuration needs.
+func ReadConfigFile(path string) (ConfigValues, error) {
+	var sep string
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		sep = ":"
+	case ".toml":
+		sep = "="
+	default:
+		return nil, ConfigErrors{fmt.Sprintf("configuration file %s must be .yaml, .yml or .toml", path)}
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, ConfigErrors{fmt.Sprintf("could not open the configuration file: %s", err)}
+	}
+	defer file.Close()
+	values := make(ConfigValues)
+	var errs ConfigErrors
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || line == "---" {
+			continue
+		}
+		idx := strings.Index(line, sep)
+		if idx <= 0 || strings.HasPrefix(scanner.Text(), " ") || strings.HasPrefix(line, "[") {
+			errs = append(errs, fmt.Sprintf("%s:%d: expected a top level `key %s value`", path, lineNum, sep))
+			continue
+		}
+		key := strings.ToUpper(strings.TrimSpace(line[:idx]))
+		if !isConfigKey(key) {
+			errs = append(errs, fmt.Sprintf("%s:%d: unknown key `%s`", path, lineNum, strings.ToLower(key)))
+			continue
+		}
+		val, err := configFileValue(strings.TrimSpace(line[idx+1:]))
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s:%d: %s", path, lineNum, err))
+			continue
+		}
+		values[key] = val
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, fmt.Sprintf("could not read the configuration file: %s", err))
+	}
+	if len(errs) > 0 {
+		return values, errs
+	}
+	return values, nil
+}
+
+// configFileValue returns the scalar value of a file line, without its quotes or trailing comment.
+func configFileValue(raw string) (string, error) {
+	if strings.HasPrefix(raw, `"`) || strings.HasPrefix(raw, "'") {
+		end := strings.Index(raw[1:], raw[:1])
+		if end < 0 {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		if raw[:1] == `"` {
+			return strconv.Unquote(raw[:end+2])
+		}
+		return raw[1 : end+1], nil
+	}
+	if idx := strings.Index(raw, " #"); idx >= 0 {
+		raw = raw[:idx]
+	}
+	return strings.TrimSpace(raw), nil
+}
+
+// configParser parses the configuration values and collects all the problems.
+type configParser struct {
+	values ConfigValues
+	errs   ConfigErrors
+}
+
+// invalid records a problem with the value of a key.
+func (p *configParser) invalid(key string, val string, reason string) {
+	p.errs = append(p.errs, fmt.Sprintf("%s `%s` %s", key, val, reason))
+}
+
+// str returns the value of the key, or the default if it is not set or empty.
+func (p *configParser) str(key string, def string) string {
+	if val := strings.TrimSpace(p.values[key]); val != "" {
+		return val
+	}
+	return def
+}
+
+// required returns the value of the key, which must be set.
+func (p *configParser) required(key string) string {
+	val := p.str(key, "")
+	if val == "" {
+		p.errs = append(p.errs, fmt.Sprintf("%s is required", key))
+	}
+	return val
+}
+
+// oneOf returns the value of the key, which must be one of the options.
+func (p *configParser) oneOf(key string, def string, options ...string) string {
+	val := p.str(key, def)
+	for _, option := range options {
+		if val == option {
+			return val
+		}
+	}
+	p.invalid(key, val, "must be one of "+strings.Join(options, ", "))
+	return def
+}
+
+// integer returns the integer value of the key, which must be between min and max.
+func (p *configParser) integer(key string, def int64, min int64, max int64) int64 {
+	valStr := p.str(key, "")
+	if valStr == "" {
+		return def
+	}
+	val, err := strconv.ParseInt(valStr, 10, 64)
+	if err != nil || val < min || val > max {
+		p.invalid(key, valStr, fmt.Sprintf("must be an integer between %d and %d", min, max))
+		return def
+	}
+	return val
+}
+
+// duration returns the positive duration value of the key, e.g. "30s".
+func (p *configParser) duration(key string, def time.Duration) time.Duration {
+	valStr := p.str(key, "")
+	if valStr == "" {
+		return def
+	}
+	val, err := time.ParseDuration(valStr)
+	if err != nil || val <= 0 {
+		p.invalid(key, valStr, "must be a positive duration, e.g. 30s")
+		return def
+	}
+	return val
+}
+
+// optionalDuration returns the duration value of the key, which may be 0 to disable what it allows, e.g. a leeway.
+func (p *configParser) optionalDuration(key string, def time.Duration) time.Duration {
+	valStr := p.str(key, "")
+	if valStr == "" {
+		return def
+	}
+	val, err := time.ParseDuration(valStr)
+	if err != nil || val < 0 {
+		p.invalid(key, valStr, "must be a duration, e.g. 30s, or 0s")
+		return def
+	}
+	return val
+}
+
+// boolean returns the boolean value of the key.
+func (p *configParser) boolean(key string, def bool) bool {
+	valStr := p.str(key, "")
+	if valStr == "" {
+		return def
+	}
+	val, err := strconv.ParseBool(valStr)
+	if err != nil {
+		p.invalid(key, valStr, "must be true or false")
+		return def
+	}
+	return val
+}
+
+// list returns the comma separated values of the key.
+func (p *configParser) list(key string, def string) []string {
+	return splitList(p.str(key, def))
+}
+
+// ParseConfig returns the typed configuration of the values, or ConfigErrors with all the invalid values.
+func ParseConfig(values ConfigValues) (*Config, error) {
+	p := &configParser{values: values}
+	cfg := &Config{
+		AWSAccessKeyID:     p.required("AWS_ACCESS_KEY_ID"),
+		AWSSecretAccessKey: p.required("AWS_SECRET_ACCESS_KEY"),
+		StorageBucket:      p.required("AWS_STORAGE_BUCKET_NAME"),
+		RedisURL:           p.required("REDIS_URL"),
+		DatabaseURL:        p.required("DATABASE_URL"),
+		MaxCPUs:            int(p.integer("MAX_CPUS", 0, 0, math.MaxInt16)),
+		LogFormat:          p.oneOf("LOG_FORMAT", "text", "text", "json"),
+		ServerMode:         p.oneOf("SERVER_MODE", DefaultServerMode, "debug", "release", "test"),
+		PersistEncoding:    p.oneOf("PERSIST_ENCODING", "none", "none", "gzip"),
+	}
+	if cfg.PersistEncoding == "none" {
+		cfg.PersistEncoding = ""
+	}
+	if redisURL, err := url.Parse(cfg.RedisURL); cfg.RedisURL != "" && (err != nil || redisURL.Host == "") {
+		p.invalid("REDIS_URL", cfg.RedisURL, "must be an URL with a host")
+	}
+	levelStr := p.str("LOG_LEVEL", "INFO")
+	level, err := logging.LogLevel(levelStr)
+	if err != nil {
+		p.invalid("LOG_LEVEL", levelStr, "is not a log level")
+		level = logging.INFO
+	}
+	cfg.LogLevel = level
+	cfg.Server = parseServerSettings(p)
+	cfg.TLS = parseTLSSettings(p)
+	cfg.Admin = parseAdminSettings(p)
+	cfg.JWT = parseJWTSettings(p)
+	cfg.Quotas = parseQuotaSettings(p)
+	cfg.SecretOverlap = p.optionalDuration("PROVIDER_SECRET_OVERLAP", DefaultSecretOverlap)
+	cfg.Signing = parseSigningSettings(p)
+	cfg.CORS = CORSConfig{AllowedOrigins: p.list("CORS_ALLOWED_ORIGINS", ""),
+		AllowedMethods: splitList(strings.ToUpper(p.str("CORS_ALLOWED_METHODS", DefaultCORSMethods))),
+		AllowedHeaders: p.list("CORS_ALLOWED_HEADERS", DefaultCORSHeaders), ExposedHeaders: []string{RequestIDHeader},
+		MaxAge: time.Duration(p.integer("CORS_MAX_AGE", int64(DefaultCORSMaxAge/time.Second), 0, math.MaxInt32)) * time.Second}
+	cfg.BodyLimits = map[string]int64{
+		"auth":      p.integer("MAX_BODY_AUTH", DefaultMaxBody, 1, math.MaxInt64),
+		"analytics": p.integer("MAX_BODY_ANALYTICS", DefaultMaxBodyAnalytics, 1, math.MaxInt64),
+		"batch":     p.integer("MAX_BODY_BATCH", DefaultMaxBodyBatch, 1, math.MaxInt64),
+		"provider":  p.integer("MAX_BODY_PROVIDER", DefaultMaxBodyProvider, 1, math.MaxInt64),
+	}
+	if len(p.errs) > 0 {
+		return nil, p.errs
+	}
+	return cfg, nil
+}
+
+// parseServerSettings returns the settings of the HTTP server and of its listener.
+func parseServerSettings(p *configParser) ServerSettings {
+	port := p.str("SERVER_PORT", DefaultPort)
+	if portUInt, err := strconv.ParseUint(port, 10, 16); err != nil || portUInt == 0 {
+		p.invalid("SERVER_PORT", port, "must be a port between 1 and 65535")
+		port = DefaultPort
+	}
+	socketMode := DefaultSocketMode
+	if modeStr := p.str("SERVER_SOCKET_MODE", ""); modeStr != "" {
+		if mode, err := strconv.ParseUint(modeStr, 8, 32); err == nil && mode <= 0777 {
+			socketMode = os.FileMode(mode)
+		} else {
+			p.invalid("SERVER_SOCKET_MODE", modeStr, "must be octal permissions, e.g. 0660")
+		}
+	}
+	return ServerSettings{
+		Addr:              fmt.Sprintf("%s:%s", p.str("SERVER_ADDR", ""), port),
+		ReadTimeout:       p.duration("SERVER_READ_TIMEOUT", DefaultReadTimeout),
+		ReadHeaderTimeout: p.duration("SERVER_READ_HEADER_TIMEOUT", DefaultReadHeaderTimeout),
+		WriteTimeout:      p.duration("SERVER_WRITE_TIMEOUT", DefaultWriteTimeout),
+		IdleTimeout:       p.duration("SERVER_IDLE_TIMEOUT", DefaultIdleTimeout),
+		MaxHeaderBytes:    int(p.integer("SERVER_MAX_HEADER_BYTES", DefaultMaxHeaderBytes, 1, math.MaxInt32)),
+		MaxConns:          int(p.integer("SERVER_MAX_CONNS", DefaultMaxConns, 0, math.MaxInt32)),
+		KeepAlive:         p.boolean("SERVER_KEEPALIVE", true),
+		KeepAlivePeriod:   p.duration("SERVER_KEEPALIVE_PERIOD", DefaultKeepAlivePeriod),
+		Socket:            p.str("SERVER_SOCKET", ""),
+		SocketMode:        socketMode,
+	}
+}
+
+// parseTLSSettings returns the TLS settings. The certificate is loaded to check it, since it would fail later anyway.
+func parseTLSSettings(p *configParser) TLSSettings {
+	settings := TLSSettings{CertFile: p.str("TLS_CERT_FILE", ""), KeyFile: p.str("TLS_KEY_FILE", ""),
+		HTTP2: p.boolean("HTTP2", true)}
+	if (settings.CertFile == "") != (settings.KeyFile == "") {
+		p.errs = append(p.errs, "both TLS_CERT_FILE and TLS_KEY_FILE must be set to enable TLS")
+	} else if settings.Enabled() {
+		if _, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile); err != nil {
+			p.invalid("TLS_CERT_FILE", settings.CertFile, fmt.Sprintf("could not be loaded with its key: %s", err))
+		}
+	}
+	minVersion := p.str("TLS_MIN_VERSION", DefaultTLSMinVersion)
+	if version, valid := tlsVersions[minVersion]; valid {
+		settings.MinVersion = version
+	} else {
+		p.invalid("TLS_MIN_VERSION", minVersion, "must be 1.0, 1.1, 1.2 or 1.3")
+		settings.MinVersion = tlsVersions[DefaultTLSMinVersion]
+	}
+	if suites := p.str("TLS_CIPHER_SUITES", ""); suites != "" {
+		var err error
+		if settings.CipherSuites, err = parseCipherSuites(suites); err != nil {
+			p.errs = append(p.errs, err.Error())
+		}
+	}
+	return settings
+}
+
+// parseAdminSettings returns the credentials of the admin users. The secrets are never part of the error messages.
+func parseAdminSettings(p *configParser) AdminSettings {
+	settings := AdminSettings{JWTKeys: make(map[string][]byte)}
+	for _, entry := range p.list("ADMIN_KEYS", "") {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			p.errs = append(p.errs, "each of ADMIN_KEYS must be name:sha256-hex-of-key:role|role")
+			continue
+		}
+		hash, err := hex.DecodeString(parts[1])
+		if err != nil || len(hash) != sha256.Size {
+			p.errs = append(p.errs, fmt.Sprintf("ADMIN_KEYS `%s` must have the hex SHA-256 of its key", parts[0]))
+			continue
+		}
+		key := AdminKey{Name: parts[0], Hash: hash}
+		for _, role := range strings.Split(parts[2], "|") {
+			if !isAdminRole(role) {
+				p.errs = append(p.errs, fmt.Sprintf("ADMIN_KEYS `%s` has an unknown role `%s`", parts[0], role))
+			}
+			key.Roles = append(key.Roles, role)
+		}
+		settings.Keys = append(settings.Keys, key)
+	}
+	for _, entry := range p.list("ADMIN_JWT_KEYS", "") {
+		idx := strings.Index(entry, ":")
+		if idx < 0 {
+			p.errs = append(p.errs, "each of ADMIN_JWT_KEYS must be key-id:secret")
+			continue
+		}
+		if len(entry)-idx-1 < MinAdminKeyLength {
+			p.errs = append(p.errs, fmt.Sprintf("ADMIN_JWT_KEYS `%s` must have a secret of at least %d characters", entry[:idx], MinAdminKeyLength))
+			continue
+		}
+		settings.JWTKeys[entry[:idx]] = []byte(entry[idx+1:])
+	}
+	// As for the JWT bearer tokens, so that the JWTs signed with the same secret for other services are rejected.
+	if len(settings.JWTKeys) > 0 {
+		settings.JWTIssuer = p.required("ADMIN_JWT_ISSUER")
+		settings.JWTAudience = p.required("ADMIN_JWT_AUDIENCE")
+	}
+	return settings
+}
+
+// parseJWTSettings returns the settings of the JWT bearer tokens. The issuer and the audience are required
+// so that the JWTs issued for other services are rejected.
+func parseJWTSettings(p *configParser) JWTSettings {
+	settings := JWTSettings{JWKS: p.str("JWT_JWKS", ""), Refresh: p.duration("JWT_JWKS_REFRESH", DefaultJWKSRefresh),
+		Leeway: p.optionalDuration("JWT_LEEWAY", DefaultJWTLeeway)}
+	if settings.Enabled() {
+		settings.Issuer = p.required("JWT_ISSUER")
+		settings.Audience = p.required("JWT_AUDIENCE")
+	}
+	return settings
+}
+
+// parseQuotaSettings returns the default quota of the content providers. The quotas of specific providers are
+// stored in the database, with their keys.
+func parseQuotaSettings(p *configParser) QuotaSettings {
+	settings := QuotaSettings{}
+	if raw := p.str("PROVIDER_QUOTA", ""); raw != "" {
+		quota, err := ParseProviderQuota(raw)
+		if err != nil {
+			p.invalid("PROVIDER_QUOTA", raw, err.Error())
+		}
+		settings.Default = quota
+	}
+	return settings
+}
+
+// parseSigningSettings returns the signing algorithms allowed for all the content providers and for specific ones.
+func parseSigningSettings(p *configParser) SigningSettings {
+	settings := SigningSettings{Providers: make(map[int][]string), MaxSkew: p.duration("SIGNING_MAX_SKEW", DefaultSigningSkew)}
+	if raw := p.str("SIGNING_ALGORITHMS", ""); raw != "" {
+		algorithms, err := ParseAlgorithms(raw, ",")
+		if err != nil {
+			p.invalid("SIGNING_ALGORITHMS", raw, err.Error())
+		}
+		settings.Algorithms = algorithms
+	}
+	for _, entry := range p.list("PROVIDER_SIGNING_ALGORITHMS", "") {
+		parts := strings.SplitN(entry, "=", 2)
+		providerID, idErr := strconv.Atoi(parts[0])
+		if len(parts) != 2 || idErr != nil {
+			p.errs = append(p.errs, fmt.Sprintf("PROVIDER_SIGNING_ALGORITHMS `%s` must be provider-id=algorithm|algorithm", entry))
+			continue
+		}
+		algorithms, err := ParseAlgorithms(parts[1], "|")
+		if err != nil {
+			p.invalid("PROVIDER_SIGNING_ALGORITHMS", entry, err.Error())
+			continue
+		}
+		settings.Providers[providerID] = algorithms
+	}
+	return settings
+}
+
+// isAdminRole returns whether the role is one of the admin roles.
+func isAdminRole(role string) bool {
+	for _, known := range AdminRoles {
+		if known == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"github.com/op/go-logging"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testConfigValues returns the required configuration values, with dummy values.
+func testConfigValues() ConfigValues {
+	return ConfigValues{"AWS_ACCESS_KEY_ID": "key", "AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_STORAGE_BUCKET_NAME": "bucket", "REDIS_URL": "redis://:pwd@localhost:6379",
+		"DATABASE_URL": "postgres://localhost/goswift"}
+}
+
+// TestConfig tests stuff from config.go
+func TestConfig(t *testing.T) {
+	Convey("The configuration tests, ", t, func() {
+		values := testConfigValues()
+
+		Convey("All the missing required values are reported at once", func() {
+			_, err := ParseConfig(ConfigValues{"REDIS_URL": "redis://localhost:6379"})
+			So(err, ShouldNotBeNil)
+			So(len(err.(ConfigErrors)), ShouldEqual, 4)
+			So(err.Error(), ShouldContainSubstring, "AWS_ACCESS_KEY_ID is required")
+			So(err.Error(), ShouldContainSubstring, "DATABASE_URL is required")
+		})
+
+		Convey("The defaults are used for the optional values", func() {
+			cfg, err := ParseConfig(values)
+			So(err, ShouldBeNil)
+			So(cfg.StorageBucket, ShouldEqual, "bucket")
+			So(cfg.MaxCPUs, ShouldEqual, 0)
+			So(cfg.LogLevel, ShouldEqual, logging.INFO)
+			So(cfg.ServerMode, ShouldEqual, DefaultServerMode)
+			So(cfg.PersistEncoding, ShouldEqual, "")
+			So(cfg.Server.Addr, ShouldEqual, ":"+DefaultPort)
+			So(cfg.Server.ReadHeaderTimeout, ShouldEqual, DefaultReadHeaderTimeout)
+			So(cfg.Server.MaxConns, ShouldEqual, DefaultMaxConns)
+			So(cfg.Server.KeepAlive, ShouldBeTrue)
+			So(cfg.Server.SocketMode, ShouldEqual, DefaultSocketMode)
+			So(cfg.TLS.Enabled(), ShouldBeFalse)
+			So(cfg.CORS.AllowedOrigins, ShouldBeEmpty)
+			So(cfg.CORS.AllowedMethods, ShouldResemble, []string{"GET", "POST", "PUT", "OPTIONS"})
+			So(cfg.CORS.MaxAge, ShouldEqual, DefaultCORSMaxAge)
+			So(cfg.BodyLimit("analytics"), ShouldEqual, DefaultMaxBodyAnalytics)
+			So(cfg.BodyLimit("batch"), ShouldEqual, DefaultMaxBodyBatch)
+		})
+
+		Convey("Playing with SERVER_ADDR and SERVER_PORT", func() {
+			var serverConfs = []struct {
+				addr string
+				port string
+				expt string
+			}{
+				{"", "", fmt.Sprintf(":%s", DefaultPort)},
+				{"", "1025", ":1025"},
+				{"127.0.0.1", "", fmt.Sprintf("127.0.0.1:%s", DefaultPort)},
+				{"127.0.0.1", "1025", "127.0.0.1:1025"},
+			}
+			for _, conf := range serverConfs {
+				values["SERVER_ADDR"] = conf.addr
+				values["SERVER_PORT"] = conf.port
+				cfg, err := ParseConfig(values)
+				So(err, ShouldBeNil)
+				So(cfg.Server.Addr, ShouldEqual, conf.expt)
+			}
+		})
+
+		Convey("The optional values are parsed", func() {
+			values["MAX_CPUS"] = "2"
+			values["LOG_LEVEL"] = "DEBUG"
+			values["SERVER_READ_HEADER_TIMEOUT"] = "2s"
+			values["SERVER_MAX_CONNS"] = "0"
+			values["SERVER_KEEPALIVE"] = "false"
+			values["SERVER_SOCKET"] = "/run/goswift.sock"
+			values["SERVER_SOCKET_MODE"] = "0666"
+			values["CORS_ALLOWED_ORIGINS"] = "https://a.com, https://b.com,"
+			values["CORS_ALLOWED_METHODS"] = "get,put"
+			values["MAX_BODY_ANALYTICS"] = "2048"
+			values["PERSIST_ENCODING"] = "gzip"
+			values["JWT_LEEWAY"] = "0s"
+			values["PROVIDER_SECRET_OVERLAP"] = "0"
+			cfg, err := ParseConfig(values)
+			So(err, ShouldBeNil)
+			So(cfg.MaxCPUs, ShouldEqual, 2)
+			So(cfg.LogLevel, ShouldEqual, logging.DEBUG)
+			So(cfg.Server.ReadHeaderTimeout, ShouldEqual, time.Second*2)
+			So(cfg.Server.MaxConns, ShouldEqual, 0)
+			So(cfg.Server.KeepAlive, ShouldBeFalse)
+			So(cfg.Server.Socket, ShouldEqual, "/run/goswift.sock")
+			So(cfg.Server.SocketMode, ShouldEqual, os.FileMode(0666))
+			So(cfg.CORS.AllowedOrigins, ShouldResemble, []string{"https://a.com", "https://b.com"})
+			So(cfg.CORS.AllowedMethods, ShouldResemble, []string{"GET", "PUT"})
+			So(cfg.BodyLimit("analytics"), ShouldEqual, 2048)
+			So(cfg.PersistEncoding, ShouldEqual, "gzip")
+			So(cfg.JWT.Leeway, ShouldEqual, 0)
+			So(cfg.SecretOverlap, ShouldEqual, 0)
+		})
+
+		Convey("All the invalid values are reported at once", func() {
+			invalid := map[string]string{"MAX_CPUS": "all", "LOG_LEVEL": "D3BUG", "LOG_FORMAT": "xml",
+				"SERVER_MODE": "prod", "SERVER_PORT": "65536", "SERVER_WRITE_TIMEOUT": "-5s",
+				"SERVER_READ_TIMEOUT": "0s", "JWT_LEEWAY": "-1s",
+				"SERVER_KEEPALIVE": "maybe", "SERVER_SOCKET_MODE": "999", "CORS_MAX_AGE": "invalid",
+				"MAX_BODY_BATCH": "lots", "PERSIST_ENCODING": "zstd", "REDIS_URL": "localhost",
+				"ADMIN_KEYS": "ops:nothex:read-metrics", "ADMIN_JWT_KEYS": "k1:short", "PROVIDER_QUOTA": "lots",
+				"SIGNING_ALGORITHMS": "HMAC-MD5", "PROVIDER_SIGNING_ALGORITHMS": "1=HMAC-SHA1"}
+			for key, val := range invalid {
+				values[key] = val
+			}
+			_, err := ParseConfig(values)
+			So(err, ShouldNotBeNil)
+			So(len(err.(ConfigErrors)), ShouldEqual, len(invalid))
+			for key := range invalid {
+				So(err.Error(), ShouldContainSubstring, key)
+			}
+		})
+
+		Convey("With configuration files and flags", func() {
+			dir, _ := ioutil.TempDir("", "goswift-config-")
+			defer os.RemoveAll(dir)
+			values["SERVER_PORT"] = "1025"
+			values["LOG_LEVEL"] = "ERROR"
+			for key, val := range values {
+				// Restores the environment of the other tests.
+				if prev, ok := os.LookupEnv(key); ok {
+					defer os.Setenv(key, prev)
+				} else {
+					defer os.Unsetenv(key)
+				}
+				os.Setenv(key, val)
+			}
+
+			Convey("A YAML file overrides the environment, and the flags override the file", func() {
+				path := filepath.Join(dir, "goswift.yaml")
+				ioutil.WriteFile(path, []byte("---\n# Comment.\nserver_port: 1026\nlog_level: \"WARNING\" # Inline comment.\n"+
+					"database_url: postgres://db:5432/goswift?sslmode=disable\n"), 0600)
+				cfg, err := LoadConfig([]string{"-config", path, "-log-level", "DEBUG"})
+				So(err, ShouldBeNil)
+				So(cfg.Server.Addr, ShouldEqual, ":1026")
+				So(cfg.LogLevel, ShouldEqual, logging.DEBUG)
+				So(cfg.DatabaseURL, ShouldEqual, "postgres://db:5432/goswift?sslmode=disable")
+			})
+
+			Convey("A TOML file is read too", func() {
+				path := filepath.Join(dir, "goswift.toml")
+				ioutil.WriteFile(path, []byte("server_port = 1027\ncors_allowed_origins = 'https://a.com'\n"), 0600)
+				cfg, err := LoadConfig([]string{"-config", path})
+				So(err, ShouldBeNil)
+				So(cfg.Server.Addr, ShouldEqual, ":1027")
+				So(cfg.LogLevel, ShouldEqual, logging.ERROR)
+				So(cfg.CORS.AllowedOrigins, ShouldResemble, []string{"https://a.com"})
+			})
+
+			Convey("The problems of the file and of the values are reported together", func() {
+				path := filepath.Join(dir, "goswift.yaml")
+				ioutil.WriteFile(path, []byte("unknown_key: 1\nserver:\n  port: 1028\nmax_cpus: all\n"), 0600)
+				_, err := LoadConfig([]string{"-config", path})
+				So(err, ShouldNotBeNil)
+				So(len(err.(ConfigErrors)), ShouldEqual, 4)
+			})
+
+			Convey("Unknown flags and file extensions are errors", func() {
+				_, err := LoadConfig([]string{"-unknown-flag", "1"})
+				So(err, ShouldNotBeNil)
+				_, err = LoadConfig([]string{"-config", filepath.Join(dir, "goswift.ini")})
+				So(err, ShouldNotBeNil)
+			})
+		})
+	})
+}
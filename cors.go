@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultCORSMethods are the methods allowed by default on cross-origin requests.
+	DefaultCORSMethods = "GET,POST,PUT,OPTIONS"
+	// DefaultCORSHeaders are the request headers allowed by default on cross-origin requests.
+	DefaultCORSHeaders = "Authorization,Content-Type,Content-Encoding,X-Request-ID"
+	// DefaultCORSMaxAge is how long browsers may cache a preflight response by default.
+	DefaultCORSMaxAge = time.Minute * 10
+)
+
+// CORSConfig stores the cross-origin resource sharing configuration.
+type CORSConfig struct {
+	AllowedOrigins []string // Exact origins, "*" for all, or "*.example.com" for all the subdomains.
+	AllowedMethods []string
+	AllowedHeaders []string
+	ExposedHeaders []string
+	MaxAge         time.Duration
+}
+
+// splitList splits a comma separated list and drops the empty items.
+func splitList(list string) []string {
+	items := make([]string, 0)
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// originAllowed returns whether the origin is allowed by the configuration.
+func (conf CORSConfig) originAllowed(origin string) bool {
+	for _, allowed := range conf.AllowedOrigins {
+		switch {
+		case allowed == "*" || allowed == origin:
+			return true
+		case strings.HasPrefix(allowed, "*."):
+			// Matches any subdomain of that domain, on any scheme.
+			if idx := strings.Index(origin, "://"); idx >= 0 && strings.HasSuffix(origin[idx+3:], allowed[1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// CORS sets the CORS headers on the requests from allowed origins. Preflights are answered here and aborted, so they
+// never reach the auth managers, which would reject them and, for perishable tokens, spend a token use.
+// This must be used on the engine, before any group, so that it also runs for OPTIONS requests which match no route.
+func CORS(conf CORSConfig) gin.HandlerFunc {
+	allowedMethods := strings.Join(conf.AllowedMethods, ", ")
+	allowedHeaders := strings.Join(conf.AllowedHeaders, ", ")
+	exposedHeaders := strings.Join(conf.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(conf.MaxAge / time.Second))
+	return func(c *gin.Context) {
+		origin := c.Request.Header.Get("Origin")
+		if origin == "" {
+			return
+		}
+		headers := c.Writer.Header()
+		headers.Add("Vary", "Origin")
+		preflight := c.Request.Method == "OPTIONS" && c.Request.Header.Get("Access-Control-Request-Method") != ""
+		if !conf.originAllowed(origin) {
+			if preflight {
+				// Without the CORS headers, the browser will not send the actual request.
+				c.AbortWithStatus(http.StatusForbidden)
+			}
+			return
+		}
+		headers.Set("Access-Control-Allow-Origin", origin)
+		if preflight {
+			headers.Add("Vary", "Access-Control-Request-Method")
+			headers.Add("Vary", "Access-Control-Request-Headers")
+			headers.Set("Access-Control-Allow-Methods", allowedMethods)
+			headers.Set("Access-Control-Allow-Headers", allowedHeaders)
+			headers.Set("Access-Control-Max-Age", maxAge)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		if exposedHeaders != "" {
+			headers.Set("Access-Control-Expose-Headers", exposedHeaders)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestCORS tests the CORS middleware.
+func TestCORS(t *testing.T) {
+	Convey("The CORS tests, ", t, func() {
+		conf := CORSConfig{AllowedOrigins: []string{"https://www.sparrho.com", "*.example.com"},
+			AllowedMethods: []string{"GET", "PUT"}, AllowedHeaders: []string{"Authorization"},
+			ExposedHeaders: []string{RequestIDHeader}, MaxAge: time.Minute}
+		engine := gin.New()
+		engine.Use(CORS(conf))
+		authG := engine.Group("/auth")
+		authG.Use(func(c *gin.Context) {
+			c.AbortWithStatus(http.StatusUnauthorized)
+		})
+		authG.PUT("/record", SuccessJSON)
+		engine.GET("/open", SuccessJSON)
+
+		preflight := func(origin string) map[string][]string {
+			return map[string][]string{"Origin": {origin}, "Access-Control-Request-Method": {"PUT"}}
+		}
+
+		Convey("Preflights from allowed origins never reach the auth", func() {
+			req := performRequest(engine, "OPTIONS", "/auth/record", preflight("https://www.sparrho.com"), nil)
+			So(req.Code, ShouldEqual, 204)
+			So(req.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://www.sparrho.com")
+			So(req.Header().Get("Access-Control-Allow-Methods"), ShouldEqual, "GET, PUT")
+			So(req.Header().Get("Access-Control-Allow-Headers"), ShouldEqual, "Authorization")
+			So(req.Header().Get("Access-Control-Max-Age"), ShouldEqual, "60")
+		})
+
+		Convey("Subdomains match wildcard origins", func() {
+			req := performRequest(engine, "OPTIONS", "/auth/record", preflight("https://app.example.com"), nil)
+			So(req.Code, ShouldEqual, 204)
+			req = performRequest(engine, "OPTIONS", "/auth/record", preflight("https://example.com.evil.org"), nil)
+			So(req.Code, ShouldEqual, 403)
+		})
+
+		Convey("Preflights from other origins are forbidden", func() {
+			req := performRequest(engine, "OPTIONS", "/auth/record", preflight("https://evil.org"), nil)
+			So(req.Code, ShouldEqual, 403)
+			So(req.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "")
+		})
+
+		Convey("Actual requests get the allowed origin and the exposed headers", func() {
+			req := performRequest(engine, "GET", "/open", map[string][]string{"Origin": {"https://www.sparrho.com"}}, nil)
+			So(req.Code, ShouldEqual, 200)
+			So(req.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://www.sparrho.com")
+			So(req.Header().Get("Access-Control-Expose-Headers"), ShouldEqual, RequestIDHeader)
+			So(req.Header().Get("Vary"), ShouldEqual, "Origin")
+		})
+
+		Convey("Requests without an origin are left alone", func() {
+			req := performRequest(engine, "GET", "/open", map[string][]string{}, nil)
+			So(req.Code, ShouldEqual, 200)
+			So(req.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "")
+		})
+	})
+}
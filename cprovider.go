@@ -1,12 +1,14 @@
 package main
 
 import (
-	"database/sql"
 	"errors"
+	"fmt"
 	"github.com/ChristopherRabotin/gin-contrib-headerauth"
+	"github.com/Sparrho/goswift/client"
+	"github.com/gin-gonic/gin"
 	"github.com/pmylund/go-cache"
-	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 )
 // Better way than two different caches:
@@ -20,66 +22,121 @@ import (
 // The key of this cache is the access key and the value is an instance of ContentProviderInfo.
 const (
 	ProviderCacheTTL = time.Hour * 24
+	// ProviderContextKey is the gin context key where the ID of the authenticated content provider is stored.
+	ProviderContextKey = "provider"
 )
 
 var providerCache = cache.New(ProviderCacheTTL, time.Hour*1)
 
 // ContentProviderInfo stores basic information needed to validate or not a given content provider.
+// After a rotation, the previous secret is also accepted until it expires, so that the provider can migrate.
 type ContentProviderInfo struct {
-	id     int
-	secret string
+	id              int
+	secret          string
+	previousSecret  string
+	previousExpires time.Time
+	quota           *ProviderQuota // Quota of the provider, or nil for the default one.
 }
 
 // invalidAccessCache stores the invalid access keys used. The avoid hitting the database if a provider
 // uses an invalid access key multiple times. An invalid access key has very little chance of becoming valid.
 var invalidAccessCache = cache.New(ProviderCacheTTL, time.Hour*1)
 
-// ContentProviderMgr is an example definition of an AuthKeyManager struct.
+// ContentProviderMgr is the header auth manager of the content providers, whose requests are signed as
+// documented in the client package. The signature is verified here, rather than by headerauth, since
+// the algorithm depends on the provider.
+// If Quotas is set, the authenticated requests are counted against the quota of their provider.
 type ContentProviderMgr struct {
-	Secret string
-	*headerauth.HMACManager
+	Secret  string
+	Store   ProviderKeyStore
+	Signing SigningSettings
+	Quotas  *ProviderQuotas
+	*headerauth.TokenManager
 }
 
 // CheckHeader returns an error if something is wrong with the header, or the auth fails (if it can fail here).
 // Here should reside additional verifications on the header, or other parts of the request, if needed.
 func (m ContentProviderMgr) CheckHeader(auth *headerauth.AuthInfo, req *http.Request) (err *headerauth.AuthErr) {
+	auth.Secret = ""     // The signature is verified here.
+	auth.DataToSign = "" // There is no data left for headerauth to sign.
 	if req.ContentLength == 0 || req.Body == nil {
 		// This manager only support requests with a body.
-		return &headerauth.AuthErr{403, errors.New("Wrong access key or signature.")}
+		return NewAuthErr(StatusSignatureInvalid, errors.New("Wrong access key or signature."))
+	}
+	cred, credErr := client.ParseCredential(auth.AccessKey)
+	if credErr != nil {
+		return NewAuthErr(StatusSignatureInvalid, credErr)
+	}
+	// From now on, the access key is that of the provider, which Authorize and PostAuth look up.
+	auth.AccessKey = cred.AccessKey
+	auth.Signature = cred.Signature
+	now := time.Now()
+	if dateErr := m.Signing.checkSigningDate(req, now); dateErr != nil {
+		return NewAuthErr(StatusSignatureExpired, dateErr)
 	}
 
-	// Let's attempt to grab the content provider information from the valid cache.
+	// Let's attempt to grab the content provider information from the valid cache, and otherwise from the store.
 	provider, exists := providerCache.Get(auth.AccessKey)
 	if !exists {
-		return &headerauth.AuthErr{403, errors.New("Wrong access key or signature.")}
-		
-		// TODO: Put this in the function which updates the cache with all the values.
-		// This access key is unknown. Let's grab it from the database.
-		db := GetDBConn()
-		var secret string
-		dbErr := db.QueryRow("SELECT secret_key FROM apiv2_authkey WHERE disabled='f' and access_key=?", auth.AccessKey).Scan(&secret)
+		if _, invalid := invalidAccessCache.Get(auth.AccessKey); invalid || m.Store == nil {
+			return NewAuthErr(StatusSignatureInvalid, errors.New("Wrong access key or signature."))
+		}
+		info, lookupErr := m.Store.Lookup(auth.AccessKey)
 		switch {
-		case dbErr == sql.ErrNoRows:
+		case lookupErr == ErrKeyNotFound:
 			// Access key does not exists. Let's cache this information.
-			invalidAccessCache.Add(auth.AccessKey, struct{}{}, ProviderCacheTTL)
-			return &headerauth.AuthErr{403, errors.New("Wrong access key or signature.")}
-		case dbErr != nil:
-			log.Critical("query failed: %s", dbErr)
-			return &headerauth.AuthErr{503, errors.New("Service unavailable.")}
+			invalidAccessCache.Set(auth.AccessKey, struct{}{}, ProviderCacheTTL)
+			return NewAuthErr(StatusSignatureInvalid, errors.New("Wrong access key or signature."))
+		case lookupErr != nil:
+			log.Critical("query failed: %s", lookupErr)
+			return NewAuthErr(Status503, errors.New("Service unavailable."))
 		}
+		providerCache.Set(auth.AccessKey, info, ProviderCacheTTL)
+		provider = info
+	}
+	info := provider.(*ContentProviderInfo)
+	if !m.Signing.Allows(info.id, cred.Algorithm) {
+		return NewAuthErr(StatusAlgorithmNotAllowed, fmt.Errorf("the provider %d may not sign with %s, only with %s",
+			info.id, cred.Algorithm, strings.Join(m.Signing.AllowedAlgorithms(info.id), ", ")))
 	}
 
-	// The access key is valid. Let's check the signature.
-	body, ioErr := ioutil.ReadAll(req.Body)
-	if ioErr != nil {
-		log.Critical("could not read the body: %s.", ioErr)
-		return &headerauth.AuthErr{503, errors.New("Service unavailable.")}
+	// The access key is valid. Let's check the signature. Provider routes must cap the body size with LimitBody.
+	// The body is captured, rather than consumed, so that it can still be persisted after the auth.
+	body, ioErr := captureRequestBody(req, 0)
+	if ioErr == ErrBodyTooLarge {
+		return NewAuthErr(Status413, ioErr)
+	} else if ioErr != nil {
+		log.Error("could not read the body: %s.", ioErr)
+		return NewAuthErr(Status400, errors.New("Could not read the body."))
+	}
+	bodyHash, hashErr := hashBody(cred.Algorithm, body)
+	if hashErr != nil {
+		log.Error("could not hash the body: %s.", hashErr)
+		return NewAuthErr(Status400, errors.New("Could not read the body."))
+	}
+	stringToSign, _ := client.StringToSign(cred.Algorithm, req.Header.Get(client.DateHeader),
+		client.CanonicalRequest(req, cred.SignedHeaders, bodyHash))
+	valid, previous := info.verifySignature(cred.Algorithm, stringToSign, cred.Signature, now)
+	if !valid {
+		return NewAuthErr(StatusSignatureInvalid, errors.New("Wrong access key or signature."))
+	}
+	if previous {
+		providerSecretUses.Inc("previous")
+		log.Notice("the key %s of the provider %d signed with %s and its previous secret, which expires on %s.",
+			auth.AccessKey, info.id, cred.Algorithm, info.previousExpires.Format(time.RFC3339))
+	} else {
+		providerSecretUses.Inc("current")
+		log.Debug("the key %s of the provider %d signed with %s and its current secret.", auth.AccessKey, info.id, cred.Algorithm)
 	}
-	auth.Secret = provider.(*ContentProviderInfo).secret
-	auth.DataToSign = string(body)
 	return
 }
 
+// PreAbort responds with the code of the rejected signature or key, e.g. signature_expired. Unlike the analytics,
+// the payloads of the rejected requests are not persisted.
+func (m ContentProviderMgr) PreAbort(c *gin.Context, auth *headerauth.AuthInfo, err *headerauth.AuthErr) {
+	StatusForAuthErr(err).Respond(c, nil)
+}
+
 // Authorize returns the value to store in Gin's context at ContextKey(), or an error if the auth fails.
 // This is only called once the requested has been authorized to pursue, i.e. access key and signature are valid,
 // so logging of success should happen here.
@@ -87,13 +144,29 @@ func (m ContentProviderMgr) Authorize(auth *headerauth.AuthInfo) (val interface{
 	provider, _ := providerCache.Get(auth.AccessKey)
 	val = provider.(*ContentProviderInfo).id
 	return
-	// TODO: Add that into the ticking function too.
-	var authkeyID string
-	db := GetDBConn()
-	// TODO: Can't this be done in a unique SQL query?!
-	db.QueryRow("SELECT id FROM apiv2_authkey WHERE disabled='f' and access_key=?", auth.AccessKey).Scan(&authkeyID)
-	var cpID int
-	db.QueryRow(`SELECT "apiv2_contentprovider"."id" FROM "apiv2_contentprovider" INNER JOIN "apiv2_contentprovider_authkeys" ON ( "apiv2_contentprovider"."id" = "apiv2_contentprovider_authkeys"."contentprovider_id" ) WHERE "apiv2_contentprovider_authkeys"."authkey_id" = ?`, authkeyID).Scan(&cpID)
-	val = cpID
-	return
+}
+
+// PostAuth sets the access key which the payload is persisted with, and rejects the requests of the providers
+// which are over quota.
+func (m ContentProviderMgr) PostAuth(c *gin.Context, auth *headerauth.AuthInfo, err *headerauth.AuthErr) {
+	c.Set("token", auth.AccessKey)
+	c.Set("authSuccess", true)
+	if m.Quotas == nil {
+		return
+	}
+	provider, exists := providerCache.Get(auth.AccessKey)
+	if !exists {
+		return
+	}
+	var size int64
+	if body, captureErr := capturedBody(c); captureErr == nil && body != nil {
+		size = body.Size()
+	}
+	m.Quotas.Enforce(c, provider.(*ContentProviderInfo), size)
+}
+
+// NewContentProviderMgr returns a new ContentProviderMgr auth manager, whose requests use the client.AuthScheme prefix.
+func NewContentProviderMgr(store ProviderKeyStore, signing SigningSettings, quotas *ProviderQuotas, contextKey string) *ContentProviderMgr {
+	return &ContentProviderMgr{Store: store, Signing: signing, Quotas: quotas,
+		TokenManager: headerauth.NewTokenManager("Authorization", client.AuthScheme, contextKey)}
 }
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"github.com/ChristopherRabotin/gin-contrib-headerauth"
+	"github.com/Sparrho/goswift/client"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedProviderRequest returns a PUT request of the body signed by the signer, and its AuthInfo as headerauth
+// fills it, i.e. with the credential after the scheme as the access key.
+func signedProviderRequest(signer *client.Signer, body string) (*http.Request, *headerauth.AuthInfo) {
+	req, _ := http.NewRequest("PUT", "https://goswift.sparrho.com/content/items?b=2&a=1&a=0", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	signer.Sign(req, []byte(body))
+	return req, &headerauth.AuthInfo{AccessKey: strings.TrimPrefix(req.Header.Get("Authorization"), client.AuthScheme+" ")}
+}
+
+// TestContentProvider tests the content provider auth, whose signatures come from the client package.
+func TestContentProvider(t *testing.T) {
+	Convey("The content provider tests, ", t, func() {
+		providerCache.Set("signingAccessKey", &ContentProviderInfo{id: 1, secret: "currentSecret", previousSecret: "previousSecret",
+			previousExpires: time.Now().Add(time.Hour)}, 0)
+		defer providerCache.Delete("signingAccessKey")
+		m := ContentProviderMgr{}
+		signer := client.NewSigner("signingAccessKey", "currentSecret")
+		signer.Headers = []string{"Content-Type"}
+		checkCode := func(req *http.Request, auth *headerauth.AuthInfo) string {
+			if err := m.CheckHeader(auth, req); err != nil {
+				return StatusForAuthErr(err).Code
+			}
+			return ""
+		}
+
+		Convey("The requests signed with each algorithm are accepted", func() {
+			for algorithm := range client.Algorithms {
+				signer.Algorithm = algorithm
+				req, auth := signedProviderRequest(signer, "signed data")
+				So(checkCode(req, auth), ShouldBeBlank)
+				So(auth.AccessKey, ShouldEqual, "signingAccessKey")
+			}
+		})
+
+		Convey("The previous secret is accepted until it expires", func() {
+			signer.SecretKey = "previousSecret"
+			req, auth := signedProviderRequest(signer, "signed data")
+			So(checkCode(req, auth), ShouldBeBlank)
+			providerCache.Set("signingAccessKey", &ContentProviderInfo{id: 1, secret: "currentSecret", previousSecret: "previousSecret",
+				previousExpires: time.Now()}, 0)
+			req, auth = signedProviderRequest(signer, "signed data")
+			So(checkCode(req, auth), ShouldEqual, "signature_invalid")
+		})
+
+		Convey("Any change to the signed parts of the request is rejected", func() {
+			tampers := []func(req *http.Request){
+				func(req *http.Request) { req.Method = "POST" },
+				func(req *http.Request) { req.URL.Path = "/content/other" },
+				func(req *http.Request) { req.URL.RawQuery = "a=1&a=0&b=3" },
+				func(req *http.Request) { req.Host = "evil.com" },
+				func(req *http.Request) { req.Header.Set("Content-Type", "text/plain") },
+			}
+			for _, tamper := range tampers {
+				req, auth := signedProviderRequest(signer, "signed data")
+				tamper(req)
+				So(checkCode(req, auth), ShouldEqual, "signature_invalid")
+			}
+			req, auth := signedProviderRequest(signer, "signed data")
+			req.Body = ioutil.NopCloser(strings.NewReader("signed datA"))
+			So(checkCode(req, auth), ShouldEqual, "signature_invalid")
+
+			// The order of the query parameters and the unsigned headers do not matter.
+			req, auth = signedProviderRequest(signer, "signed data")
+			req.URL.RawQuery = "a=0&b=2&a=1"
+			req.Header.Set("User-Agent", "another agent")
+			So(checkCode(req, auth), ShouldBeBlank)
+		})
+
+		Convey("The malformed credentials and the unknown keys are rejected", func() {
+			req, auth := signedProviderRequest(signer, "signed data")
+			for _, credential := range []string{"", "signingAccessKey:signature", "HMAC-SHA1:signingAccessKey:host;x-goswift-date:abc",
+				"HMAC-SHA256:signingAccessKey:host:abc", "HMAC-SHA256:signingAccessKey:x-goswift-date;host:abc"} {
+				So(checkCode(req, &headerauth.AuthInfo{AccessKey: credential}), ShouldEqual, "signature_invalid")
+			}
+			signer.AccessKey = "unknownAccessKey"
+			req, auth = signedProviderRequest(signer, "signed data")
+			So(checkCode(req, auth), ShouldEqual, "signature_invalid")
+		})
+
+		Convey("The requests too far from the server time are rejected", func() {
+			signer.Now = func() time.Time { return time.Now().Add(-DefaultSigningSkew - time.Minute) }
+			req, auth := signedProviderRequest(signer, "signed data")
+			So(checkCode(req, auth), ShouldEqual, "signature_expired")
+			m.Signing.MaxSkew = time.Hour
+			req, auth = signedProviderRequest(signer, "signed data")
+			So(checkCode(req, auth), ShouldBeBlank)
+		})
+
+		Convey("Each provider may only sign with its allowed algorithms", func() {
+			m.Signing = SigningSettings{Algorithms: []string{"HMAC-SHA256"}, Providers: map[int][]string{1: {"HMAC-SHA512"}}}
+			req, auth := signedProviderRequest(signer, "signed data")
+			So(checkCode(req, auth), ShouldEqual, "algorithm_not_allowed")
+			signer.Algorithm = "HMAC-SHA512"
+			req, auth = signedProviderRequest(signer, "signed data")
+			So(checkCode(req, auth), ShouldBeBlank)
+		})
+
+		Convey("The signed payloads are persisted once as indexed items", func() {
+			redisServer := newFakeRedis()
+			defer redisServer.Close()
+			bucket := newMemoryBucket()
+			store := newMemoryProviderStore(2)
+			store.CreateKey(&ProviderKey{ProviderID: 2, AccessKey: "contentAccessKey", SecretKey: "contentSecret"})
+			defer providerCache.Delete("contentAccessKey")
+			values := testConfigValues()
+			values["MAX_BODY_PROVIDER"] = "64"
+			cfg, err := ParseConfig(values)
+			So(err, ShouldBeNil)
+			server, err := NewServer(cfg, Dependencies{Redis: redisServer.Client(), Bucket: bucket, Providers: store})
+			So(err, ShouldBeNil)
+			defer server.Close()
+			contentSigner := client.NewSigner("contentAccessKey", "contentSecret")
+			for i := 0; i < 2; i++ {
+				req, _ := signedProviderRequest(contentSigner, `{"title": "some content"}`)
+				w := httptest.NewRecorder()
+				server.Engine.ServeHTTP(w, req)
+				So(w.Code, ShouldEqual, 202)
+				So(w.Body.String(), ShouldContainSubstring, `"checksum"`)
+				server.persisterWg.Wait()
+			}
+			bucket.mu.Lock()
+			contents, indexes := 0, 0
+			for path, data := range bucket.objects {
+				switch {
+				case strings.Contains(path, indexFolder+"/content/valid/contentAccessKey_"):
+					indexes++
+					So(strings.Count(string(data), "contentAccessKey\t"), ShouldEqual, 2)
+				case strings.Contains(path, "/content/valid/"):
+					contents++
+					So(string(data), ShouldEqual, `{"title": "some content"}`)
+				}
+			}
+			bucket.mu.Unlock()
+			So(contents, ShouldEqual, 1)
+			So(indexes, ShouldEqual, 1)
+
+			req, _ := signedProviderRequest(contentSigner, strings.Repeat("a", 65))
+			w := httptest.NewRecorder()
+			server.Engine.ServeHTTP(w, req)
+			So(w.Code, ShouldEqual, 413)
+		})
+	})
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/mitchellh/goamz/s3"
+	. "github.com/smartystreets/goconvey/convey"
+	"gopkg.in/redis.v3"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedisArity is the minimum number of arguments, including the command, of each supported command.
+var fakeRedisArity = map[string]int{"PING": 1, "AUTH": 2, "SELECT": 2, "FLUSHDB": 1, "GET": 2, "SET": 3,
+	"INCR": 2, "INCRBY": 3, "TTL": 2, "PTTL": 2, "EXPIRE": 3, "DEL": 2, "SUBSCRIBE": 2, "PUBLISH": 3}
+
+// fakeRedis is an in-process Redis server which implements the commands goswift uses, over the Redis protocol.
+type fakeRedis struct {
+	ln          net.Listener
+	mu          sync.Mutex
+	values      map[string]string
+	expires     map[string]time.Time
+	subscribers map[string]map[*fakeRedisConn]bool
+}
+
+// fakeRedisConn is a client connection of the fake Redis, which the publishers also write to.
+type fakeRedisConn struct {
+	net.Conn
+	mu         sync.Mutex
+	subscribed bool
+}
+
+// write writes the reply, without interleaving it with the messages of the publishers.
+func (c *fakeRedisConn) write(reply string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := io.WriteString(c.Conn, reply)
+	return err
+}
+
+// fakeRedisArray returns the encoded array of bulk strings, followed by the already encoded replies.
+func fakeRedisArray(bulks []string, replies ...string) string {
+	encoded := fmt.Sprintf("*%d\r\n", len(bulks)+len(replies))
+	for _, bulk := range bulks {
+		encoded += fmt.Sprintf("$%d\r\n%s\r\n", len(bulk), bulk)
+	}
+	return encoded + strings.Join(replies, "")
+}
+
+// newFakeRedis starts a fake Redis server on a random local port.
+func newFakeRedis() *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	r := &fakeRedis{ln: ln, values: make(map[string]string), expires: make(map[string]time.Time),
+		subscribers: make(map[string]map[*fakeRedisConn]bool)}
+	go r.serve()
+	return r
+}
+
+// URL returns the Redis URL of the server.
+func (r *fakeRedis) URL() string {
+	return "redis://" + r.ln.Addr().String()
+}
+
+// Client returns a new client of the server.
+func (r *fakeRedis) Client() *redis.Client {
+	client, err := NewRedisClient(r.URL())
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// Close stops accepting connections.
+func (r *fakeRedis) Close() error {
+	return r.ln.Close()
+}
+
+// serve accepts the connections until the server is closed.
+func (r *fakeRedis) serve() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+// handle replies to the commands of the connection until it is closed.
+func (r *fakeRedis) handle(netConn net.Conn) {
+	conn := &fakeRedisConn{Conn: netConn}
+	defer func() {
+		r.mu.Lock()
+		for _, conns := range r.subscribers {
+			delete(conns, conn)
+		}
+		r.mu.Unlock()
+		conn.Close()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			return
+		}
+		if err := conn.write(r.exec(conn, args)); err != nil {
+			return
+		}
+	}
+}
+
+// readRESPCommand reads a command, either as an array of bulk strings or inline.
+func readRESPCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	count, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, count)
+	for i := range args {
+		if line, err = reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimRight(line, "\r\n")[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2) // Includes the trailing CRLF.
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+// exec runs the command of the connection and returns its encoded reply.
+func (r *fakeRedis) exec(conn *fakeRedisConn, args []string) string {
+	if len(args) == 0 {
+		return "-ERR empty command\r\n"
+	}
+	cmd := strings.ToUpper(args[0])
+	arity, known := fakeRedisArity[cmd]
+	if !known {
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	} else if len(args) < arity {
+		return fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", args[0])
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for key, expiry := range r.expires {
+		if !expiry.After(now) {
+			delete(r.values, key)
+			delete(r.expires, key)
+		}
+	}
+	switch cmd {
+	case "PING":
+		if conn.subscribed {
+			return fakeRedisArray([]string{"pong", ""})
+		}
+		return "+PONG\r\n"
+	case "SUBSCRIBE":
+		conn.subscribed = true
+		replies := ""
+		for _, channel := range args[1:] {
+			if r.subscribers[channel] == nil {
+				r.subscribers[channel] = make(map[*fakeRedisConn]bool)
+			}
+			r.subscribers[channel][conn] = true
+			replies += fakeRedisArray([]string{"subscribe", channel}, fmt.Sprintf(":%d\r\n", len(r.subscribers[channel])))
+		}
+		return replies
+	case "PUBLISH":
+		for subscriber := range r.subscribers[args[1]] {
+			subscriber.write(fakeRedisArray([]string{"message", args[1], args[2]}))
+		}
+		return fmt.Sprintf(":%d\r\n", len(r.subscribers[args[1]]))
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "FLUSHDB":
+		r.values = make(map[string]string)
+		r.expires = make(map[string]time.Time)
+		return "+OK\r\n"
+	case "GET":
+		val, ok := r.values[args[1]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(val), val)
+	case "SET":
+		r.values[args[1]] = args[2]
+		delete(r.expires, args[1])
+		if len(args) == 5 {
+			unit := time.Second
+			if strings.ToUpper(args[3]) == "PX" {
+				unit = time.Millisecond
+			}
+			ttl, err := strconv.ParseInt(args[4], 10, 64)
+			if err != nil || ttl <= 0 {
+				return "-ERR invalid expire time in set\r\n"
+			}
+			r.expires[args[1]] = now.Add(time.Duration(ttl) * unit)
+		}
+		return "+OK\r\n"
+	case "INCR", "INCRBY":
+		incr := int64(1)
+		if cmd == "INCRBY" {
+			var err error
+			if incr, err = strconv.ParseInt(args[2], 10, 64); err != nil {
+				return "-ERR value is not an integer or out of range\r\n"
+			}
+		}
+		val := int64(0)
+		if valStr, ok := r.values[args[1]]; ok {
+			var err error
+			if val, err = strconv.ParseInt(valStr, 10, 64); err != nil {
+				return "-ERR value is not an integer or out of range\r\n"
+			}
+		}
+		val += incr
+		r.values[args[1]] = strconv.FormatInt(val, 10)
+		return fmt.Sprintf(":%d\r\n", val)
+	case "TTL", "PTTL":
+		if _, ok := r.values[args[1]]; !ok {
+			return ":-2\r\n"
+		}
+		expiry, ok := r.expires[args[1]]
+		if !ok {
+			return ":-1\r\n"
+		}
+		unit := time.Second
+		if cmd == "PTTL" {
+			unit = time.Millisecond
+		}
+		return fmt.Sprintf(":%d\r\n", (expiry.Sub(now)+unit/2)/unit)
+	case "EXPIRE":
+		ttl, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		if _, ok := r.values[args[1]]; !ok {
+			return ":0\r\n"
+		}
+		r.expires[args[1]] = now.Add(time.Duration(ttl) * time.Second)
+		return ":1\r\n"
+	default: // DEL
+		deleted := 0
+		for _, key := range args[1:] {
+			if _, ok := r.values[key]; ok {
+				delete(r.values, key)
+				delete(r.expires, key)
+				deleted++
+			}
+		}
+		return fmt.Sprintf(":%d\r\n", deleted)
+	}
+}
+
+// memoryBucket is an in-memory Bucket.
+type memoryBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+// newMemoryBucket returns an empty memoryBucket.
+func newMemoryBucket() *memoryBucket {
+	return &memoryBucket{objects: make(map[string][]byte)}
+}
+
+// Get returns the data of the object, or the S3 error if it does not exist.
+func (b *memoryBucket) Get(path string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.objects[path]
+	if !ok {
+		return nil, &s3.Error{StatusCode: 404, Code: "NoSuchKey", Message: "The specified key does not exist."}
+	}
+	return append([]byte(nil), data...), nil
+}
+
+// PutHeader stores a copy of the data. The headers and ACL are ignored.
+func (b *memoryBucket) PutHeader(path string, data []byte, customHeaders map[string][]string, perm s3.ACL) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objects[path] = append([]byte(nil), data...)
+	return nil
+}
+
+// PutReaderHeader stores the data read from the reader, which must be of the provided length.
+func (b *memoryBucket) PutReaderHeader(path string, r io.Reader, length int64, customHeaders map[string][]string, perm s3.ACL) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, length))
+	if err != nil {
+		return err
+	} else if int64(len(data)) != length {
+		return fmt.Errorf("read %d bytes instead of %d", len(data), length)
+	}
+	return b.PutHeader(path, data, customHeaders, perm)
+}
+
+// Del deletes the object. Like on S3, deleting a missing object is not an error.
+func (b *memoryBucket) Del(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, path)
+	return nil
+}
+
+// List returns up to max keys after the marker which start with the prefix, sorted. The keys which contain
+// the delimiter after the prefix are grouped in the common prefixes.
+func (b *memoryBucket) List(prefix, delim, marker string, max int) (*s3.ListResp, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	paths := make([]string, 0, len(b.objects))
+	for path := range b.objects {
+		if strings.HasPrefix(path, prefix) && path > marker {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	resp := &s3.ListResp{Prefix: prefix, Delimiter: delim, Marker: marker, MaxKeys: max}
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if len(resp.Contents)+len(resp.CommonPrefixes) == max {
+			resp.IsTruncated = true
+			break
+		}
+		if idx := strings.Index(path[len(prefix):], delim); delim != "" && idx >= 0 {
+			common := path[:len(prefix)+idx+len(delim)]
+			if !seen[common] {
+				seen[common] = true
+				resp.CommonPrefixes = append(resp.CommonPrefixes, common)
+			}
+			continue
+		}
+		resp.Contents = append(resp.Contents, s3.Key{Key: path, Size: int64(len(b.objects[path]))})
+	}
+	return resp, nil
+}
+
+// memoryProviderStore is an in-memory ProviderKeyStore of the provided content providers.
+type memoryProviderStore struct {
+	mu        sync.Mutex
+	providers map[int]bool
+	keys      []*ProviderKey
+	previous  map[string]string // Previous secrets by access key.
+	quotas    map[int]ProviderQuota
+}
+
+// newMemoryProviderStore returns an empty store of the providers.
+func newMemoryProviderStore(providerIDs ...int) *memoryProviderStore {
+	store := &memoryProviderStore{providers: make(map[int]bool), previous: make(map[string]string),
+		quotas: make(map[int]ProviderQuota)}
+	for _, providerID := range providerIDs {
+		store.providers[providerID] = true
+	}
+	return store
+}
+
+// key returns the stored key of the access key, or nil.
+func (s *memoryProviderStore) key(accessKey string) *ProviderKey {
+	for _, key := range s.keys {
+		if key.AccessKey == accessKey {
+			return key
+		}
+	}
+	return nil
+}
+
+// Lookup returns the provider information of the enabled access key.
+func (s *memoryProviderStore) Lookup(accessKey string) (*ContentProviderInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.key(accessKey)
+	if key == nil || key.Disabled {
+		return nil, ErrKeyNotFound
+	}
+	info := &ContentProviderInfo{id: key.ProviderID, secret: key.SecretKey}
+	if previous, exists := s.previous[accessKey]; exists && key.PreviousExpires != nil {
+		info.previousSecret, info.previousExpires = previous, *key.PreviousExpires
+	}
+	if quota, exists := s.quotas[key.ProviderID]; exists {
+		info.quota = &quota
+	}
+	return info, nil
+}
+
+// ListKeys returns the keys of the provider, without their secrets.
+func (s *memoryProviderStore) ListKeys(providerID int) ([]*ProviderKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]*ProviderKey, 0)
+	for _, key := range s.keys {
+		if key.ProviderID == providerID {
+			listed := *key
+			listed.SecretKey = ""
+			if listed.PreviousExpires != nil && !listed.PreviousExpires.After(time.Now()) {
+				listed.PreviousExpires = nil
+			}
+			keys = append(keys, &listed)
+		}
+	}
+	return keys, nil
+}
+
+// CreateKey stores a copy of the key.
+func (s *memoryProviderStore) CreateKey(key *ProviderKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.providers[key.ProviderID] {
+		return ErrProviderNotFound
+	}
+	key.ID = len(s.keys) + 1
+	stored := *key
+	s.keys = append(s.keys, &stored)
+	return nil
+}
+
+// DisableKey disables the access key.
+func (s *memoryProviderStore) DisableKey(accessKey string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.key(accessKey)
+	if key == nil {
+		return ErrKeyNotFound
+	}
+	key.Disabled = true
+	return nil
+}
+
+// RotateKey replaces the secret of the enabled access key, and keeps the replaced one until previousExpires.
+func (s *memoryProviderStore) RotateKey(accessKey string, secretKey string, previousExpires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := s.key(accessKey)
+	if key == nil || key.Disabled {
+		return ErrKeyNotFound
+	}
+	s.previous[accessKey] = key.SecretKey
+	key.SecretKey = secretKey
+	key.PreviousExpires = &previousExpires
+	return nil
+}
+
+// TestFakes tests the fakes used by the other tests.
+func TestFakes(t *testing.T) {
+	Convey("The fakes tests, ", t, func() {
+		Convey("The fake Redis expires the keys", func() {
+			server := newFakeRedis()
+			defer server.Close()
+			client := server.Client()
+			defer client.Close()
+			So(client.Ping().Err(), ShouldBeNil)
+			So(client.Set("perishing", 1, time.Millisecond*50).Err(), ShouldBeNil)
+			So(client.Incr("perishing").Val(), ShouldEqual, 2)
+			time.Sleep(time.Millisecond * 100)
+			So(client.Get("perishing").Err(), ShouldEqual, redis.Nil)
+			So(client.TTL("perishing").Val(), ShouldBeLessThan, 0)
+		})
+
+		Convey("The fake Redis publishes the messages to the subscribers", func() {
+			server := newFakeRedis()
+			defer server.Close()
+			client := server.Client()
+			defer client.Close()
+			pubsub, err := client.Subscribe("channel")
+			So(err, ShouldBeNil)
+			defer pubsub.Close()
+			// The subscription is confirmed before the message, which ReceiveMessage skips.
+			time.Sleep(time.Millisecond * 50)
+			So(client.Publish("channel", "hello").Val(), ShouldEqual, 1)
+			msg, err := pubsub.ReceiveMessage()
+			So(err, ShouldBeNil)
+			So(msg.Payload, ShouldEqual, "hello")
+		})
+
+		Convey("The memory bucket lists like S3", func() {
+			bucket := newMemoryBucket()
+			var _ Bucket = bucket
+			_, err := bucket.Get("/missing")
+			So(err, ShouldNotBeNil)
+			for _, path := range []string{"/a/1", "/a/2", "/a/b/3", "/c"} {
+				bucket.PutHeader(path, []byte(path), nil, s3.Private)
+			}
+			resp, _ := bucket.List("/a/", "/", "", 10)
+			So(len(resp.Contents), ShouldEqual, 2)
+			So(resp.CommonPrefixes, ShouldResemble, []string{"/a/b/"})
+			resp, _ = bucket.List("/", "", "/a/1", 2)
+			So(resp.Contents[0].Key, ShouldEqual, "/a/2")
+			So(resp.IsTruncated, ShouldBeTrue)
+		})
+	})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/redis.v3"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// ReadinessTimeout is the maximum time a single dependency check may take.
+	ReadinessTimeout = time.Second * 2
+	// PersistSaturation is the ratio of the persist channel capacity above which the node is not ready.
+	PersistSaturation = 0.9
+	// DrainGracePeriod is the time given to load balancers to notice that the node is draining.
+	DrainGracePeriod = time.Second * 10
+)
+
+// draining is set to 1 when the server is shutting down.
+var draining int32
+
+// BeginDrain marks the server as draining, which makes the readiness check fail.
+func BeginDrain() {
+	atomic.StoreInt32(&draining, 1)
+}
+
+// IsDraining returns whether the server is shutting down.
+func IsDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+// HandleShutdownSignals drains the server on SIGINT or SIGTERM: readiness fails for DrainGracePeriod
+// so that load balancers stop routing to this node, then the server is drained. The returned channel is closed
+// once the server stopped, and the pending persistences must then be awaited.
+func HandleShutdownSignals(server *http.Server) <-chan struct{} {
+	done := make(chan struct{})
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-sigChan
+		signal.Stop(sigChan)
+		log.Notice("Received %s, draining for %s.", sig, DrainGracePeriod)
+		BeginDrain()
+		time.Sleep(DrainGracePeriod)
+		drainServer(server)
+		close(done)
+	}()
+	return done
+}
+
+// drainServer stops the server from accepting connections and waits up to DrainGracePeriod for the in-flight
+// requests, after which the remaining connections are closed.
+func drainServer(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), DrainGracePeriod)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error("Could not drain the requests within %s, closing their connections: %s", DrainGracePeriod, err)
+		server.Close()
+	}
+}
+
+// DependencyStatus is the result of a single dependency check. The error of a failed check is only logged,
+// since the readiness endpoint is public and the errors may contain the hosts or the credentials.
+type DependencyStatus struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// DependencyCheck returns an error if the dependency is not usable.
+type DependencyCheck func() error
+
+// GetHealthz is the liveness check: if this responds, the process is alive.
+func GetHealthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// NewReadinessHandler returns the readiness check handler, which checks Redis, Postgres,
+// the storage bucket and the saturation of the provided persist channel.
+func NewReadinessHandler(persistChan chan *S3Persist, bucket Bucket, redisClient *redis.Client, databaseURL string) gin.HandlerFunc {
+	// database/sql keeps a pool, so a single one is pinged by every check rather than opened on each.
+	db := GetDBConn(databaseURL)
+	checks := map[string]DependencyCheck{
+		"redis": func() error {
+			return redisClient.Ping().Err()
+		},
+		"postgres": func() error {
+			return db.Ping()
+		},
+		"storage": func() error {
+			_, err := bucket.List(rootPath, "/", "", 1)
+			return err
+		},
+		"persister": func() error {
+			if float64(len(persistChan)) >= PersistSaturation*float64(cap(persistChan)) {
+				return fmt.Errorf("persist channel saturated (%d/%d)", len(persistChan), cap(persistChan))
+			}
+			return nil
+		},
+	}
+	return func(c *gin.Context) {
+		if IsDraining() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+			return
+		}
+		results := RunDependencyChecks(checks, ReadinessTimeout)
+		status, code := "ok", http.StatusOK
+		for _, result := range results {
+			if result.Status != "ok" {
+				status, code = "unavailable", http.StatusServiceUnavailable
+				break
+			}
+		}
+		c.JSON(code, gin.H{"status": status, "checks": results})
+	}
+}
+
+// RunDependencyChecks runs all the checks concurrently. A check which does not return within the timeout is failed.
+func RunDependencyChecks(checks map[string]DependencyCheck, timeout time.Duration) map[string]*DependencyStatus {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]*DependencyStatus, len(checks))
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check DependencyCheck) {
+			defer wg.Done()
+			start := time.Now()
+			errChan := make(chan error, 1) // Buffered so a check which times out does not leak its goroutine forever.
+			go func() {
+				errChan <- check()
+			}()
+			var err error
+			select {
+			case err = <-errChan:
+			case <-time.After(timeout):
+				err = fmt.Errorf("timed out after %s", timeout)
+			}
+			result := &DependencyStatus{Status: "ok", LatencyMs: float64(time.Since(start)) / float64(time.Millisecond)}
+			if err != nil {
+				log.Warning("readiness check %s failed: %s", name, err)
+				result.Status = "unavailable"
+			}
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+	return results
+}
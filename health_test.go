@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestHealth tests the dependency checks used by the readiness endpoint.
+func TestHealth(t *testing.T) {
+	Convey("The readiness checks, ", t, func() {
+		Convey("Report each dependency separately", func() {
+			checks := map[string]DependencyCheck{
+				"up":   func() error { return nil },
+				"down": func() error { return errors.New("dial tcp db.internal:5432: connection refused") },
+			}
+			results := RunDependencyChecks(checks, time.Second)
+			So(results["up"].Status, ShouldEqual, "ok")
+			So(results["down"].Status, ShouldEqual, "unavailable")
+			data, err := json.Marshal(results)
+			So(err, ShouldBeNil)
+			So(string(data), ShouldNotContainSubstring, "db.internal")
+		})
+
+		Convey("Fail a dependency which hangs", func() {
+			checks := map[string]DependencyCheck{
+				"hanging": func() error { time.Sleep(time.Second); return nil },
+			}
+			results := RunDependencyChecks(checks, time.Millisecond*10)
+			So(results["hanging"].Status, ShouldEqual, "unavailable")
+		})
+
+		Convey("Draining the server lets the in-flight requests finish", func() {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			started := make(chan struct{})
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(time.Millisecond * 100)
+				w.Write([]byte("done"))
+			})}
+			go server.Serve(ln)
+			result := make(chan error, 1)
+			go func() {
+				resp, err := http.Get("http://" + ln.Addr().String())
+				if err == nil {
+					resp.Body.Close()
+				}
+				result <- err
+			}()
+			<-started
+			drainServer(server)
+			So(<-result, ShouldBeNil)
+			_, err = http.Get("http://" + ln.Addr().String())
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
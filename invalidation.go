@@ -0,0 +1,84 @@
+package main
+
+import (
+	"gopkg.in/redis.v3"
+	"time"
+)
+
+const (
+	// ProviderInvalidationChannel is the Redis channel on which the changed access keys are published.
+	ProviderInvalidationChannel = "goswift:providers:invalidate"
+	// TokenRevocationChannel is the Redis channel on which the revoked perishable tokens are published.
+	TokenRevocationChannel = "goswift:tokens:revoke"
+)
+
+// invalidationHandlers maps each invalidation channel to the function which applies a published value locally.
+var invalidationHandlers = map[string]func(string){
+	ProviderInvalidationChannel: invalidateProviderKey,
+	TokenRevocationChannel:      revokeCachedToken,
+}
+
+// PublishInvalidation applies the invalidation locally, and publishes it to the other instances through Redis.
+func PublishInvalidation(client *redis.Client, channel string, value string) error {
+	invalidationHandlers[channel](value)
+	return client.Publish(channel, value).Err()
+}
+
+// WatchInvalidations applies the invalidations published by all the instances, until the subscription fails
+// or done is closed, in which case this returns nil.
+func WatchInvalidations(client *redis.Client, done <-chan struct{}) error {
+	channels := make([]string, 0, len(invalidationHandlers))
+	for channel := range invalidationHandlers {
+		channels = append(channels, channel)
+	}
+	pubsub, err := client.Subscribe(channels...)
+	if err != nil {
+		return err
+	}
+	// Closing the subscription is what interrupts ReceiveMessage when done is closed.
+	failed := make(chan struct{})
+	defer close(failed)
+	go func() {
+		select {
+		case <-done:
+		case <-failed:
+		}
+		pubsub.Close()
+	}()
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			select {
+			case <-done:
+				return nil
+			default:
+				return err
+			}
+		}
+		if handler, exists := invalidationHandlers[msg.Channel]; exists {
+			handler(msg.Payload)
+		}
+	}
+}
+
+// watchInvalidations keeps watching the invalidations, and subscribes again whenever the subscription fails,
+// until done is closed. Since invalidations may have been missed in the meantime, the caches are then flushed.
+func watchInvalidations(client *redis.Client, done <-chan struct{}) {
+	for {
+		err := WatchInvalidations(client, done)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		log.Error("invalidations subscription failed, retrying: %s", err)
+		providerCache.Flush()
+		invalidAccessCache.Flush()
+		perishableCache.Flush()
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
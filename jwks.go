@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// JWKSMinRefresh is the minimum time between two loads of the JWKS, e.g. when a JWT has an unknown key ID.
+	JWKSMinRefresh = time.Second * 30
+	// MaxJWKSSize is the maximum size of a JWKS document.
+	MaxJWKSSize = 1 << 20
+)
+
+// JWK is a JSON Web Key. Only the RSA and the P-256 elliptic curve public keys are supported.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// PublicKey returns the RSA or ECDSA public key of the JWK.
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, nErr := base64.RawURLEncoding.DecodeString(k.N)
+		e, eErr := base64.RawURLEncoding.DecodeString(k.E)
+		if nErr != nil || eErr != nil || len(n) == 0 || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA key `%s`", k.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve `%s` of key `%s`", k.Crv, k.Kid)
+		}
+		x, xErr := base64.RawURLEncoding.DecodeString(k.X)
+		y, yErr := base64.RawURLEncoding.DecodeString(k.Y)
+		if xErr != nil || yErr != nil {
+			return nil, fmt.Errorf("invalid EC key `%s`", k.Kid)
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid EC key `%s`", k.Kid)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type `%s` of key `%s`", k.Kty, k.Kid)
+}
+
+// jwksKey is a public key of the JWKS, with the algorithm it is restricted to, if any.
+type jwksKey struct {
+	alg string
+	key crypto.PublicKey
+}
+
+// JWKS caches the public keys of a JSON Web Key Set, read from a file or fetched from an URL.
+// The keys are loaded again after the refresh interval, or sooner when a JWT has an unknown key ID,
+// which happens after the keys are rotated. If a load fails, the previous keys are kept.
+type JWKS struct {
+	source     string
+	refresh    time.Duration
+	minRefresh time.Duration
+	client     *http.Client
+	mu         sync.Mutex
+	keys       map[string]*jwksKey
+	loadedAt   time.Time     // Time of the last load, even if it failed.
+	loadErr    error         // Error of the last load, returned while there are no keys.
+	loading    chan struct{} // Closed when the current load is done, nil if there is none.
+}
+
+// NewJWKS returns a new JWKS of the file or the http(s) URL. The keys are only loaded when first needed.
+func NewJWKS(source string, refresh time.Duration) *JWKS {
+	return &JWKS{source: source, refresh: refresh, minRefresh: JWKSMinRefresh, client: &http.Client{Timeout: time.Second * 10}}
+}
+
+// Key returns the public key of the key ID, and the algorithm which the key is restricted to, if any.
+// The key ID may be empty when the set has a single key.
+func (j *JWKS) Key(kid string) (crypto.PublicKey, string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	since := time.Since(j.loadedAt)
+	_, known := j.keys[kid]
+	missing := j.keys == nil || !known && kid != ""
+	// After a failed load or on an unknown key ID, the keys are only loaded again after minRefresh.
+	// The requests whose key is missing wait for the load in progress, if any, but not the others.
+	if since >= j.refresh || missing && (since >= j.minRefresh || j.loading != nil) {
+		j.reload()
+	}
+	if j.keys == nil {
+		return nil, "", j.loadErr
+	}
+	key, known := j.keys[kid]
+	if kid == "" && len(j.keys) == 1 {
+		for _, key = range j.keys {
+			known = true
+		}
+	}
+	if !known {
+		return nil, "", fmt.Errorf("unknown JWT key `%s`", kid)
+	}
+	return key.key, key.alg, nil
+}
+
+// reload loads the keys, or waits for the load which is in progress. It must be called with the lock held,
+// which is released while loading, so that the requests whose keys are known are not blocked by the fetch.
+func (j *JWKS) reload() {
+	if loading := j.loading; loading != nil {
+		j.mu.Unlock()
+		<-loading
+		j.mu.Lock()
+		return
+	}
+	loading := make(chan struct{})
+	j.loading, j.loadedAt = loading, time.Now()
+	j.mu.Unlock()
+	keys, err := j.load()
+	j.mu.Lock()
+	if err == nil {
+		j.keys = keys
+	} else if j.keys != nil {
+		log.Warning("could not reload the JWKS, keeping the previous keys: %s", err)
+	}
+	j.loadErr = err
+	j.loading = nil
+	close(loading)
+}
+
+// load reads the JWKS and returns its signature keys by key ID. The unsupported keys are skipped.
+func (j *JWKS) load() (map[string]*jwksKey, error) {
+	data, err := j.read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read the JWKS %s: %s", j.source, err)
+	}
+	var set struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS %s: %s", j.source, err)
+	}
+	keys := make(map[string]*jwksKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			log.Warning("skipping a key of the JWKS %s: %s", j.source, err)
+			continue
+		}
+		keys[jwk.Kid] = &jwksKey{jwk.Alg, key}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("the JWKS %s has no supported key", j.source)
+	}
+	return keys, nil
+}
+
+// read returns the JWKS document, from the URL or from the file.
+func (j *JWKS) read() ([]byte, error) {
+	if !strings.HasPrefix(j.source, "http://") && !strings.HasPrefix(j.source, "https://") {
+		return ioutil.ReadFile(j.source)
+	}
+	resp, err := j.client.Get(j.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, MaxJWKSSize))
+}
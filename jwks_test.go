@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testJWK returns the JWK of the RSA or ECDSA public key.
+func testJWK(kid string, key crypto.PublicKey) JWK {
+	enc := base64.RawURLEncoding.EncodeToString
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		return JWK{Kty: "RSA", Kid: kid, Use: "sig", N: enc(pub.N.Bytes()), E: enc(big.NewInt(int64(pub.E)).Bytes())}
+	case *ecdsa.PublicKey:
+		return JWK{Kty: "EC", Kid: kid, Crv: "P-256", X: enc(pub.X.Bytes()), Y: enc(pub.Y.Bytes())}
+	}
+	panic("unsupported key")
+}
+
+// testJWKSDocument returns the JWKS document of the JWKs.
+func testJWKSDocument(keys ...JWK) []byte {
+	data, _ := json.Marshal(map[string][]JWK{"keys": keys})
+	return data
+}
+
+// TestJWKS tests the parsing, the fetching and the caching of the JWKS.
+func TestJWKS(t *testing.T) {
+	Convey("The JWKS tests, ", t, func() {
+		rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+		Convey("RSA and P-256 keys are parsed", func() {
+			key, err := testJWK("rsa", &rsaKey.PublicKey).PublicKey()
+			So(err, ShouldBeNil)
+			So(key.(*rsa.PublicKey).N.Cmp(rsaKey.N), ShouldEqual, 0)
+			So(key.(*rsa.PublicKey).E, ShouldEqual, rsaKey.E)
+			key, err = testJWK("ec", &ecKey.PublicKey).PublicKey()
+			So(err, ShouldBeNil)
+			So(key.(*ecdsa.PublicKey).X.Cmp(ecKey.X), ShouldEqual, 0)
+
+			_, err = JWK{Kty: "oct", Kid: "hmac"}.PublicKey()
+			So(err, ShouldNotBeNil)
+			invalid := testJWK("ec", &ecKey.PublicKey)
+			invalid.Y = invalid.X
+			_, err = invalid.PublicKey()
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The JWKS is fetched when first needed, then cached until a key ID is unknown", func() {
+			var document atomic.Value
+			document.Store(testJWKSDocument(testJWK("k1", &rsaKey.PublicKey)))
+			var fetches int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&fetches, 1)
+				w.Write(document.Load().([]byte))
+			}))
+			defer server.Close()
+			jwks := NewJWKS(server.URL, time.Hour)
+			So(atomic.LoadInt32(&fetches), ShouldEqual, 0)
+
+			key, _, err := jwks.Key("k1")
+			So(err, ShouldBeNil)
+			_, isRSA := key.(*rsa.PublicKey)
+			So(isRSA, ShouldBeTrue)
+			_, _, err = jwks.Key("")
+			So(err, ShouldBeNil)
+			So(atomic.LoadInt32(&fetches), ShouldEqual, 1)
+
+			// The keys are rotated: the unknown key ID loads the JWKS again, but not more than once per minRefresh.
+			document.Store(testJWKSDocument(testJWK("k2", &ecKey.PublicKey)))
+			_, _, err = jwks.Key("k2")
+			So(err, ShouldNotBeNil)
+			So(atomic.LoadInt32(&fetches), ShouldEqual, 1)
+			jwks.minRefresh = 0
+			key, _, err = jwks.Key("k2")
+			So(err, ShouldBeNil)
+			_, isEC := key.(*ecdsa.PublicKey)
+			So(isEC, ShouldBeTrue)
+			So(atomic.LoadInt32(&fetches), ShouldEqual, 2)
+			_, _, err = jwks.Key("k1")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The JWKS is fetched once for concurrent requests, without blocking the known keys", func() {
+			var fetches int32
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&fetches, 1) > 1 {
+					<-release
+				}
+				w.Write(testJWKSDocument(testJWK("k1", &rsaKey.PublicKey), testJWK("k2", &ecKey.PublicKey)))
+			}))
+			defer server.Close()
+			jwks := NewJWKS(server.URL, time.Hour)
+			_, _, err := jwks.Key("k1")
+			So(err, ShouldBeNil)
+			jwks.minRefresh = 0
+			jwks.mu.Lock()
+			delete(jwks.keys, "k2")
+			jwks.mu.Unlock()
+
+			var wg sync.WaitGroup
+			errs := make(chan error, 5)
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, _, err := jwks.Key("k2")
+					errs <- err
+				}()
+			}
+			for atomic.LoadInt32(&fetches) < 2 {
+				time.Sleep(time.Millisecond)
+			}
+			// The fetch is in progress, but the known key is still available.
+			_, _, err = jwks.Key("k1")
+			So(err, ShouldBeNil)
+			close(release)
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				So(err, ShouldBeNil)
+			}
+			So(atomic.LoadInt32(&fetches), ShouldEqual, 2)
+		})
+
+		Convey("The previous keys are kept when a load fails", func() {
+			var fail int32
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.LoadInt32(&fail) == 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Write(testJWKSDocument(testJWK("k1", &rsaKey.PublicKey)))
+			}))
+			defer server.Close()
+			jwks := NewJWKS(server.URL, time.Hour)
+			_, _, err := jwks.Key("k1")
+			So(err, ShouldBeNil)
+			atomic.StoreInt32(&fail, 1)
+			jwks.refresh = 0
+			_, _, err = jwks.Key("k1")
+			So(err, ShouldBeNil)
+		})
+
+		Convey("A JWKS without any supported key is an error", func() {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(testJWKSDocument(JWK{Kty: "oct", Kid: "hmac"}))
+			}))
+			defer server.Close()
+			_, _, err := NewJWKS(server.URL, time.Hour).Key("hmac")
+			So(err, ShouldNotBeNil)
+			_, _, err = NewJWKS("/nonexistent/jwks.json", time.Hour).Key("k1")
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
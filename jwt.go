@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// jwtHeader is the JOSE header of a JWT.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// JWTClaims are the claims of a JWT which goswift uses.
+type JWTClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss,omitempty"`
+	Audience  JWTAudience `json:"aud,omitempty"`
+	ExpiresAt int64       `json:"exp"`
+	NotBefore int64       `json:"nbf,omitempty"`
+	IssuedAt  int64       `json:"iat,omitempty"`
+	Roles     []string    `json:"roles,omitempty"`
+}
+
+// JWTAudience is the aud claim, which is either a single string or an array of strings.
+type JWTAudience []string
+
+// UnmarshalJSON reads a single audience as a one element list.
+func (a *JWTAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = JWTAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = JWTAudience(list)
+	return nil
+}
+
+// Contains returns whether the audience is one of the audiences of the claim.
+func (a JWTAudience) Contains(audience string) bool {
+	for _, aud := range a {
+		if aud == audience {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the time claims, with the provided leeway for the clock skew, and the issuer and the audience
+// when they are not empty. A JWT without an expiration is never valid.
+func (c *JWTClaims) Validate(now time.Time, leeway time.Duration, issuer string, audience string) error {
+	if c.ExpiresAt == 0 || now.Add(-leeway).Unix() >= c.ExpiresAt {
+		return errors.New("expired JWT")
+	}
+	if c.NotBefore != 0 && now.Add(leeway).Unix() < c.NotBefore {
+		return errors.New("JWT not valid yet")
+	}
+	if issuer != "" && c.Issuer != issuer {
+		return fmt.Errorf("unexpected JWT issuer `%s`", c.Issuer)
+	}
+	if audience != "" && !c.Audience.Contains(audience) {
+		return errors.New("JWT not intended for this audience")
+	}
+	return nil
+}
+
+// ErrJWTMalformed is returned when the token is not a compact JWT.
+var ErrJWTMalformed = errors.New("malformed JWT")
+
+// isJWT returns whether the token looks like a compact JWT, i.e. three base64url parts.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// splitJWT decodes the header and the claims of the JWT, and returns them with the signing input and the signature.
+func splitJWT(token string) (*jwtHeader, *JWTClaims, string, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, "", nil, ErrJWTMalformed
+	}
+	headerJSON, headerErr := base64.RawURLEncoding.DecodeString(parts[0])
+	claimsJSON, claimsErr := base64.RawURLEncoding.DecodeString(parts[1])
+	signature, sigErr := base64.RawURLEncoding.DecodeString(parts[2])
+	if headerErr != nil || claimsErr != nil || sigErr != nil {
+		return nil, nil, "", nil, ErrJWTMalformed
+	}
+	header := &jwtHeader{}
+	claims := &JWTClaims{}
+	if json.Unmarshal(headerJSON, header) != nil || json.Unmarshal(claimsJSON, claims) != nil {
+		return nil, nil, "", nil, ErrJWTMalformed
+	}
+	return header, claims, parts[0] + "." + parts[1], signature, nil
+}
+
+// VerifyHS256JWT verifies the HS256 signature of the JWT with the key of its kid, that it has not expired,
+// and that it has the issuer and the audience, unless they are empty. The kid may be omitted when there is a single key.
+func VerifyHS256JWT(token string, keys map[string][]byte, issuer string, audience string, now time.Time) (*JWTClaims, error) {
+	header, claims, signingInput, signature, err := splitJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("unsupported JWT algorithm `%s`", header.Alg)
+	}
+	key, known := keys[header.Kid]
+	if header.Kid == "" && len(keys) == 1 {
+		for _, key = range keys {
+			known = true
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown JWT key `%s`", header.Kid)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signingInput))
+	if !hmac.Equal(mac.Sum(nil), signature) {
+		return nil, errors.New("invalid JWT signature")
+	}
+	if err := claims.Validate(now, 0, issuer, audience); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
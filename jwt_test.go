@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// signTestJWT returns the JWT of the header and claims, signed with HS256.
+func signTestJWT(header map[string]interface{}, claims map[string]interface{}, secret string) string {
+	headerJSON, _ := json.Marshal(header)
+	claimsJSON, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingInput))
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// TestJWT tests the verification of the JWTs.
+func TestJWT(t *testing.T) {
+	Convey("The JWT tests, ", t, func() {
+		secret := "0123456789abcdef0123456789abcdef"
+		keys := map[string][]byte{"k1": []byte(secret)}
+		header := map[string]interface{}{"alg": "HS256", "kid": "k1"}
+		claims := map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix(), "roles": []string{RoleReadMetrics}}
+
+		Convey("A valid JWT returns its claims", func() {
+			verified, err := VerifyHS256JWT(signTestJWT(header, claims, secret), keys, "", "", time.Now())
+			So(err, ShouldBeNil)
+			So(verified.Subject, ShouldEqual, "alice")
+			So(verified.Roles, ShouldResemble, []string{RoleReadMetrics})
+		})
+
+		Convey("The kid may be omitted with a single key", func() {
+			_, err := VerifyHS256JWT(signTestJWT(map[string]interface{}{"alg": "HS256"}, claims, secret), keys, "", "", time.Now())
+			So(err, ShouldBeNil)
+		})
+
+		Convey("The issuer and the audience are checked when set", func() {
+			issued := map[string]interface{}{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix(), "iss": "ops", "aud": "goswift-admin"}
+			_, err := VerifyHS256JWT(signTestJWT(header, issued, secret), keys, "ops", "goswift-admin", time.Now())
+			So(err, ShouldBeNil)
+			_, err = VerifyHS256JWT(signTestJWT(header, issued, secret), keys, "ops", "other", time.Now())
+			So(err, ShouldNotBeNil)
+			_, err = VerifyHS256JWT(signTestJWT(header, claims, secret), keys, "ops", "goswift-admin", time.Now())
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Invalid JWTs are rejected", func() {
+			_, err := VerifyHS256JWT(signTestJWT(header, claims, "another secret"), keys, "", "", time.Now())
+			So(err, ShouldNotBeNil)
+			_, err = VerifyHS256JWT(signTestJWT(map[string]interface{}{"alg": "HS256", "kid": "k2"}, claims, secret), keys, "", "", time.Now())
+			So(err, ShouldNotBeNil)
+			_, err = VerifyHS256JWT(signTestJWT(map[string]interface{}{"alg": "none", "kid": "k1"}, claims, secret), keys, "", "", time.Now())
+			So(err, ShouldNotBeNil)
+			_, err = VerifyHS256JWT(signTestJWT(header, claims, secret), keys, "", "", time.Now().Add(time.Hour*2))
+			So(err, ShouldNotBeNil)
+			delete(claims, "exp")
+			_, err = VerifyHS256JWT(signTestJWT(header, claims, secret), keys, "", "", time.Now())
+			So(err, ShouldNotBeNil)
+			_, err = VerifyHS256JWT("not.a.jwt", keys, "", "", time.Now())
+			So(err, ShouldEqual, ErrJWTMalformed)
+		})
+	})
+}
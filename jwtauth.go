@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/ChristopherRabotin/gin-contrib-headerauth"
+	"github.com/gin-gonic/gin"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// JWTClaimsKey is the gin context key where the JWTClaims of the requests authenticated with a JWT are stored.
+	JWTClaimsKey = "claims"
+	// DefaultJWKSRefresh is how often the JWKS is loaded again by default.
+	DefaultJWKSRefresh = time.Hour
+	// DefaultJWTLeeway is the clock skew allowed by default on the exp and nbf claims.
+	DefaultJWTLeeway = time.Second * 30
+)
+
+// JWTSettings configure the JWT bearer tokens issued by the identity service.
+type JWTSettings struct {
+	JWKS     string // File or URL of the JWKS with the public keys of the identity service.
+	Refresh  time.Duration
+	Issuer   string
+	Audience string
+	Leeway   time.Duration // Allowed clock skew on exp and nbf.
+}
+
+// Enabled returns whether a JWKS is configured, which enables the JWT bearer tokens.
+func (s JWTSettings) Enabled() bool {
+	return s.JWKS != ""
+}
+
+// verifiedAuths passes what CheckHeader verified to Authorize, which headerauth then calls with the same AuthInfo,
+// so that the tokens are only verified once per request.
+type verifiedAuths struct {
+	results sync.Map
+}
+
+// store keeps the result of the verification of the AuthInfo until Authorize takes it.
+func (v *verifiedAuths) store(auth *headerauth.AuthInfo, result interface{}) {
+	v.results.Store(auth, result)
+}
+
+// take returns and forgets the result of the verification of the AuthInfo, if CheckHeader stored one.
+func (v *verifiedAuths) take(auth *headerauth.AuthInfo) (interface{}, bool) {
+	return v.results.LoadAndDelete(auth)
+}
+
+// JWTManager defines a header auth manager for the JWT bearer tokens, signed with RS256 or ES256
+// by one of the keys of the JWKS.
+type JWTManager struct {
+	settings JWTSettings
+	jwks     *JWKS
+	verified *verifiedAuths
+	*headerauth.TokenManager
+}
+
+// Verify returns the claims of the JWT if its signature and its claims are valid.
+func (m JWTManager) Verify(token string, now time.Time) (*JWTClaims, error) {
+	header, claims, signingInput, signature, err := splitJWT(token)
+	if err != nil {
+		return nil, err
+	}
+	key, alg, err := m.jwks.Key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if alg != "" && alg != header.Alg {
+		return nil, fmt.Errorf("the JWT key `%s` is restricted to %s", header.Kid, alg)
+	}
+	if err := verifyJWTSignature(header.Alg, key, signingInput, signature); err != nil {
+		return nil, err
+	}
+	if err := claims.Validate(now, m.settings.Leeway, m.settings.Issuer, m.settings.Audience); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// verifyJWTSignature verifies the RS256 or ES256 signature of the signing input with the public key.
+func verifyJWTSignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signingInput))
+	switch alg {
+	case "RS256":
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			if rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature) != nil {
+				return errors.New("invalid JWT signature")
+			}
+			return nil
+		}
+	case "ES256":
+		// The ES256 signature is the concatenation of r and s, of 32 bytes each.
+		if ecKey, ok := key.(*ecdsa.PublicKey); ok {
+			if len(signature) != 64 {
+				return errors.New("invalid JWT signature")
+			}
+			r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+			if !ecdsa.Verify(ecKey, digest[:], r, s) {
+				return errors.New("invalid JWT signature")
+			}
+			return nil
+		}
+	default:
+		return fmt.Errorf("unsupported JWT algorithm `%s`", alg)
+	}
+	return fmt.Errorf("the JWT key does not match the algorithm %s", alg)
+}
+
+// CheckHeader verifies the JWT, and keeps its claims for Authorize.
+func (m JWTManager) CheckHeader(auth *headerauth.AuthInfo, req *http.Request) (err *headerauth.AuthErr) {
+	auth.Secret = ""     // There is no secret key, just an access key.
+	auth.DataToSign = "" // There is no data to sign.
+	claims, jwtErr := m.Verify(auth.AccessKey, time.Now())
+	if jwtErr != nil {
+		return NewAuthErr(Status401, jwtErr)
+	}
+	m.verified.store(auth, claims)
+	return
+}
+
+// Authorize sets the specified context key to the JWTClaims verified by CheckHeader.
+func (m JWTManager) Authorize(auth *headerauth.AuthInfo) (val interface{}, err *headerauth.AuthErr) {
+	if claims, verified := m.verified.take(auth); verified {
+		return claims, nil
+	}
+	claims, jwtErr := m.Verify(auth.AccessKey, time.Now())
+	if jwtErr != nil {
+		return nil, NewAuthErr(Status401, jwtErr)
+	}
+	return claims, nil
+}
+
+// PreAbort responds with the status of the AuthErr, a 401 for the JWTs which are invalid, expired or not issued for goswift.
+func (m JWTManager) PreAbort(c *gin.Context, auth *headerauth.AuthInfo, err *headerauth.AuthErr) {
+	StatusForAuthErr(err).Respond(c, nil)
+}
+
+// TokenID returns the identifier of the JWT to record with the analytics events. The JWT itself is a credential,
+// so it is identified by its subject, which is only trustworthy if the JWT is valid. The subject is escaped
+// since the identifier is part of the persistence paths.
+func (m JWTManager) TokenID(auth *headerauth.AuthInfo) string {
+	if _, claims, _, _, err := splitJWT(auth.AccessKey); err == nil && claims.Subject != "" {
+		return "jwt:" + url.QueryEscape(claims.Subject)
+	}
+	return "jwt:unknown"
+}
+
+// NewJWTManager returns a new JWTManager auth manager, whose JWTs use the Bearer prefix.
+func NewJWTManager(settings JWTSettings, contextKey string) *JWTManager {
+	return &JWTManager{settings, NewJWKS(settings.JWKS, settings.Refresh), &verifiedAuths{},
+		headerauth.NewTokenManager("Authorization", "Bearer", contextKey)}
+}
+
+// HeaderAuthByPrefix authenticates the requests with the auth manager whose prefix is used in the header,
+// so that a route group accepts several kinds of tokens. The first manager handles the other requests.
+func HeaderAuthByPrefix(managers ...headerauth.Manager) gin.HandlerFunc {
+	handlers := make([]gin.HandlerFunc, len(managers))
+	for i, m := range managers {
+		handlers[i] = headerauth.HeaderAuth(m)
+	}
+	return func(c *gin.Context) {
+		for i, m := range managers {
+			if strings.HasPrefix(c.Request.Header.Get(m.HeaderKey()), m.HeaderPrefix()+" ") {
+				handlers[i](c)
+				return
+			}
+		}
+		handlers[0](c)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/ChristopherRabotin/gin-contrib-headerauth"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// signTestAsymJWT returns the JWT of the claims, signed with RS256 or ES256 depending on the private key.
+func signTestAsymJWT(kid string, key crypto.Signer, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	headerJSON, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	claimsJSON, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	switch priv := key.(type) {
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, priv, digest[:])
+		signature = make([]byte, 64)
+		rBytes, sBytes := r.Bytes(), s.Bytes()
+		copy(signature[32-len(rBytes):32], rBytes)
+		copy(signature[64-len(sBytes):], sBytes)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// TestJWTManager tests the JWT bearer tokens and their use on the analytics routes.
+func TestJWTManager(t *testing.T) {
+	Convey("The JWT manager tests, ", t, func() {
+		dir, _ := ioutil.TempDir("", "goswift-jwks-")
+		defer os.RemoveAll(dir)
+		rsaKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		rsaJWK := testJWK("rsa", &rsaKey.PublicKey)
+		rsaJWK.Alg = "RS256"
+		jwksFile := filepath.Join(dir, "jwks.json")
+		ioutil.WriteFile(jwksFile, testJWKSDocument(rsaJWK, testJWK("ec", &ecKey.PublicKey)), 0600)
+
+		values := testConfigValues()
+		values["JWT_JWKS"] = jwksFile
+		values["JWT_ISSUER"] = "https://id.sparrho.com"
+		values["JWT_AUDIENCE"] = "goswift"
+		cfg, err := ParseConfig(values)
+		So(err, ShouldBeNil)
+		validClaims := func() map[string]interface{} {
+			return map[string]interface{}{"sub": "alice", "iss": "https://id.sparrho.com", "aud": []string{"goswift", "other"},
+				"exp": time.Now().Add(time.Minute).Unix(), "nbf": time.Now().Add(-time.Minute).Unix()}
+		}
+
+		Convey("The issuer and the audience are required with a JWKS", func() {
+			delete(values, "JWT_ISSUER")
+			delete(values, "JWT_AUDIENCE")
+			_, err := ParseConfig(values)
+			So(err, ShouldNotBeNil)
+			So(len(err.(ConfigErrors)), ShouldEqual, 2)
+		})
+
+		Convey("RS256 and ES256 JWTs are verified", func() {
+			m := NewJWTManager(cfg.JWT, JWTClaimsKey)
+			claims, err := m.Verify(signTestAsymJWT("rsa", rsaKey, validClaims()), time.Now())
+			So(err, ShouldBeNil)
+			So(claims.Subject, ShouldEqual, "alice")
+			So(claims.Audience, ShouldResemble, JWTAudience{"goswift", "other"})
+			_, err = m.Verify(signTestAsymJWT("ec", ecKey, validClaims()), time.Now())
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Invalid JWTs are rejected", func() {
+			m := NewJWTManager(cfg.JWT, JWTClaimsKey)
+			otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			_, err := m.Verify(signTestAsymJWT("ec", otherKey, validClaims()), time.Now())
+			So(err, ShouldNotBeNil)
+			// The RSA key is restricted to RS256.
+			_, err = m.Verify(signTestAsymJWT("rsa", ecKey, validClaims()), time.Now())
+			So(err, ShouldNotBeNil)
+			_, err = m.Verify(signTestAsymJWT("unknown", rsaKey, validClaims()), time.Now())
+			So(err, ShouldNotBeNil)
+			_, err = m.Verify(signTestJWT(map[string]interface{}{"alg": "HS256", "kid": "rsa"}, validClaims(), "secret"), time.Now())
+			So(err, ShouldNotBeNil)
+
+			for claim, val := range map[string]interface{}{"iss": "https://evil.com", "aud": "other", "exp": nil,
+				"nbf": time.Now().Add(time.Minute * 5).Unix()} {
+				claims := validClaims()
+				claims[claim] = val
+				_, err = m.Verify(signTestAsymJWT("rsa", rsaKey, claims), time.Now())
+				So(err, ShouldNotBeNil)
+			}
+			_, err = m.Verify(signTestAsymJWT("rsa", rsaKey, validClaims()), time.Now().Add(time.Minute*2))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The JWT is only verified once per request", func() {
+			m := NewJWTManager(cfg.JWT, JWTClaimsKey)
+			auth := &headerauth.AuthInfo{AccessKey: signTestAsymJWT("rsa", rsaKey, validClaims())}
+			So(m.CheckHeader(auth, nil), ShouldBeNil)
+			// Authorize would fail if it verified the JWT again, since the JWKS is now unreadable.
+			m.jwks = NewJWKS(filepath.Join(dir, "missing.json"), time.Hour)
+			claims, authErr := m.Authorize(auth)
+			So(authErr, ShouldBeNil)
+			So(claims.(*JWTClaims).Subject, ShouldEqual, "alice")
+			_, stored := m.verified.take(auth)
+			So(stored, ShouldBeFalse)
+			_, authErr = m.Authorize(auth)
+			So(authErr, ShouldNotBeNil)
+		})
+
+		Convey("The clock skew is allowed within the leeway", func() {
+			m := NewJWTManager(cfg.JWT, JWTClaimsKey)
+			claims := validClaims()
+			claims["nbf"] = time.Now().Add(DefaultJWTLeeway / 2).Unix()
+			_, err := m.Verify(signTestAsymJWT("rsa", rsaKey, claims), time.Now())
+			So(err, ShouldBeNil)
+			_, err = m.Verify(signTestAsymJWT("rsa", rsaKey, validClaims()), time.Now().Add(time.Minute+DefaultJWTLeeway/2))
+			So(err, ShouldBeNil)
+		})
+
+		Convey("The analytics routes accept both the JWTs and the perishable tokens", func() {
+			redisServer := newFakeRedis()
+			defer redisServer.Close()
+			bucket := newMemoryBucket()
+			server, err := NewServer(cfg, Dependencies{Redis: redisServer.Client(), Bucket: bucket, Providers: newMemoryProviderStore()})
+			So(err, ShouldBeNil)
+			defer server.Close()
+			e := server.Engine
+			testS3Locations = []string{}
+
+			headers := bearerHeaders(signTestAsymJWT("ec", ecKey, validClaims()))
+			event := NewAnalyticsEvent()
+			So(performRequest(e, "PUT", "/analytics/record", headers, event.JSONIO()).Code, ShouldEqual, 202)
+			server.persisterWg.Wait()
+			So(len(testS3Locations), ShouldEqual, 1)
+			data, err := bucket.Get(testS3Locations[0])
+			So(err, ShouldBeNil)
+			So(checkPersistedEvents(data, []*AnalyticsJSON{event}, "jwt:alice"), ShouldBeNil)
+
+			expired := validClaims()
+			expired["exp"] = time.Now().Add(-time.Hour).Unix()
+			headers = bearerHeaders(signTestAsymJWT("ec", ecKey, expired))
+			So(performRequest(e, "PUT", "/analytics/record", headers, NewAnalyticsEvent().JSONIO()).Code, ShouldEqual, 401)
+
+			// The perishable tokens are still checked by their own manager.
+			headers = map[string][]string{"Authorization": {"DecayingToken InvalidToken"}}
+			req := performRequest(e, "PUT", "/analytics/record", headers, NewAnalyticsEvent().JSONIO())
+			So(req.Code, ShouldEqual, 401)
+			So(req.Body.String(), ShouldContainSubstring, "token_unknown")
+			server.persisterWg.Wait()
+		})
+	})
+}
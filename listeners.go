@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// DefaultSocketMode is the default permission of the Unix socket, which lets the group (e.g. nginx) connect.
+const DefaultSocketMode os.FileMode = 0660
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation (SD_LISTEN_FDS_START).
+var listenFDsStart = 3
+
+// systemdListener returns the listener passed by systemd socket activation, or nil if there is none.
+// As with sd_listen_fds, the LISTEN_* variables are unset so that child processes do not use the listener too.
+func systemdListener() (net.Listener, error) {
+	pidStr, fdsStr := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if pidStr == "" || fdsStr == "" {
+		return nil, nil
+	}
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if pid, err := strconv.Atoi(pidStr); err != nil || pid != os.Getpid() {
+		// These were meant for another process.
+		return nil, nil
+	}
+	numFDs, err := strconv.Atoi(fdsStr)
+	if err != nil || numFDs < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS `%s`", fdsStr)
+	}
+	if numFDs > 1 {
+		log.Notice("systemd passed %d sockets, only the first one is used.", numFDs)
+	}
+	return fileListener(listenFDsStart)
+}
+
+// fileListener returns the listener of an inherited file descriptor.
+func fileListener(fd int) (net.Listener, error) {
+	syscall.CloseOnExec(fd)
+	file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+	// FileListener duplicates the descriptor, so the file can be closed right away.
+	defer file.Close()
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not use the inherited socket %d: %s", fd, err)
+	}
+	return ln, nil
+}
+
+// listenUnix listens on the Unix socket at path, with the provided permissions. A socket left over by a
+// previous process is removed first, but any other kind of file is left alone.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// TestListeners tests the Unix socket and systemd listeners.
+func TestListeners(t *testing.T) {
+	Convey("The listener tests, ", t, func() {
+		dir, _ := ioutil.TempDir("", "goswift-sock-")
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "goswift.sock")
+
+		Convey("The Unix socket is created with its permissions", func() {
+			ln, err := ServerSettings{Socket: path, SocketMode: 0600}.Listen()
+			So(err, ShouldBeNil)
+			defer ln.Close()
+			info, _ := os.Stat(path)
+			So(info.Mode().Perm(), ShouldEqual, os.FileMode(0600))
+			conn, err := net.Dial("unix", path)
+			So(err, ShouldBeNil)
+			conn.Close()
+		})
+
+		Convey("A stale socket is replaced, but not a regular file", func() {
+			stale, _ := net.Listen("unix", path)
+			// Leaves the socket file behind, like a process which was killed.
+			stale.(*net.UnixListener).SetUnlinkOnClose(false)
+			stale.Close()
+			ln, err := listenUnix(path, DefaultSocketMode)
+			So(err, ShouldBeNil)
+			ln.Close()
+
+			regular := filepath.Join(dir, "regular")
+			ioutil.WriteFile(regular, []byte("data"), 0600)
+			_, err = listenUnix(regular, DefaultSocketMode)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The systemd listener is used when it is meant for this process", func() {
+			activated, _ := net.Listen("tcp", "127.0.0.1:0")
+			defer activated.Close()
+			file, _ := activated.(*net.TCPListener).File()
+			defer file.Close()
+			// The listener takes over and closes the inherited descriptor, so it gets its own.
+			fd, err := syscall.Dup(int(file.Fd()))
+			So(err, ShouldBeNil)
+			prevStart := listenFDsStart
+			listenFDsStart = fd
+			defer func() { listenFDsStart = prevStart }()
+
+			os.Setenv("LISTEN_PID", "1")
+			os.Setenv("LISTEN_FDS", "1")
+			ln, err := systemdListener()
+			So(ln, ShouldBeNil)
+			So(err, ShouldBeNil)
+			So(os.Getenv("LISTEN_FDS"), ShouldBeBlank)
+
+			os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+			os.Setenv("LISTEN_FDS", "1")
+			ln, err = ServerSettings{Addr: "127.0.0.1:0", Socket: path}.Listen()
+			So(err, ShouldBeNil)
+			defer ln.Close()
+			So(ln.Addr().String(), ShouldEqual, activated.Addr().String())
+		})
+	})
+}
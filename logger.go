@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/jmcvetta/randutil"
+	"github.com/op/go-logging"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RequestIDHeader is the header used to propagate the request ID.
+	RequestIDHeader = "X-Request-ID"
+	// RequestIDKey is the gin context key where the request ID is stored.
+	RequestIDKey = "requestID"
+	// maxRequestIDLen is the maximum length of a propagated request ID, longer ones are replaced.
+	maxRequestIDLen = 128
+	// tokenPrefixLen is the number of characters of the token which are logged.
+	tokenPrefixLen = 4
+)
+
+// LogFields is a set of structured fields. When passed as the only argument of a log call,
+// the JSON backend adds them at the top level of the line, while the text format prints them as key=value.
+type LogFields map[string]interface{}
+
+// String returns the fields as sorted key=value pairs.
+func (f LogFields) String() string {
+	keys := make([]string, 0, len(f))
+	for key := range f {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf("%s=%v", key, f[key])
+	}
+	return strings.Join(pairs, " ")
+}
+
+// JSONBackend is a go-logging backend which writes one JSON object per line.
+type JSONBackend struct {
+	sync.Mutex
+	out io.Writer
+}
+
+// NewJSONBackend returns a new JSON backend writing to the provided writer.
+func NewJSONBackend(out io.Writer) *JSONBackend {
+	return &JSONBackend{out: out}
+}
+
+// Log writes the record as a JSON line.
+func (b *JSONBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	line := map[string]interface{}{}
+	if len(rec.Args) == 1 {
+		if fields, ok := rec.Args[0].(LogFields); ok {
+			for key, val := range fields {
+				line[key] = val
+			}
+		}
+	}
+	// These are set after the fields so they cannot be overwritten.
+	line["time"] = rec.Time.UTC().Format("2006-01-02T15:04:05.000Z")
+	line["level"] = level.String()
+	line["module"] = rec.Module
+	line["message"] = rec.Message()
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	defer b.Unlock()
+	_, err = b.out.Write(append(data, '\n'))
+	return err
+}
+
+// RequestLogger assigns or propagates the X-Request-ID and logs one structured line per request.
+// As in the metrics, the route is the registered pattern, since the path may contain tokens or keys.
+func RequestLogger(routes *RouteTable) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		requestID := c.Request.Header.Get(RequestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLen || strings.ContainsAny(requestID, " \t\r\n\"") {
+			requestID = newRequestID()
+		}
+		c.Set(RequestIDKey, requestID)
+		c.Writer.Header().Set(RequestIDHeader, requestID)
+
+		c.Next()
+
+		log.Info("%s", LogFields{
+			"request_id":   requestID,
+			"method":       c.Request.Method,
+			"route":        routes.Match(c.Request.URL.Path),
+			"status":       c.Writer.Status(),
+			"latency_ms":   float64(time.Since(start)) / float64(time.Millisecond),
+			"client_ip":    c.ClientIP(),
+			"token_prefix": tokenPrefix(c),
+			"auth":         authOutcome(c),
+		})
+	}
+}
+
+// RequestID returns the request ID of this context, or an empty string if there is none.
+func RequestID(c *gin.Context) string {
+	if val, exists := c.Get(RequestIDKey); exists {
+		if requestID, ok := val.(string); ok {
+			return requestID
+		}
+	}
+	return ""
+}
+
+// newRequestID returns a new random request ID.
+func newRequestID() string {
+	requestID, err := randutil.AlphaStringRange(20, 20)
+	if err != nil {
+		// Very unlikely, but the time is still unique enough to correlate lines.
+		return fmt.Sprintf("t%d", time.Now().UnixNano())
+	}
+	return requestID
+}
+
+// tokenPrefix returns the first characters of the token used on this request, if any.
+// The full token is never logged because it is a credential.
+func tokenPrefix(c *gin.Context) string {
+	token := ""
+	if val, exists := c.Get("token"); exists {
+		token, _ = val.(string)
+	}
+	if token == "" {
+		// The auth failed before the token was set in the context, so let's take it from the header.
+		if fields := strings.Fields(c.Request.Header.Get("Authorization")); len(fields) == 2 {
+			token = fields[1]
+		}
+	}
+	if len(token) > tokenPrefixLen {
+		token = token[:tokenPrefixLen]
+	}
+	return token
+}
+
+// authOutcome returns "success", "failure" or "none" depending on how the auth went on this request.
+func authOutcome(c *gin.Context) string {
+	if val, exists := c.Get("authSuccess"); exists {
+		if success, ok := val.(bool); ok {
+			if success {
+				return "success"
+			}
+			return "failure"
+		}
+	}
+	if _, exists := c.Get("token"); exists {
+		return "success"
+	}
+	if c.Request.Header.Get("Authorization") != "" {
+		return "failure"
+	}
+	return "none"
+}
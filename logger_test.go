@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/op/go-logging"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"testing"
+)
+
+// TestLogger tests the JSON log backend and the structured fields.
+func TestLogger(t *testing.T) {
+	Convey("The logger tests, ", t, func() {
+		Convey("LogFields are printed as sorted key=value pairs", func() {
+			So(LogFields{"status": 200, "route": "/auth/token"}.String(), ShouldEqual, "route=/auth/token status=200")
+		})
+
+		Convey("The JSON backend writes the fields at the top level", func() {
+			var buf bytes.Buffer
+			logging.SetBackend(NewJSONBackend(&buf))
+			log.Info("%s", LogFields{"request_id": "abc", "message": "overwritten"})
+			ConfigureLogger(&Config{LogFormat: "text", LogLevel: logging.INFO})
+			var line map[string]interface{}
+			So(json.Unmarshal(buf.Bytes(), &line), ShouldBeNil)
+			So(line["request_id"], ShouldEqual, "abc")
+			So(line["module"], ShouldEqual, "goswift")
+			So(line["level"], ShouldEqual, "INFO")
+			So(line["message"], ShouldNotEqual, "overwritten")
+		})
+
+		Convey("The requests are logged with their route pattern and the token prefix only", func() {
+			var buf bytes.Buffer
+			logging.SetBackend(NewJSONBackend(&buf))
+			defer ConfigureLogger(&Config{LogFormat: "text", LogLevel: logging.INFO})
+			routes := &RouteTable{}
+			engine := gin.New()
+			engine.Use(RequestLogger(routes))
+			NewRouteGroup(engine, routes).DELETE("/admin/tokens/:token", func(c *gin.Context) {
+				c.String(http.StatusOK, "")
+			})
+			performRequest(engine, "DELETE", "/admin/tokens/secretToken", map[string][]string{"Authorization": {"Admin adminSecret"}}, nil)
+			So(buf.String(), ShouldNotContainSubstring, "secretToken")
+			So(buf.String(), ShouldNotContainSubstring, "adminSecret")
+			var line map[string]interface{}
+			So(json.Unmarshal(buf.Bytes(), &line), ShouldBeNil)
+			So(line["route"], ShouldEqual, "/admin/tokens/:token")
+			So(line["token_prefix"], ShouldEqual, "admi")
+		})
+
+		Convey("Generated request IDs are unique", func() {
+			So(newRequestID(), ShouldNotEqual, newRequestID())
+		})
+	})
+}
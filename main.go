@@ -2,13 +2,17 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"github.com/ChristopherRabotin/gin-contrib-headerauth"
 	"github.com/gin-gonic/gin"
 	"github.com/op/go-logging"
+	"gopkg.in/redis.v3"
+	"os"
 	"sync"
 )
 
-// testGoswift must be true when testing to avoid starting the server.
+// testGoswift must be true when testing to store the persisted items under the test folder.
 var testGoswift = false
 
 // testS3Locations will store the list of S3 locations to delete after running the tests.
@@ -17,57 +21,172 @@ var testS3Locations []string
 // log is the main go-logging logger.
 var log = logging.MustGetLogger("goswift")
 
-// persisterWg is the persister wait group, which will write to S3.
-var persisterWg sync.WaitGroup
+// main loads the configuration and starts all needed functions to start the server.
+func main() {
+	cfg, err := LoadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	ConfigureLogger(cfg)
+	ConfigureRuntime(cfg)
+	server, err := NewServer(cfg, Dependencies{})
+	if err != nil {
+		log.Fatalf("Could not start goswift: %s", err)
+	}
+	if err := server.Serve(); err != nil {
+		log.Fatalf("Server stopped: %s", err)
+	}
+	// Serve only returns once the server was shut down or upgraded, so let's finish persisting before exiting.
+	server.Close()
+	log.Notice("Drained, exiting.")
+}
 
-// init is ran before the main, so we'll perform the environment verifications there.
-func init() {
-	CheckEnvVars() // This will fail if there are env vars missing.
-	ConfigureLogger()
-	ConfigureRuntime()
+// Dependencies are the external services of the server. NewServer creates the missing ones from the configuration,
+// so the tests can provide fakes instead.
+type Dependencies struct {
+	Redis     *redis.Client
+	Bucket    Bucket
+	Providers ProviderKeyStore
 }
 
-// main starts all needed functions to start the server.
-func main() {
-	PourGin()
-	persisterWg.Wait()
+// Server stores the dependencies of goswift and the gin engine which uses them.
+type Server struct {
+	cfg          *Config
+	Engine       *gin.Engine
+	Redis        *redis.Client
+	Bucket       Bucket
+	Providers    ProviderKeyStore
+	Quotas       *ProviderQuotas     // Quotas of the content providers, set on their ContentProviderMgr.
+	ProviderAuth *ContentProviderMgr // Auth manager of the signed content provider requests, on the /content routes.
+	persistChan  chan *S3Persist
+	persisterWg  sync.WaitGroup // Counts the persistences sent on persistChan which are not done yet.
+	done         chan struct{}  // Closed by Close, to stop the background goroutines.
 }
 
-// PourGin starts pouring the gin, i.e. sets up routes and starts listening.
-// This returns an engine specifically for testing purposes.
-func PourGin() *gin.Engine {
-	gin.SetMode(ServerMode())
-	engine := gin.Default()
-	engine.GET("/", IndexGet)
-	// S3 persister variables
-	persistChan := make(chan *S3Persist, 250)
-	go S3PersistingHandler(persistChan, &persisterWg)
+// NewServer creates the missing dependencies from the configuration, starts the persister and sets up the routes.
+// Nothing listens until Serve is called, so this is also how the tests get the engine.
+func NewServer(cfg *Config, deps Dependencies) (*Server, error) {
+	if deps.Redis == nil {
+		redisClient, err := NewRedisClient(cfg.RedisURL)
+		if err != nil {
+			return nil, err
+		}
+		deps.Redis = redisClient
+	}
+	if deps.Bucket == nil {
+		deps.Bucket = NewS3Bucket(cfg)
+	}
+	if deps.Providers == nil {
+		deps.Providers = NewSQLProviderStore(cfg.DatabaseURL)
+	}
+	s := &Server{cfg: cfg, Redis: deps.Redis, Bucket: deps.Bucket, Providers: deps.Providers,
+		persistChan: make(chan *S3Persist, 250), done: make(chan struct{})}
+	s.Quotas = NewProviderQuotas(cfg.Quotas, s.Redis)
+	s.ProviderAuth = NewContentProviderMgr(s.Providers, cfg.Signing, s.Quotas, ProviderContextKey)
+	go S3PersistingHandler(s.persistChan, s.Bucket, cfg.PersistEncoding, &s.persisterWg)
+	go watchInvalidations(s.Redis, s.done)
+	s.Engine = s.pourGin()
+	return s, nil
+}
+
+// Close stops the invalidation watcher and, once the pending persistences are done, the persister.
+// It must only be called once the server no longer handles requests. The dependencies are left open,
+// since they may have been provided.
+func (s *Server) Close() {
+	close(s.done)
+	s.persisterWg.Wait()
+	close(s.persistChan)
+}
+
+// Serve listens with the server settings until the server is shut down or upgraded.
+func (s *Server) Serve() error {
+	// The server is built here rather than by engine.Run, so that its timeouts and limits are configurable.
+	return Serve(s.Engine, s.cfg.Server, s.cfg.TLS)
+}
+
+// pourGin pours the gin, i.e. sets up the routes with the dependencies of the server.
+func (s *Server) pourGin() *gin.Engine {
+	cfg := s.cfg
+	gin.SetMode(cfg.ServerMode)
+	// gin's own logger is replaced by RequestLogger, whose format depends on LOG_FORMAT.
+	// The routes are registered through a RouteGroup, which records their patterns for the logs and the metrics labels.
+	routes := &RouteTable{}
+	engine := gin.New()
+	engine.Use(gin.Recovery(), RequestLogger(routes))
+
+	// Metrics are registered first so that the middleware measures all the routes.
+	RegisterMetrics(s.persistChan)
+	engine.Use(MetricsMiddleware(routes))
+	// CORS runs before all the groups so that preflights are answered before the auth managers.
+	engine.Use(CORS(cfg.CORS))
+	root := NewRouteGroup(engine, routes)
+	root.GET("/", IndexGet)
+	root.GET("/healthz", GetHealthz)
+	root.GET("/readyz", NewReadinessHandler(s.persistChan, s.Bucket, s.Redis, cfg.DatabaseURL))
 
 	// Auth managers
-	perishableHA := NewPerishableTokenMgr("DecayingToken", "token")
-	analyticsHA := NewAnalyticsTokenMgr("DecayingToken", "token", persistChan, &persisterWg)
+	perishableHA := NewPerishableTokenMgr("DecayingToken", "token", s.Redis)
+	analyticsHA := NewAnalyticsTokenMgr("DecayingToken", "token", s.Redis, s.persistChan, &s.persisterWg)
+	analyticsBatchHA := NewAnalyticsBatchTokenMgr("DecayingToken", "token", s.Redis, s.persistChan, &s.persisterWg)
+	// With a JWKS, the analytics routes also accept the JWTs of the identity service, with the Bearer prefix.
+	analyticsAuth := headerauth.HeaderAuth(analyticsHA)
+	analyticsBatchAuth := headerauth.HeaderAuth(analyticsBatchHA)
+	if cfg.JWT.Enabled() {
+		jwtHA := NewJWTManager(cfg.JWT, JWTClaimsKey)
+		analyticsAuth = HeaderAuthByPrefix(analyticsHA, NewAnalyticsJWTMgr(jwtHA, false, s.persistChan, &s.persisterWg))
+		analyticsBatchAuth = HeaderAuthByPrefix(analyticsBatchHA, NewAnalyticsJWTMgr(jwtHA, true, s.persistChan, &s.persisterWg))
+	}
 
 	// Auth group.
-	authG := engine.Group("/auth")
-	authG.GET("/token", GetNewToken)
+	authG := root.Group("/auth")
+	authG.GET("/token", NewTokenHandler(s.Redis))
 	// Auth testing group for tokens. Works on *all* methods.
 	authTokenTest := authG.Group("/token/test")
-	authTokenTest.Use(headerauth.HeaderAuth(perishableHA))
+	authTokenTest.Use(LimitBody(cfg.BodyLimit("auth")), headerauth.HeaderAuth(perishableHA))
 	methods := []string{"GET", "POST", "PUT", "DELETE", "PATCH"}
 	for _, meth := range methods {
 		authTokenTest.Handle(meth, "/", []gin.HandlerFunc{SuccessJSON}[0])
 	}
 
 	// Analytics group.
-	analyticsG := engine.Group("/analytics")
-	analyticsG.Use(headerauth.HeaderAuth(analyticsHA))
-	analyticsG.PUT("/record", RecordAnalytics)
-	if testGoswift {
-		testS3Locations = make([]string, 0) // Allows append to assign directly to zeroth element.
-	} else {
-		// Starting the server.
-		engine.Run(ServerConfig())
-		return nil
+	// Bodies are limited, decompressed and captured before the auth managers read them. The events are parsed in
+	// memory anyway, so their bodies are never spooled.
+	analyticsLimit := cfg.BodyLimit("analytics")
+	recordAnalytics := NewRecordAnalyticsHandler(s.persistChan, &s.persisterWg)
+	analyticsG := root.Group("/analytics")
+	analyticsG.Use(LimitBody(analyticsLimit), DecompressBody(analyticsLimit), CaptureBody(0), analyticsAuth)
+	analyticsG.PUT("/record", recordAnalytics)
+	// Beacons carry their token in the query string or the form, which BeaconAuth moves to the header.
+	analyticsBeaconG := root.Group("/analytics")
+	analyticsBeaconG.Use(LimitBody(analyticsLimit), DecompressBody(analyticsLimit), CaptureBody(0), BeaconAuth(analyticsHA), analyticsAuth)
+	analyticsBeaconG.POST("/beacon", recordAnalytics)
+	// Batches have their own group because their auth manager persists the rejected events differently.
+	batchLimit := cfg.BodyLimit("batch")
+	analyticsBatchG := root.Group("/analytics")
+	analyticsBatchG.Use(LimitBody(batchLimit), DecompressBody(batchLimit), CaptureBody(0), analyticsBatchAuth)
+	analyticsBatchG.PUT("/batch", NewRecordAnalyticsBatchHandler(s.persistChan, &s.persisterWg))
+
+	// Content group, where the providers send their signed payloads. Those are not decompressed, since the signature
+	// is that of the body as sent, and they are persisted as indexed items. The large ones are spooled to disk, and
+	// streamed from there to S3.
+	contentG := root.Group("/content")
+	contentG.Use(LimitBody(cfg.BodyLimit("provider")), CaptureBody(DefaultSpoolThreshold), headerauth.HeaderAuth(s.ProviderAuth))
+	contentG.PUT("/items", NewRecordContentHandler(s.persistChan, &s.persisterWg))
+
+	// Admin group, which is only enabled with admin credentials. Each route requires a role.
+	if cfg.Admin.Enabled() {
+		keysAdmin := NewProviderKeysAdmin(s.Providers, s.Redis, cfg.SecretOverlap)
+		adminG := root.Group("/admin")
+		adminG.Use(LimitBody(cfg.BodyLimit("auth")), headerauth.HeaderAuth(NewAdminAuthMgr(cfg.Admin, AdminContextKey)))
+		adminG.GET("/metrics", RequireRole(RoleReadMetrics), GetMetrics)
+		adminG.DELETE("/tokens/:token", RequireRole(RoleRevokeTokens), NewRevokeTokenHandler(s.Redis))
+		adminG.GET("/providers/:id/keys", RequireRole(RoleManageProviders), keysAdmin.ListKeys)
+		adminG.POST("/providers/:id/keys", RequireRole(RoleManageProviders), keysAdmin.CreateKey)
+		adminG.POST("/keys/:access_key/disable", RequireRole(RoleManageProviders), keysAdmin.DisableKey)
+		adminG.POST("/keys/:access_key/rotate", RequireRole(RoleManageProviders), keysAdmin.RotateKey)
 	}
 	return engine
 }
@@ -9,24 +9,38 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"net/url"
+	"strings"
 	"testing"
 	"time"
 )
 
+// testServer is the server built from the environment for the tests.
+var testServer *Server
+
 // TestSwift tests all of GoSwift features.
 func TestSwift(t *testing.T) {
 	testGoswift = true
-	// Setting some environment variables.
+	// The server uses in-memory fakes of Redis and of the storage bucket, so the tests need no network.
+	values := testConfigValues()
 	testSettings := map[string]string{"MAX_CPUS": "1", "AWS_STORAGE_BUCKET_NAME": "sparrho-content",
-		"SERVER_MODE": "debug", "LOG_LEVEL": "DEBUG"}
-	for env, val := range testSettings {
-		err := os.Setenv(env, val)
-		if err != nil {
-			panic(fmt.Errorf("could not set %s to %s", env, val))
-		}
-		log.Debug("Set envvar %s to %s.", env, val)
+		"SERVER_MODE": "debug", "LOG_LEVEL": "DEBUG", "CORS_ALLOWED_ORIGINS": "https://www.sparrho.com"}
+	for key, val := range testSettings {
+		values[key] = val
+	}
+	cfg, err := ParseConfig(values)
+	if err != nil {
+		panic(err)
 	}
+	ConfigureLogger(cfg)
+	ConfigureRuntime(cfg)
+	redisServer := newFakeRedis()
+	defer redisServer.Close()
+	if testServer, err = NewServer(cfg, Dependencies{Redis: redisServer.Client(), Bucket: newMemoryBucket(),
+		Providers: newMemoryProviderStore()}); err != nil {
+		panic(err)
+	}
+	defer testServer.Close()
 
 	methods := []string{"GET", "POST", "PUT", "DELETE", "PATCH"}
 
@@ -45,18 +59,51 @@ func TestSwift(t *testing.T) {
 		}
 
 		type ErrorResponse struct {
-			Error string
+			Error     string
+			Code      string
+			RequestID string `json:"request_id"`
 		}
 
-		ConfigureLogger()
-		ConfigureRuntime()
-		e := PourGin()
+		e := testServer.Engine
+		testS3Locations = make([]string, 0) // Allows append to assign directly to zeroth element.
 
 		Convey("GET root redirects", func() {
 			req := performRequest(e, "GET", "/", nil, nil)
 			So(req.Code, ShouldEqual, 303)
 		})
 
+		Convey("The metrics are not public", func() {
+			req := performRequest(e, "GET", "/metrics", nil, nil)
+			So(req.Code, ShouldEqual, 404)
+		})
+
+		Convey("GET healthz is always OK", func() {
+			req := performRequest(e, "GET", "/healthz", nil, nil)
+			So(req.Code, ShouldEqual, 200)
+		})
+
+		Convey("OPTIONS preflights on analytics are answered before auth", func() {
+			headers := map[string][]string{"Origin": {"https://www.sparrho.com"},
+				"Access-Control-Request-Method": {"PUT"}, "Access-Control-Request-Headers": {"Authorization"}}
+			req := performRequest(e, "OPTIONS", "/analytics/record", headers, nil)
+			So(req.Code, ShouldEqual, 204)
+			So(req.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "https://www.sparrho.com")
+			So(req.Header().Get("Access-Control-Allow-Headers"), ShouldContainSubstring, "Authorization")
+
+			headers["Origin"] = []string{"https://evil.example.com"}
+			req = performRequest(e, "OPTIONS", "/analytics/record", headers, nil)
+			So(req.Code, ShouldEqual, 403)
+			So(req.Header().Get("Access-Control-Allow-Origin"), ShouldEqual, "")
+		})
+
+		Convey("GET readyz fails while draining", func() {
+			BeginDrain()
+			req := performRequest(e, "GET", "/readyz", nil, nil)
+			draining = 0
+			So(req.Code, ShouldEqual, 503)
+			So(req.Body.String(), ShouldContainSubstring, "draining")
+		})
+
 		Convey("Perishable Tokens can be generated and stored on this instance", func() {
 			req := performRequest(e, "GET", "/auth/token", nil, nil)
 			So(req.Code, ShouldEqual, 200)
@@ -93,6 +140,8 @@ func TestSwift(t *testing.T) {
 
 				So(req.Code, ShouldEqual, 401)
 				So(resp.Error, ShouldEqual, "unauthorized")
+				So(resp.Code, ShouldEqual, "token_exhausted")
+				So(resp.RequestID, ShouldEqual, req.Header().Get("X-Request-ID"))
 
 			})
 		})
@@ -143,7 +192,7 @@ func TestSwift(t *testing.T) {
 
 			Convey("And the token could have timed out on Redis", func() {
 				// Let's update this token on Redis to an invalid number of hits.
-				redisClient().Set(PerishableRedisKey(tok.Token), NonceLimit+1, 0)
+				testServer.Redis.Set(PerishableRedisKey(tok.Token), NonceLimit+1, 0)
 
 				headers := make(map[string][]string)
 				headers["Authorization"] = []string{"DecayingToken " + tok.Token}
@@ -159,7 +208,7 @@ func TestSwift(t *testing.T) {
 
 			Convey("And the token could have reached max hits on Redis", func() {
 				// Let's update this token on Redis to an invalid number of hits.
-				redisClient().Set(PerishableRedisKey(tok.Token), NonceLimit+1, time.Minute*5)
+				testServer.Redis.Set(PerishableRedisKey(tok.Token), NonceLimit+1, time.Minute*5)
 
 				headers := make(map[string][]string)
 				headers["Authorization"] = []string{"DecayingToken " + tok.Token}
@@ -178,7 +227,7 @@ func TestSwift(t *testing.T) {
 			headers := make(map[string][]string)
 			invalidToken := "someinvalidtoken"
 			// Let's make sure we remove this from redis.
-			RedisCnx.Del(PerishableRedisKey(invalidToken))
+			testServer.Redis.Del(PerishableRedisKey(invalidToken))
 			headers["Authorization"] = []string{"DecayingToken " + invalidToken}
 			for _, meth := range methods {
 				req := performRequest(e, meth, "/auth/token/test/", headers, nil)
@@ -187,14 +236,14 @@ func TestSwift(t *testing.T) {
 
 				So(req.Code, ShouldEqual, 401)
 				So(resp.Error, ShouldEqual, "unauthorized")
+				So(resp.Code, ShouldEqual, "token_unknown")
 
 			}
 		})
 
 		Convey("Analytics endpoint works as expected", func() {
 
-			// Grab the bucket from the environment for tests.
-			bucket := S3BucketFromOS()
+			bucket := testServer.Bucket
 
 			//Let's first grab a token.
 			req := performRequest(e, "GET", "/auth/token", nil, nil)
@@ -212,7 +261,7 @@ func TestSwift(t *testing.T) {
 				headers := make(map[string][]string)
 				headers["Authorization"] = []string{"DecayingToken " + tok.Token}
 				for _, meth := range methods {
-					req := performRequest(e, meth, "/analytics/record", headers, nil)
+					req := performRequest(e, meth, "/analytics/record", headers, NewAnalyticsEvent().JSONIO())
 					tok.NumUsed++ // Incrementing the number of times this one was used to confirm it will expire later.
 					var resp SuccessResponse
 					json.Unmarshal(req.Body.Bytes(), &resp)
@@ -239,30 +288,143 @@ func TestSwift(t *testing.T) {
 					So(performRequest(e, meth, "/analytics/record", headers, NewAnalyticsEvent().JSONIO()).Code, ShouldEqual, 404)
 				}
 				// Let's check that a PUT with an invalid token still persists the data.
-				expectedData := ""
+				events := make([]*AnalyticsJSON, 0)
 				for i := 0; i < 10; i++ {
 					event := NewAnalyticsEvent()
 					req := performRequest(e, "PUT", "/analytics/record", headers, event.JSONIO())
-					expectedData += string(event.JSON()) + "\n"
+					events = append(events, event)
 					So(req.Code, ShouldEqual, 401)
 				}
 
 				var resp ErrorResponse
 				json.Unmarshal(req.Body.Bytes(), &resp)
-				persisterWg.Wait()
+				testServer.persisterWg.Wait()
 				// Let's check that the S3 location is the same for all the events we just sent.
 				for i := 1; i < len(testS3Locations); i++ {
 					So(testS3Locations[0], ShouldEqual, testS3Locations[i])
 				}
 				// Let's check that there's is the appropriate value on S3.
 				if data, err := bucket.Get(testS3Locations[0]); err == nil {
-					So(string(data), ShouldEqual, expectedData)
+					So(checkPersistedEvents(data, events, "InvalidToken"), ShouldBeNil)
 				} else {
 					panic(err)
 				}
 
 			})
 
+			Convey("By failing with the field errors if the event is invalid", func() {
+				headers := make(map[string][]string)
+				headers["Authorization"] = []string{"DecayingToken " + tok.Token}
+				event := NewAnalyticsEvent()
+				event.EventType = ""
+				event.Timestamp = "yesterday"
+				req := performRequest(e, "PUT", "/analytics/record", headers, event.JSONIO())
+				So(req.Code, ShouldEqual, 400)
+				var resp struct {
+					Error  string
+					Fields map[string]string
+				}
+				json.Unmarshal(req.Body.Bytes(), &resp)
+				So(resp.Error, ShouldEqual, "client error")
+				So(resp.Fields["event_type"], ShouldNotBeBlank)
+				So(resp.Fields["timestamp"], ShouldNotBeBlank)
+				So(resp.Fields["session_id"], ShouldBeBlank)
+				// The handler rejected the event, so nothing was persisted.
+				testServer.persisterWg.Wait()
+				So(len(testS3Locations), ShouldEqual, 0)
+			})
+
+			Convey("PUT batches are persisted with a single token use", func() {
+
+				// Let's always delete the test S3 locations at the end of tests.
+				defer rmTestS3Files()
+
+				headers := make(map[string][]string)
+				headers["Authorization"] = []string{"DecayingToken " + tok.Token}
+				invalid := NewAnalyticsEvent()
+				invalid.SessionID = ""
+				events := []*AnalyticsJSON{NewAnalyticsEvent(), NewAnalyticsEvent()}
+				body := string(events[0].JSON()) + "\n" + string(invalid.JSON()) + "\n" + string(events[1].JSON()) + "\n"
+				req := performRequest(e, "PUT", "/analytics/batch", headers, strings.NewReader(body))
+				So(req.Code, ShouldEqual, 202)
+				var resp struct {
+					Accepted int
+					Rejected int
+					Results  []BatchResult
+				}
+				json.Unmarshal(req.Body.Bytes(), &resp)
+				So(resp.Accepted, ShouldEqual, 2)
+				So(resp.Rejected, ShouldEqual, 1)
+				So(resp.Results[1].Status, ShouldEqual, "rejected")
+
+				testServer.persisterWg.Wait()
+				So(len(testS3Locations), ShouldEqual, 1)
+				if data, err := bucket.Get(testS3Locations[0]); err == nil {
+					So(checkPersistedEvents(data, events, tok.Token), ShouldBeNil)
+				} else {
+					panic(err)
+				}
+				// Only one use of the token was spent.
+				cached, _ := perishableCache.Get(tok.Token)
+				So(cached.(*PerishableInfo).Hits, ShouldEqual, 1)
+			})
+
+			Convey("zstd events and batches are decompressed before being persisted", func() {
+
+				// Let's always delete the test S3 locations at the end of tests.
+				defer rmTestS3Files()
+
+				headers := map[string][]string{"Authorization": {"DecayingToken " + tok.Token}, "Content-Encoding": {"zstd"}}
+				events := []*AnalyticsJSON{NewAnalyticsEvent(), NewAnalyticsEvent(), NewAnalyticsEvent()}
+				data := zstdCompress(events[0].JSON())
+				So(performRequest(e, "PUT", "/analytics/record", headers, bytes.NewReader(data)).Code, ShouldEqual, 202)
+				data = zstdCompress([]byte(string(events[1].JSON()) + "\n" + string(events[2].JSON()) + "\n"))
+				req := performRequest(e, "PUT", "/analytics/batch", headers, bytes.NewReader(data))
+				So(req.Code, ShouldEqual, 202)
+				So(req.Body.String(), ShouldContainSubstring, `"accepted":2`)
+
+				testServer.persisterWg.Wait()
+				// The events may be appended to the same object, whose location is then recorded twice.
+				var persisted []byte
+				seen := make(map[string]bool)
+				for _, location := range testS3Locations {
+					if seen[location] {
+						continue
+					}
+					seen[location] = true
+					data, err := bucket.Get(location)
+					So(err, ShouldBeNil)
+					persisted = append(persisted, data...)
+				}
+				So(checkPersistedEvents(persisted, events, tok.Token), ShouldBeNil)
+			})
+
+			Convey("POST beacons are persisted with the token of the query string or the form", func() {
+
+				// Let's always delete the test S3 locations at the end of tests.
+				defer rmTestS3Files()
+
+				events := []*AnalyticsJSON{NewAnalyticsEvent(), NewAnalyticsEvent()}
+				headers := map[string][]string{"Content-Type": {"text/plain;charset=UTF-8"}}
+				req := performRequest(e, "POST", "/analytics/beacon?token="+tok.Token, headers, events[0].JSONIO())
+				So(req.Code, ShouldEqual, 202)
+				form := url.Values{BeaconTokenParam: {tok.Token}, BeaconEventField: {string(events[1].JSON())}}
+				headers = map[string][]string{"Content-Type": {"application/x-www-form-urlencoded"}}
+				req = performRequest(e, "POST", "/analytics/beacon", headers, strings.NewReader(form.Encode()))
+				So(req.Code, ShouldEqual, 202)
+
+				testServer.persisterWg.Wait()
+				for i := 1; i < len(testS3Locations); i++ {
+					So(testS3Locations[0], ShouldEqual, testS3Locations[i])
+				}
+				if data, err := bucket.Get(testS3Locations[0]); err == nil {
+					So(checkPersistedEvents(data, events, tok.Token), ShouldBeNil)
+				} else {
+					panic(err)
+				}
+				So(performRequest(e, "POST", "/analytics/beacon?token=InvalidToken", nil, events[0].JSONIO()).Code, ShouldEqual, 401)
+			})
+
 			Convey("PUT requests persist the data on S3", func() {
 				Convey("If the token is valid", func() {
 
@@ -273,24 +435,24 @@ func TestSwift(t *testing.T) {
 					headers["Authorization"] = []string{"DecayingToken " + tok.Token}
 
 					// Let's check that a PUT with an invalid token still persists the data.
-					expectedData := ""
+					events := make([]*AnalyticsJSON, 0)
 					for i := 0; i < 10; i++ {
 						event := NewAnalyticsEvent()
 						req := performRequest(e, "PUT", "/analytics/record", headers, event.JSONIO())
-						expectedData += string(event.JSON()) + "\n"
+						events = append(events, event)
 						So(req.Code, ShouldEqual, 202)
 					}
 
 					var resp SuccessResponse
 					json.Unmarshal(req.Body.Bytes(), &resp)
-					persisterWg.Wait()
+					testServer.persisterWg.Wait()
 					// Let's check that the S3 location is the same for all the events we just sent.
 					for i := 1; i < len(testS3Locations); i++ {
 						So(testS3Locations[0], ShouldEqual, testS3Locations[i])
 					}
 					// Let's check that there's is the appropriate value on S3.
 					if data, err := bucket.Get(testS3Locations[0]); err == nil {
-						So(string(data), ShouldEqual, expectedData)
+						So(checkPersistedEvents(data, events, tok.Token), ShouldBeNil)
 					} else {
 						panic(err)
 					}
@@ -313,12 +475,10 @@ func performRequest(r http.Handler, method string, path string, headers map[stri
 
 // AnalyticsJSON stores an analytics event as JSON.
 type AnalyticsJSON struct {
-	UserAgent  string `json:"user_agent"`
-	Referer    string `json:"referer"`
-	KissMetric string `json:"km_ai"`
-	Session    string `json:"session_id"`
-	URL        string `json:"url_path"`
-	IP         string `json:"client_ip"`
+	EventType  string            `json:"event_type"`
+	Timestamp  string            `json:"timestamp"`
+	SessionID  string            `json:"session_id"`
+	Properties map[string]string `json:"properties"`
 }
 
 func (e AnalyticsJSON) JSON() []byte {
@@ -335,12 +495,35 @@ func (e AnalyticsJSON) JSONIO() io.Reader {
 
 func NewAnalyticsEvent() *AnalyticsJSON {
 	randToken, _ := randutil.AlphaStringRange(10, 10)
-	return &AnalyticsJSON{IP: "127.0.0.1", KissMetric: randToken[0:7], Session: "session_" + randToken[5:10],
-		UserAgent: "Mozilla/5.0 (X11; Linux x86_64; rv:39.0) Gecko/20100101 Firefox/39.0", URL: "http://sparrho.com/awesome/link"}
+	return &AnalyticsJSON{EventType: "page_view", Timestamp: time.Now().Format(time.RFC3339), SessionID: "session_" + randToken[5:10],
+		Properties: map[string]string{"km_ai": randToken[0:7], "url_path": "http://sparrho.com/awesome/link",
+			"user_agent": "Mozilla/5.0 (X11; Linux x86_64; rv:39.0) Gecko/20100101 Firefox/39.0"}}
+}
+
+// checkPersistedEvents returns an error if the persisted lines do not match the events sent, in order.
+func checkPersistedEvents(data []byte, events []*AnalyticsJSON, token string) error {
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != len(events) {
+		return fmt.Errorf("expected %d lines, got %d", len(events), len(lines))
+	}
+	for i, line := range lines {
+		var persisted PersistedEvent
+		if err := json.Unmarshal([]byte(line), &persisted); err != nil {
+			return fmt.Errorf("line %d is not JSON: %s", i, err)
+		}
+		if persisted.SessionID != events[i].SessionID || persisted.EventType != events[i].EventType ||
+			persisted.Properties["km_ai"] != events[i].Properties["km_ai"] {
+			return fmt.Errorf("line %d does not match the event: %s", i, line)
+		}
+		if persisted.Token != token || persisted.ServerTimestamp == "" {
+			return fmt.Errorf("line %d is not enriched: %s", i, line)
+		}
+	}
+	return nil
 }
 
 func rmTestS3Files() {
-	bucket := S3BucketFromOS()
+	bucket := testServer.Bucket
 	for i := range testS3Locations {
 		go func(path string) {
 			bucket.Del(path)
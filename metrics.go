@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricsContentType is the content type of the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// defaultLatencyBuckets are the upper bounds (in seconds) of the latency histograms.
+var defaultLatencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// collector is anything which can write itself in the Prometheus text format.
+type collector interface {
+	metricName() string
+	writeTo(w io.Writer)
+}
+
+// MetricsRegistry stores all the collectors exposed on /admin/metrics.
+type MetricsRegistry struct {
+	sync.Mutex
+	collectors map[string]collector
+}
+
+// Register adds (or replaces) a collector, which allows NewServer to be called several times.
+func (r *MetricsRegistry) Register(c collector) {
+	r.Lock()
+	defer r.Unlock()
+	if r.collectors == nil {
+		r.collectors = make(map[string]collector)
+	}
+	r.collectors[c.metricName()] = c
+}
+
+// Write writes all the registered collectors sorted by name.
+func (r *MetricsRegistry) Write(w io.Writer) {
+	r.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]collector, len(names))
+	for i, name := range names {
+		collectors[i] = r.collectors[name]
+	}
+	r.Unlock()
+	for _, c := range collectors {
+		c.writeTo(w)
+	}
+}
+
+// metricsRegistry is the registry served on /admin/metrics.
+var metricsRegistry = &MetricsRegistry{}
+
+// CounterVec is a counter partitioned by label values.
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounterVec returns a new counter with the provided label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Inc increments the counter for the provided label values (in the order of the label names).
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds the provided value to the counter for the provided label values.
+func (c *CounterVec) Add(val float64, labelValues ...string) {
+	key := formatLabels(c.labels, labelValues, "", "")
+	c.mu.Lock()
+	c.values[key] += val
+	c.mu.Unlock()
+}
+
+// Value returns the current value of the counter for the provided label values.
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	key := formatLabels(c.labels, labelValues, "", "")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+func (c *CounterVec) metricName() string {
+	return c.name
+}
+
+func (c *CounterVec) writeTo(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+// GaugeFunc is a gauge whose value is computed when scraped.
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+// NewGaugeFunc returns a new gauge which calls value at every scrape.
+func NewGaugeFunc(name, help string, value func() float64) *GaugeFunc {
+	return &GaugeFunc{name, help, value}
+}
+
+func (g *GaugeFunc) metricName() string {
+	return g.name
+}
+
+func (g *GaugeFunc) writeTo(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatFloat(g.value()))
+}
+
+// histogramData stores the observations of a single label combination.
+type histogramData struct {
+	counts []uint64 // Cumulative counts are only computed on write.
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec is a histogram partitioned by label values.
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramData
+}
+
+// NewHistogramVec returns a new histogram with the default latency buckets.
+func NewHistogramVec(name, help string, labels ...string) *HistogramVec {
+	return &HistogramVec{name: name, help: help, labels: labels, buckets: defaultLatencyBuckets, values: make(map[string]*histogramData)}
+}
+
+// Observe adds an observation for the provided label values.
+func (h *HistogramVec) Observe(val float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	data, exists := h.values[key]
+	if !exists {
+		data = &histogramData{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = data
+	}
+	for i, upper := range h.buckets {
+		if val <= upper {
+			data.counts[i]++
+			break
+		}
+	}
+	data.count++
+	data.sum += val
+}
+
+// Since observes the number of seconds elapsed since start.
+func (h *HistogramVec) Since(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) metricName() string {
+	return h.name
+}
+
+func (h *HistogramVec) writeTo(w io.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var labelValues []string
+		if len(h.labels) > 0 {
+			labelValues = strings.Split(key, "\xff")
+		}
+		data := h.values[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += data.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, "le", formatFloat(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, labelValues, "le", "+Inf"), data.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, labelValues, "", ""), formatFloat(data.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, labelValues, "", ""), data.count)
+	}
+}
+
+// writeHeader writes the HELP and TYPE lines of a metric.
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelEscaper escapes the label values as the Prometheus text format requires, which only escapes
+// the backslashes, the double quotes and the line feeds.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels returns the label set as {name="value",...}, or an empty string if there are no labels.
+// If extraName is set, that label is appended, which is used for the histogram "le" label.
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) != len(values) {
+		panic(fmt.Errorf("expected %d label values, got %d", len(names), len(values)))
+	}
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	var buf bytes.Buffer
+	buf.WriteString("{")
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, "%s=\"%s\"", name, labelEscaper.Replace(values[i]))
+	}
+	if extraName != "" {
+		if len(names) > 0 {
+			buf.WriteString(",")
+		}
+		fmt.Fprintf(&buf, "%s=\"%s\"", extraName, labelEscaper.Replace(extraValue))
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+// formatFloat formats a float as expected by Prometheus.
+func formatFloat(val float64) string {
+	return strconv.FormatFloat(val, 'g', -1, 64)
+}
+
+// sortedKeys returns the keys of a counter map sorted alphabetically.
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// HTTP metrics, populated by MetricsMiddleware.
+var (
+	httpRequests = NewCounterVec("goswift_http_requests_total", "Number of HTTP requests by route, method and status.", "route", "method", "status")
+	httpLatency  = NewHistogramVec("goswift_http_request_duration_seconds", "HTTP request latency by route, method and status.", "route", "method", "status")
+)
+
+// Perishable token metrics, populated by GetNewToken and PerishableToken.
+var (
+	tokensIssued     = NewCounterVec("goswift_tokens_issued_total", "Number of perishable tokens issued.")
+	tokenValidations = NewCounterVec("goswift_token_validations_total", "Number of perishable token validations by result.", "result")
+	tokenLookups     = NewCounterVec("goswift_token_lookups_total", "Number of perishable token lookups by source (cache or redis).", "source")
+	tokenRejections  = NewCounterVec("goswift_token_rejections_total", "Number of 401 responses on perishable tokens by reason.", "reason")
+)
+
+// S3 persistence metrics, populated by S3PersistingHandler.
+var (
+	s3PutLatency  = NewHistogramVec("goswift_s3_put_duration_seconds", "Latency of S3 PUT requests.")
+	s3PutRetries  = NewCounterVec("goswift_s3_put_retries_total", "Number of S3 PUT requests which were retried.")
+	s3PutFailures = NewCounterVec("goswift_s3_put_failures_total", "Number of failed S3 PUT requests.")
+)
+
+// Content provider metrics, populated by ContentProviderMgr and ProviderQuotas.
+var (
+	providerSecretUses = NewCounterVec("goswift_provider_secret_uses_total", "Number of content provider requests by secret used (current or previous).", "secret")
+	quotaRejections    = NewCounterVec("goswift_quota_rejections_total", "Number of 429 responses on over quota providers by provider ID.", "provider")
+)
+
+// RegisterMetrics registers all the goswift metrics, including the depth of the provided persist channel.
+func RegisterMetrics(persistChan chan *S3Persist) {
+	for _, c := range []collector{httpRequests, httpLatency, tokensIssued, tokenValidations, tokenLookups,
+		tokenRejections, s3PutLatency, s3PutRetries, s3PutFailures, quotaRejections,
+		providerSecretUses} {
+		metricsRegistry.Register(c)
+	}
+	metricsRegistry.Register(NewGaugeFunc("goswift_persist_queue_depth", "Number of items waiting in the persist channel.",
+		func() float64 { return float64(len(persistChan)) }))
+	metricsRegistry.Register(NewGaugeFunc("goswift_persist_queue_capacity", "Capacity of the persist channel.",
+		func() float64 { return float64(cap(persistChan)) }))
+}
+
+// MetricsMiddleware records the count and latency of each request, labeled with the pattern of its route
+// in the table. The paths themselves would leak tokens and keys, and create one series per random path.
+func MetricsMiddleware(routes *RouteTable) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		status := c.Writer.Status()
+		route := routes.Match(c.Request.URL.Path)
+		statusStr := strconv.Itoa(status)
+		httpRequests.Inc(route, c.Request.Method, statusStr)
+		httpLatency.Since(start, route, c.Request.Method, statusStr)
+	}
+}
+
+// GetMetrics returns all the registered metrics in the Prometheus text format.
+func GetMetrics(c *gin.Context) {
+	var buf bytes.Buffer
+	metricsRegistry.Write(&buf)
+	c.Data(http.StatusOK, metricsContentType, buf.Bytes())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	. "github.com/smartystreets/goconvey/convey"
+	"strings"
+	"testing"
+)
+
+// TestMetrics tests the Prometheus text format of the metrics.
+func TestMetrics(t *testing.T) {
+	Convey("The metrics tests, ", t, func() {
+		registry := &MetricsRegistry{}
+
+		Convey("A counter with labels is formatted with its labels", func() {
+			counter := NewCounterVec("test_total", "A test counter.", "reason")
+			counter.Inc("expired")
+			counter.Add(2, "expired")
+			registry.Register(counter)
+			var buf bytes.Buffer
+			registry.Write(&buf)
+			So(buf.String(), ShouldEqual, "# HELP test_total A test counter.\n# TYPE test_total counter\ntest_total{reason=\"expired\"} 3\n")
+			So(counter.Value("expired"), ShouldEqual, 3)
+		})
+
+		Convey("The label values are escaped as in the Prometheus text format", func() {
+			counter := NewCounterVec("test_total", "A test counter.", "reason")
+			counter.Inc("a\\b\"c\nd\té")
+			registry.Register(counter)
+			var buf bytes.Buffer
+			registry.Write(&buf)
+			So(buf.String(), ShouldContainSubstring, "test_total{reason=\"a\\\\b\\\"c\\nd\té\"} 1\n")
+		})
+
+		Convey("A counter with the wrong number of label values panics", func() {
+			counter := NewCounterVec("test_total", "A test counter.", "reason")
+			So(func() { counter.Inc() }, ShouldPanic)
+		})
+
+		Convey("A histogram has cumulative buckets", func() {
+			histogram := NewHistogramVec("test_seconds", "A test histogram.", "route")
+			histogram.Observe(0.003, "/a")
+			histogram.Observe(0.2, "/a")
+			registry.Register(histogram)
+			var buf bytes.Buffer
+			registry.Write(&buf)
+			out := buf.String()
+			So(out, ShouldContainSubstring, "test_seconds_bucket{route=\"/a\",le=\"0.001\"} 0\n")
+			So(out, ShouldContainSubstring, "test_seconds_bucket{route=\"/a\",le=\"0.005\"} 1\n")
+			So(out, ShouldContainSubstring, "test_seconds_bucket{route=\"/a\",le=\"0.25\"} 2\n")
+			So(out, ShouldContainSubstring, "test_seconds_bucket{route=\"/a\",le=\"+Inf\"} 2\n")
+			So(out, ShouldContainSubstring, "test_seconds_count{route=\"/a\"} 2\n")
+		})
+
+		Convey("The routes are matched to their patterns", func() {
+			routes := &RouteTable{}
+			for _, pattern := range []string{"/", "/auth/token", "/auth/token/test/", "/admin/tokens/:token", "/admin/keys/:access_key/rotate",
+				"/admin/keys/static/rotate"} {
+				routes.Add(pattern)
+			}
+			So(routes.Match("/"), ShouldEqual, "/")
+			So(routes.Match("/auth/token/test"), ShouldEqual, "/auth/token/test")
+			So(routes.Match("/admin/tokens/abc"), ShouldEqual, "/admin/tokens/:token")
+			So(routes.Match("/admin/keys/AKIA/rotate"), ShouldEqual, "/admin/keys/:access_key/rotate")
+			So(routes.Match("/admin/keys/static/rotate"), ShouldEqual, "/admin/keys/static/rotate")
+			So(routes.Match("/admin/tokens/"), ShouldEqual, UnmatchedRoute)
+			So(routes.Match("/admin/tokens/abc/more"), ShouldEqual, UnmatchedRoute)
+		})
+
+		Convey("The requests are labeled with their route rather than their path", func() {
+			redisServer := newFakeRedis()
+			defer redisServer.Close()
+			values := testConfigValues()
+			values["ADMIN_KEYS"] = "ops:" + sha256Hex(strings.Repeat("a", MinAdminKeyLength)) + ":revoke-tokens"
+			cfg, err := ParseConfig(values)
+			So(err, ShouldBeNil)
+			server, err := NewServer(cfg, Dependencies{Redis: redisServer.Client(), Bucket: newMemoryBucket(), Providers: newMemoryProviderStore()})
+			So(err, ShouldBeNil)
+			defer server.Close()
+			before := httpRequests.Value("/admin/tokens/:token", "DELETE", "401")
+			So(performRequest(server.Engine, "DELETE", "/admin/tokens/abc", nil, nil).Code, ShouldEqual, 401)
+			So(httpRequests.Value("/admin/tokens/:token", "DELETE", "401"), ShouldEqual, before+1)
+			So(httpRequests.Value("/admin/tokens/abc", "DELETE", "401"), ShouldEqual, 0)
+			before = httpRequests.Value(UnmatchedRoute, "GET", "404")
+			performRequest(server.Engine, "GET", "/random/path", nil, nil)
+			So(httpRequests.Value(UnmatchedRoute, "GET", "404"), ShouldEqual, before+1)
+		})
+
+		Convey("A gauge function is called at every scrape", func() {
+			depth := 0
+			registry.Register(NewGaugeFunc("test_depth", "A test gauge.", func() float64 { return float64(depth) }))
+			depth = 4
+			var buf bytes.Buffer
+			registry.Write(&buf)
+			So(strings.HasSuffix(buf.String(), "test_depth 4\n"), ShouldEqual, true)
+		})
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/pmylund/go-cache"
 	"gopkg.in/redis.v3"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -25,66 +26,74 @@ type PerishableToken struct {
 	*headerauth.TokenManager
 }
 
-// RedisCnx stores an instance of the redis client.
-var RedisCnx = redisClient()
-
 // CheckHeader returns the secret key from the provided access key.
 func (m PerishableToken) CheckHeader(auth *headerauth.AuthInfo, req *http.Request) (err *headerauth.AuthErr) {
 	auth.Secret = ""     // There is no secret key, just an access key.
 	auth.DataToSign = "" // There is no data to sign.
 	// Let's check if we have that token in cache, if not we'll check on Redis.
 	if cachedItf, exists := perishableCache.Get(auth.AccessKey); exists {
+		tokenLookups.Inc("cache")
 		cached := cachedItf.(*PerishableInfo)
 		if cached.isValid() {
 			cached.Hits++
 			go func() {
 				incrToken(PerishableRedisKey(auth.AccessKey), m.redisClient)
 			}()
+			tokenValidations.Inc("valid")
 		} else {
-			err = &headerauth.AuthErr{401, fmt.Errorf("token expired in cache: [%s]", auth.AccessKey)}
+			err = rejectToken("cache_expired", cached.rejection(), fmt.Errorf("token expired in cache: [%s]", auth.AccessKey))
 		}
 		return
 	}
+	tokenLookups.Inc("redis")
 	exists, attempts := getTokenHits(PerishableRedisKey(auth.AccessKey), m.redisClient)
 	if !exists {
 		// The key does not exist on Redis, let's return an error.
-		err = &headerauth.AuthErr{401, fmt.Errorf("token not on Redis: [%s]", auth.AccessKey)}
+		err = rejectToken("not_on_redis", StatusTokenUnknown, fmt.Errorf("token not on Redis: [%s]", auth.AccessKey))
 		return
 	}
 	// Let's add this token to the cache.
 	exists, ttl := getTokenTTL(PerishableRedisKey(auth.AccessKey), m.redisClient)
 	if !exists {
 		// The key has expired between when we checked its existence and when we got its TTL.
-		err = &headerauth.AuthErr{401, fmt.Errorf("token expired on Redis: [%s]", auth.AccessKey)}
+		err = rejectToken("redis_expired", StatusTokenExpired, fmt.Errorf("token expired on Redis: [%s]", auth.AccessKey))
 		return
 	}
 	// Let's store this perishable token in the cache. Because we're using it now, let's increment it locally now.
 	perishable := &PerishableInfo{attempts + 1, ttl}
 	if !perishable.isValid() {
-		err = &headerauth.AuthErr{401, fmt.Errorf("token expired on load from Redis: [%s]", auth.AccessKey)}
+		err = rejectToken("redis_load_expired", perishable.rejection(), fmt.Errorf("token expired on load from Redis: [%s]", auth.AccessKey))
 		return
 	}
 	perishableCache.Set(auth.AccessKey, perishable, NonceTTL)
+	tokenValidations.Inc("valid")
 	go func() {
 		incrToken(PerishableRedisKey(auth.AccessKey), m.redisClient)
 	}()
 	return
 }
 
+// rejectToken records the rejection reason in the metrics and returns the AuthErr of the catalogue entry.
+func rejectToken(reason string, entry *StatusErr, err error) *headerauth.AuthErr {
+	tokenValidations.Inc("invalid")
+	tokenRejections.Inc(reason)
+	return NewAuthErr(entry, err)
+}
+
 // Authorize sets the specified context key to the valid token (no additonals checks here, as per documentation recommendations).
 func (m PerishableToken) Authorize(auth *headerauth.AuthInfo) (val interface{}, err *headerauth.AuthErr) {
 	return auth.AccessKey, nil
 }
 
-// PreAbort sets the appropriate error JSON.
+// PreAbort logs the request of the rejected token, and responds with the code of the token error, e.g. token_exhausted.
 func (m PerishableToken) PreAbort(c *gin.Context, auth *headerauth.AuthInfo, err *headerauth.AuthErr) {
 	log.Critical(c.Request.RequestURI)
-	c.JSON(err.Status, StatusMsg[err.Status].JSON())
+	StatusForAuthErr(err).Respond(c, nil)
 }
 
-// NewPerishableTokenMgr returns a new PerishableToken auth manager.
-func NewPerishableTokenMgr(prefix string, contextKey string) *PerishableToken {
-	return &PerishableToken{RedisCnx, headerauth.NewTokenManager("Authorization", prefix, contextKey)}
+// NewPerishableTokenMgr returns a new PerishableToken auth manager, whose tokens are stored on the Redis client.
+func NewPerishableTokenMgr(prefix string, contextKey string, client *redis.Client) *PerishableToken {
+	return &PerishableToken{client, headerauth.NewTokenManager("Authorization", prefix, contextKey)}
 }
 
 // PerishableInfo stores perisable token information.
@@ -98,6 +107,14 @@ func (p PerishableInfo) isValid() bool {
 	return p.Hits < NonceLimit && p.Expires.After(time.Now())
 }
 
+// rejection returns why this token is not valid: either it was used too many times, or it expired.
+func (p PerishableInfo) rejection() *StatusErr {
+	if p.Hits >= NonceLimit {
+		return StatusTokenExhausted
+	}
+	return StatusTokenExpired
+}
+
 var perishableCache = cache.New(NonceTTL, time.Millisecond*50)
 
 // PerishableRedisKey returns the formatted Redis key for the provided perishable token.
@@ -105,8 +122,15 @@ func PerishableRedisKey(token string) string {
 	return fmt.Sprintf("goswift:perishabletoken:%s", token)
 }
 
+// NewTokenHandler returns the handler of GET /auth/token, which stores the new tokens on the Redis client.
+func NewTokenHandler(client *redis.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		GetNewToken(c, client)
+	}
+}
+
 // GetNewToken returns a JSON object which contains a new NONCE with its expiration time and the number of allowed usages.
-func GetNewToken(c *gin.Context) {
+func GetNewToken(c *gin.Context, client *redis.Client) {
 	failed := true
 	// Allow up to ten attempts to generate an access key.
 	for iter := 0; iter < 10; iter++ {
@@ -116,13 +140,14 @@ func GetNewToken(c *gin.Context) {
 				// and just ask for a new one.
 				continue
 			}
-			if ok, _ := getTokenHits(PerishableRedisKey(token), RedisCnx); !ok {
+			if ok, _ := getTokenHits(PerishableRedisKey(token), client); !ok {
 				// We calculate the expire time prior to actually setting it so the client
 				// can switch to another Nonce before it actually expires.
 				expires := time.Now().Add(NonceTTL)
 				perishableCache.Set(token, &PerishableInfo{0, expires}, NonceTTL)
-				setToken(PerishableRedisKey(token), NonceTTL, RedisCnx)
-				c.JSON(200, gin.H{"token": token, "expires": expires.Format(time.RFC3339), "limit": NonceLimit})
+				setToken(PerishableRedisKey(token), NonceTTL, client)
+				tokensIssued.Inc()
+				Render(c, 200, gin.H{"token": token, "expires": expires.Format(time.RFC3339), "limit": NonceLimit})
 				failed = false
 				break
 			}
@@ -131,33 +156,111 @@ func GetNewToken(c *gin.Context) {
 
 	if failed {
 		// Could not generate a valid token.
-		c.JSON(503, Status503.JSON())
+		Status503.Respond(c, nil)
+	}
+}
+
+// revokeCachedToken removes the revoked token from the local cache.
+func revokeCachedToken(token string) {
+	perishableCache.Delete(token)
+}
+
+// NewRevokeTokenHandler returns the handler which revokes a perishable token, on Redis and on all the instances.
+func NewRevokeTokenHandler(client *redis.Client) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Params.ByName("token")
+		deleted, err := client.Del(PerishableRedisKey(token)).Result()
+		if err != nil {
+			log.Error("could not revoke the token %s: %s", token, err)
+			Status503.Respond(c, nil)
+			return
+		}
+		if _, cached := perishableCache.Get(token); deleted == 0 && !cached {
+			Status404.Respond(c, gin.H{"detail": "This token does not exist."})
+			return
+		}
+		if err := PublishInvalidation(client, TokenRevocationChannel, token); err != nil {
+			log.Error("could not publish the revocation of %s: %s", token, err)
+		}
+		log.Notice("%s revoked the token %s.", adminName(c), token)
+		Render(c, 200, gin.H{"token": token, "revoked": true})
 	}
 }
 
+// AnalyticsToken wraps a token auth manager, a PerishableToken or a JWTManager, to also persist the analytics events
+// of the rejected requests on S3; the handlers persist the others. If batch is set, the request body is a batch
+// of events, which only counts as one token use.
 type AnalyticsToken struct {
 	persistC chan<- *S3Persist
 	wg       *sync.WaitGroup
-	*PerishableToken
+	batch    bool
+	headerauth.Manager
+}
+
+// tokenIdentifier is implemented by the auth managers whose tokens must not be recorded as is.
+type tokenIdentifier interface {
+	TokenID(auth *headerauth.AuthInfo) string
+}
+
+// tokenID returns the identifier of the token which is recorded with the events, and set in the "token" context key.
+func (m AnalyticsToken) tokenID(auth *headerauth.AuthInfo) string {
+	if identifier, ok := m.Manager.(tokenIdentifier); ok {
+		return identifier.TokenID(auth)
+	}
+	return auth.AccessKey
 }
 
-// PreAbort sets the appropriate error JSON after starting the persistence.
+// PreAbort sets the appropriate error JSON after starting the persistence of valid events.
 func (m AnalyticsToken) PreAbort(c *gin.Context, auth *headerauth.AuthInfo, err *headerauth.AuthErr) {
-	m.wg.Add(1)
-	c.Set(m.ContextKey(), auth.AccessKey)
+	c.Set("token", m.tokenID(auth))
 	c.Set("authSuccess", false)
-	m.persistC <- NewS3Persist("analytics", false, c)
-	c.JSON(err.Status, StatusMsg[err.Status].JSON())
+	// The auth error takes precedence over the request errors, so invalid events are just not persisted.
+	if m.batch {
+		if events, _, _ := readAnalyticsBatch(c); len(events) > 0 {
+			persistAnalytics(c, m.persistC, m.wg, events)
+		}
+	} else if event, _ := readAnalyticsEvent(c); event != nil {
+		persistAnalytics(c, m.persistC, m.wg, []*AnalyticsEvent{event})
+	}
+	StatusForAuthErr(err).Respond(c, nil)
 }
 
-// PostAuth starte the persistence.
+// PostAuth sets the token which the events are recorded with.
 func (m AnalyticsToken) PostAuth(c *gin.Context, auth *headerauth.AuthInfo, err *headerauth.AuthErr) {
-	m.wg.Add(1)
+	c.Set("token", m.tokenID(auth))
 	c.Set("authSuccess", true)
-	m.persistC <- NewS3Persist("analytics", false, c)
+}
+
+// persistAnalytics sends the normalized events to the persister, as a single persistence of one line per event.
+// They are recorded with the token identifier set in the "token" context key.
+func persistAnalytics(c *gin.Context, persistC chan<- *S3Persist, wg *sync.WaitGroup, events []*AnalyticsEvent) *RequestErr {
+	tokenItf, _ := c.Get("token")
+	token, _ := tokenItf.(string)
+	lines := make([]string, len(events))
+	for i, event := range events {
+		lines[i] = event.Serialize(c.ClientIP(), token)
+	}
+	c.Set(SerializedKey, strings.Join(lines, "\n"))
+	persist, reqErr := NewS3Persist("analytics", false, c)
+	if reqErr != nil {
+		return reqErr
+	}
+	wg.Add(1)
+	persistC <- persist
+	return nil
 }
 
 // NewAnalyticsTokenMgr returns a new AnalyticsToken auth manager, which is PerishableToken with S3 persistence.
-func NewAnalyticsTokenMgr(prefix string, contextKey string, persistChan chan<- *S3Persist, wg *sync.WaitGroup) *AnalyticsToken {
-	return &AnalyticsToken{persistChan, wg, NewPerishableTokenMgr(prefix, contextKey)}
+func NewAnalyticsTokenMgr(prefix string, contextKey string, client *redis.Client, persistChan chan<- *S3Persist, wg *sync.WaitGroup) *AnalyticsToken {
+	return &AnalyticsToken{persistChan, wg, false, NewPerishableTokenMgr(prefix, contextKey, client)}
+}
+
+// NewAnalyticsBatchTokenMgr returns a new AnalyticsToken auth manager for batches of events.
+func NewAnalyticsBatchTokenMgr(prefix string, contextKey string, client *redis.Client, persistChan chan<- *S3Persist, wg *sync.WaitGroup) *AnalyticsToken {
+	return &AnalyticsToken{persistChan, wg, true, NewPerishableTokenMgr(prefix, contextKey, client)}
+}
+
+// NewAnalyticsJWTMgr returns a new AnalyticsToken auth manager of the JWTs, for single events or for batches.
+func NewAnalyticsJWTMgr(jwtMgr *JWTManager, batch bool, persistChan chan<- *S3Persist, wg *sync.WaitGroup) *AnalyticsToken {
+	return &AnalyticsToken{persistChan, wg, batch, jwtMgr}
 }
@@ -8,7 +8,7 @@ import (
 	"github.com/jmcvetta/randutil"
 	"github.com/mitchellh/goamz/aws"
 	"github.com/mitchellh/goamz/s3"
-	"io/ioutil"
+	"io"
 	"os"
 	"sync"
 	"time"
@@ -30,15 +30,20 @@ type S3Index struct {
 // S3Persist stores information to be persist on S3.
 type S3Persist struct {
 	s3path      string
+	RequestID   string
 	cBody       string
+	spool       *os.File // Spooled body of indexed persistences, which is streamed to S3 instead of kept in memory.
+	spoolSize   int64
 	ContentPath string
 	Checksum    string
 	Serialized  string
 	Index       *S3Index
 }
 
-func NewS3Persist(s3path string, indexed bool, c *gin.Context) *S3Persist {
-	p := S3Persist{s3path: s3path}
+// NewS3Persist returns a new persistence from the request in the context, or a RequestErr if the body could not be read.
+// The indexed bodies which CaptureBody spooled to disk are streamed to S3 rather than loaded in memory.
+func NewS3Persist(s3path string, indexed bool, c *gin.Context) (*S3Persist, *RequestErr) {
+	p := S3Persist{s3path: s3path, RequestID: RequestID(c)}
 
 	// Extracting some values from the context.
 	authSuccessIft, _ := c.Get("authSuccess")
@@ -57,22 +62,35 @@ func NewS3Persist(s3path string, indexed bool, c *gin.Context) *S3Persist {
 		accessKey = val
 	}
 
-	// Let's set the body.
-	if c.Request.Body != nil {
-		body, err := ioutil.ReadAll(c.Request.Body)
+	// Let's set the body, and compute the checksum of this persistence while reading it.
+	body, err := capturedBody(c)
+	if err != nil {
+		return nil, bodyReadErr(err)
+	}
+	hash := sha512.New384()
+	if body != nil && indexed && body.Spooled() {
+		// The spooled payload is streamed to S3 from its file, which the persistence takes over.
+		if _, err := io.Copy(hash, body.NewReader()); err != nil {
+			return nil, bodyReadErr(err)
+		}
+		p.spool, p.spoolSize = body.handOff()
+	} else if body != nil {
+		data, err := body.Bytes()
 		if err != nil {
-			panic("could not read body")
+			return nil, bodyReadErr(err)
 		}
-		p.cBody = string(body)
+		hash.Write(data)
+		p.cBody = string(data)
 	}
+	p.Checksum = hex.EncodeToString(hash.Sum(nil))
 
-	// Serializing the data to persist.
+	// Serializing the data to persist: handlers may store a normalized version in the context.
 	p.Serialized = p.cBody
-
-	// Let's compute the checksum of this persistence.
-	hash := sha512.New384()
-	hash.Write([]byte(p.cBody))
-	p.Checksum = hex.EncodeToString(hash.Sum(nil))
+	if serializedItf, exists := c.Get(SerializedKey); exists {
+		if val, ok := serializedItf.(string); ok {
+			p.Serialized = val
+		}
+	}
 
 	// Let's set the persistence location.
 	cLoc := rootPath + storePath
@@ -102,7 +120,7 @@ func NewS3Persist(s3path string, indexed bool, c *gin.Context) *S3Persist {
 		iLoc += indexFolder + "/" + p.s3path + "/" + successFolder + "/" + accessKey + "_" + p.Checksum
 
 		p.Index = &S3Index{Location: iLoc, Header: fmt.Sprintf("%s\n", p.ContentPath),
-			Body: fmt.Sprintf("%s\t%s\t%s\n", accessKey, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), c.ClientIP())}
+			Body: fmt.Sprintf("%s\t%s\t%s\t%s\n", accessKey, time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), c.ClientIP(), p.RequestID)}
 
 		if testGoswift {
 			testS3Locations = append(testS3Locations, p.Index.Location)
@@ -113,23 +131,71 @@ func NewS3Persist(s3path string, indexed bool, c *gin.Context) *S3Persist {
 		testS3Locations = append(testS3Locations, p.ContentPath)
 	}
 
-	return &p
+	return &p, nil
 }
 
-// S3BucketFromOS returns the bucket from the environment variables (cf. README.md).
-func S3BucketFromOS() *s3.Bucket {
-	// Prepare AWS S3 connection.
-	s3auth, err := aws.EnvAuth()
+// release removes the spooled body, if any, once the persistence is done.
+func (p *S3Persist) release() {
+	if p.spool != nil {
+		p.spool.Close()
+		os.Remove(p.spool.Name())
+		p.spool = nil
+	}
+}
+
+// Bucket is the storage the persister writes to. It is implemented by *s3.Bucket, and by an in-memory bucket in the tests.
+type Bucket interface {
+	Get(path string) ([]byte, error)
+	PutHeader(path string, data []byte, customHeaders map[string][]string, perm s3.ACL) error
+	PutReaderHeader(path string, r io.Reader, length int64, customHeaders map[string][]string, perm s3.ACL) error
+	Del(path string) error
+	List(prefix, delim, marker string, max int) (*s3.ListResp, error)
+}
+
+// NewS3Bucket returns the storage bucket of the configuration.
+func NewS3Bucket(cfg *Config) *s3.Bucket {
+	client := s3.New(aws.Auth{AccessKey: cfg.AWSAccessKeyID, SecretKey: cfg.AWSSecretAccessKey}, aws.USEast)
+	return client.Bucket(cfg.StorageBucket)
+}
+
+// putObject PUTs the data on the bucket and records the latency and failures of that request.
+// If an encoding is provided, the data is compressed and stored with the matching Content-Encoding.
+func putObject(bucket Bucket, path string, data []byte, encoding string) error {
+	data, err := encodeObject(data, encoding)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	headers := map[string][]string{"Content-Type": {"text/plain"}}
+	if encoding != "" {
+		headers["Content-Encoding"] = []string{encoding}
 	}
-	client := s3.New(s3auth, aws.USEast)
-	return client.Bucket(os.Getenv("AWS_STORAGE_BUCKET_NAME"))
+	start := time.Now()
+	err = bucket.PutHeader(path, data, headers, s3.Private)
+	s3PutLatency.Since(start)
+	if err != nil {
+		s3PutFailures.Inc()
+	}
+	return err
+}
+
+// putSpooled streams the spooled body of the persistence to its content path. Spooled bodies are stored as is.
+func putSpooled(bucket Bucket, persist *S3Persist) error {
+	if _, err := persist.spool.Seek(0, 0); err != nil {
+		return err
+	}
+	headers := map[string][]string{"Content-Type": {"text/plain"}}
+	start := time.Now()
+	err := bucket.PutReaderHeader(persist.ContentPath, persist.spool, persist.spoolSize, headers, s3.Private)
+	s3PutLatency.Since(start)
+	if err != nil {
+		s3PutFailures.Inc()
+	}
+	return err
 }
 
 // S3PersistingHandler stores information from the contextChan onto S3.
-func S3PersistingHandler(persistChan chan *S3Persist, wg *sync.WaitGroup) {
-	bucket := S3BucketFromOS()
+// The encoding is the Content-Encoding of the stored objects, either "gzip" or none.
+func S3PersistingHandler(persistChan chan *S3Persist, bucket Bucket, encoding string, wg *sync.WaitGroup) {
 	for {
 		persist, open := <-persistChan
 		if !open {
@@ -141,9 +207,10 @@ func S3PersistingHandler(persistChan chan *S3Persist, wg *sync.WaitGroup) {
 			indexData, notFoundErr := bucket.Get(persist.Index.Location) // notFoundErr => if there is an err Get failed, so the file does not exist.
 			if notFoundErr == nil {
 				// Append index content to the existing index.
-				s3Err := bucket.Put(persist.Index.Location, []byte(string(indexData)+persist.Index.Body), "text/plain", s3.Private)
+				s3Err := putObject(bucket, persist.Index.Location, []byte(string(indexData)+persist.Index.Body), "")
 				if s3Err != nil {
 					// If somethting goes wrong, let's re-add this fetch to items to be processed.
+					s3PutRetries.Inc()
 					persistChan <- persist
 					log.Error("could not update index: %s", s3Err)
 					continue
@@ -153,9 +220,15 @@ func S3PersistingHandler(persistChan chan *S3Persist, wg *sync.WaitGroup) {
 
 			} else {
 				// Store the content on S3 and create an index.
-				s3Err := bucket.Put(persist.ContentPath, []byte(persist.Serialized), "text/plain", s3.Private)
+				var s3Err error
+				if persist.spool != nil {
+					s3Err = putSpooled(bucket, persist)
+				} else {
+					s3Err = putObject(bucket, persist.ContentPath, []byte(persist.Serialized), encoding)
+				}
 				if s3Err != nil {
 					// If somethting goes wrong, let's re-add this fetch to items to be processed.
+					s3PutRetries.Inc()
 					persistChan <- persist
 					log.Error("could not PUT new content: %s", s3Err)
 					continue
@@ -163,13 +236,14 @@ func S3PersistingHandler(persistChan chan *S3Persist, wg *sync.WaitGroup) {
 
 				// Add canonical index information.
 				for i := 0; i < 10; i++ {
-					s3Err := bucket.Put(persist.Index.Location, []byte(persist.Index.Header+persist.Index.Body), "text/plain", s3.Private)
+					s3Err := putObject(bucket, persist.Index.Location, []byte(persist.Index.Header+persist.Index.Body), "")
 					if s3Err == nil {
 						break
 					} else if i == 9 {
 						// Panic: we have attempted to add the index information ten times.
 						panic(fmt.Sprintf("Could not add index: %+v", persist.Index))
 					}
+					s3PutRetries.Inc()
 				}
 			}
 		} else {
@@ -177,19 +251,27 @@ func S3PersistingHandler(persistChan chan *S3Persist, wg *sync.WaitGroup) {
 			oldData, notFoundErr := bucket.Get(persist.ContentPath)
 			data := persist.Serialized + "\n"
 			if notFoundErr == nil {
-				// Append data to the existing data.
-				data = string(oldData) + data
+				// Append data to the existing data, which may have been stored compressed.
+				if plainData, decodeErr := decodeObject(oldData); decodeErr == nil {
+					data = string(plainData) + data
+				} else {
+					// Let's not lose the existing data, even if it can't be decoded.
+					log.Error("could not decode %s, appending to the raw data: %s", persist.ContentPath, decodeErr)
+					data = string(oldData) + data
+				}
 			}
 
-			s3Err := bucket.Put(persist.ContentPath, []byte(data), "text/plain", s3.Private)
+			s3Err := putObject(bucket, persist.ContentPath, []byte(data), encoding)
 			if s3Err != nil {
 				// If somethting goes wrong, let's re-add this persistor to items to be persisted.
+				s3PutRetries.Inc()
 				persistChan <- persist
-				log.Error("could not PUT new content on %s: %s", bucket.Name, s3Err)
+				log.Error("could not PUT new content on %s: %s", persist.ContentPath, s3Err)
 				continue
 			}
 		}
 
+		persist.release()
 		wg.Done()
 	}
 }
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/jmcvetta/randutil"
+	"time"
+)
+
+const (
+	// AccessKeyLength is the length of the generated access keys.
+	AccessKeyLength = 20
+	// SecretKeyLength is the length of the generated secret keys.
+	SecretKeyLength = 40
+	// DefaultSecretOverlap is how long the previous secret of a rotated key stays valid by default.
+	DefaultSecretOverlap = time.Hour * 24 * 7
+)
+
+var (
+	// ErrKeyNotFound is returned when the access key does not exist, or is disabled.
+	ErrKeyNotFound = errors.New("access key not found")
+	// ErrProviderNotFound is returned when the content provider does not exist.
+	ErrProviderNotFound = errors.New("content provider not found")
+)
+
+// ProviderKey is an access and secret key pair of a content provider. The secret is only set when it was just generated.
+// PreviousExpires is set while the secret it replaced is still valid.
+type ProviderKey struct {
+	ID              int        `json:"id"`
+	ProviderID      int        `json:"provider_id"`
+	AccessKey       string     `json:"access_key"`
+	SecretKey       string     `json:"secret_key,omitempty"`
+	Disabled        bool       `json:"disabled"`
+	PreviousExpires *time.Time `json:"previous_secret_expires,omitempty"`
+}
+
+// ProviderKeyStore stores the content provider keys. It is implemented on the Django tables by SQLProviderStore.
+type ProviderKeyStore interface {
+	// Lookup returns the provider information of the access key, or ErrKeyNotFound if it does not exist or is disabled.
+	Lookup(accessKey string) (*ContentProviderInfo, error)
+	// ListKeys returns all the keys of the provider, without their secrets.
+	ListKeys(providerID int) ([]*ProviderKey, error)
+	// CreateKey stores the new key and sets its ID, or returns ErrProviderNotFound.
+	CreateKey(key *ProviderKey) error
+	// DisableKey disables the access key, or returns ErrKeyNotFound.
+	DisableKey(accessKey string) error
+	// RotateKey replaces the secret of the enabled access key, or returns ErrKeyNotFound.
+	// The replaced secret stays valid until previousExpires.
+	RotateKey(accessKey string, secretKey string, previousExpires time.Time) error
+}
+
+// SQLProviderStore is the ProviderKeyStore of the apiv2_authkey and apiv2_contentprovider_authkeys tables.
+// The previous secret of the rotated keys is stored in goswift_authkey_previous_secrets, and the quotas of specific
+// providers in goswift_provider_quotas. Those tables are created by the migrations of the sql folder.
+type SQLProviderStore struct {
+	db *sql.DB
+}
+
+// NewSQLProviderStore returns the store of the database, which is only connected to when first used.
+func NewSQLProviderStore(databaseURL string) *SQLProviderStore {
+	return &SQLProviderStore{GetDBConn(databaseURL)}
+}
+
+// Lookup returns the provider information of the enabled access key.
+func (s *SQLProviderStore) Lookup(accessKey string) (*ContentProviderInfo, error) {
+	info := &ContentProviderInfo{}
+	var keyID int
+	err := s.db.QueryRow(`SELECT "apiv2_authkey"."id", "apiv2_contentprovider_authkeys"."contentprovider_id", "apiv2_authkey"."secret_key"
+		FROM "apiv2_authkey" INNER JOIN "apiv2_contentprovider_authkeys" ON ( "apiv2_authkey"."id" = "apiv2_contentprovider_authkeys"."authkey_id" )
+		WHERE "apiv2_authkey"."disabled" = false AND "apiv2_authkey"."access_key" = $1`, accessKey).Scan(&keyID, &info.id, &info.secret)
+	if err == sql.ErrNoRows {
+		return nil, ErrKeyNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	s.lookupPreviousSecret(keyID, info)
+	info.quota = s.lookupQuota(info.id)
+	return info, nil
+}
+
+// lookupPreviousSecret sets the previous secret of the key on the info, if it has one which has not expired.
+// A failure is only logged, so that the providers are still authenticated, with their current secret.
+func (s *SQLProviderStore) lookupPreviousSecret(keyID int, info *ContentProviderInfo) {
+	var previousSecret string
+	var previousExpires time.Time
+	err := s.db.QueryRow(`SELECT "secret_key", "expires" FROM "goswift_authkey_previous_secrets"
+		WHERE "authkey_id" = $1 AND "expires" > now()`, keyID).Scan(&previousSecret, &previousExpires)
+	if err == sql.ErrNoRows {
+		return
+	} else if err != nil {
+		log.Error("could not read the previous secret of the key %d: %s", keyID, err)
+		return
+	}
+	info.previousSecret, info.previousExpires = previousSecret, previousExpires
+}
+
+// lookupQuota returns the quota of the provider from goswift_provider_quotas, or nil for the default quota.
+// A failure is only logged, so that the providers are still authenticated, with the default quota.
+func (s *SQLProviderStore) lookupQuota(providerID int) *ProviderQuota {
+	quota := &ProviderQuota{}
+	err := s.db.QueryRow(`SELECT "requests_per_minute", "bytes_per_minute", "requests_per_day", "bytes_per_day"
+		FROM "goswift_provider_quotas" WHERE "contentprovider_id" = $1`, providerID).Scan(&quota.PerMinute.Requests,
+		&quota.PerMinute.Bytes, &quota.PerDay.Requests, &quota.PerDay.Bytes)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		log.Error("could not read the quota of the provider %d: %s", providerID, err)
+		return nil
+	}
+	return quota
+}
+
+// ListKeys returns all the keys of the provider, sorted by ID.
+func (s *SQLProviderStore) ListKeys(providerID int) ([]*ProviderKey, error) {
+	rows, err := s.db.Query(`SELECT "apiv2_authkey"."id", "apiv2_authkey"."access_key", "apiv2_authkey"."disabled",
+		"goswift_authkey_previous_secrets"."expires"
+		FROM "apiv2_authkey" INNER JOIN "apiv2_contentprovider_authkeys" ON ( "apiv2_authkey"."id" = "apiv2_contentprovider_authkeys"."authkey_id" )
+		LEFT OUTER JOIN "goswift_authkey_previous_secrets" ON ( "apiv2_authkey"."id" = "goswift_authkey_previous_secrets"."authkey_id" )
+		WHERE "apiv2_contentprovider_authkeys"."contentprovider_id" = $1 ORDER BY "apiv2_authkey"."id"`, providerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := make([]*ProviderKey, 0)
+	for rows.Next() {
+		key := &ProviderKey{ProviderID: providerID}
+		if err := rows.Scan(&key.ID, &key.AccessKey, &key.Disabled, &key.PreviousExpires); err != nil {
+			return nil, err
+		}
+		if key.PreviousExpires != nil && !key.PreviousExpires.After(time.Now()) {
+			key.PreviousExpires = nil
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// CreateKey stores the key and links it to its provider, in a single transaction.
+func (s *SQLProviderStore) CreateKey(key *ProviderKey) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing once committed.
+	var exists int
+	if err := tx.QueryRow(`SELECT 1 FROM "apiv2_contentprovider" WHERE "id" = $1`, key.ProviderID).Scan(&exists); err == sql.ErrNoRows {
+		return ErrProviderNotFound
+	} else if err != nil {
+		return err
+	}
+	if err := tx.QueryRow(`INSERT INTO "apiv2_authkey" ("access_key", "secret_key", "disabled") VALUES ($1, $2, $3) RETURNING "id"`,
+		key.AccessKey, key.SecretKey, key.Disabled).Scan(&key.ID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO "apiv2_contentprovider_authkeys" ("contentprovider_id", "authkey_id") VALUES ($1, $2)`,
+		key.ProviderID, key.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableKey disables the access key.
+func (s *SQLProviderStore) DisableKey(accessKey string) error {
+	return s.updateKey(`UPDATE "apiv2_authkey" SET "disabled" = true WHERE "access_key" = $1`, accessKey)
+}
+
+// RotateKey replaces the secret of the enabled access key, and keeps the replaced one until previousExpires,
+// in a single transaction.
+func (s *SQLProviderStore) RotateKey(accessKey string, secretKey string, previousExpires time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // Does nothing once committed.
+	var keyID int
+	var previousSecret string
+	if err := tx.QueryRow(`SELECT "id", "secret_key" FROM "apiv2_authkey" WHERE "access_key" = $1 AND "disabled" = false FOR UPDATE`,
+		accessKey).Scan(&keyID, &previousSecret); err == sql.ErrNoRows {
+		return ErrKeyNotFound
+	} else if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO "goswift_authkey_previous_secrets" ("authkey_id", "secret_key", "expires") VALUES ($1, $2, $3)
+		ON CONFLICT ("authkey_id") DO UPDATE SET "secret_key" = EXCLUDED."secret_key", "expires" = EXCLUDED."expires"`,
+		keyID, previousSecret, previousExpires); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE "apiv2_authkey" SET "secret_key" = $2 WHERE "id" = $1`, keyID, secretKey); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// updateKey runs the update of a single key, and returns ErrKeyNotFound if no key was updated.
+func (s *SQLProviderStore) updateKey(query string, args ...interface{}) error {
+	result, err := s.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return ErrKeyNotFound
+	}
+	return nil
+}
+
+// NewProviderKey returns a new enabled key of the provider, with a random access key and secret.
+func NewProviderKey(providerID int) (*ProviderKey, error) {
+	accessKey, err := randutil.AlphaStringRange(AccessKeyLength, AccessKeyLength)
+	if err != nil {
+		return nil, err
+	}
+	secretKey, err := NewSecretKey()
+	if err != nil {
+		return nil, err
+	}
+	return &ProviderKey{ProviderID: providerID, AccessKey: accessKey, SecretKey: secretKey}, nil
+}
+
+// NewSecretKey returns a new random secret key.
+func NewSecretKey() (string, error) {
+	return randutil.AlphaStringRange(SecretKeyLength, SecretKeyLength)
+}
+
+// invalidateProviderKey removes the access key from the local provider caches.
+func invalidateProviderKey(accessKey string) {
+	providerCache.Delete(accessKey)
+	invalidAccessCache.Delete(accessKey)
+}
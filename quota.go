@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/redis.v3"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuotaLimits are the maximum number of requests and of body bytes over a window. Zero means unlimited.
+type QuotaLimits struct {
+	Requests int64
+	Bytes    int64
+}
+
+// ProviderQuota are the limits of a content provider per minute and per day.
+type ProviderQuota struct {
+	PerMinute QuotaLimits
+	PerDay    QuotaLimits
+}
+
+// IsZero returns whether the quota has no limit at all.
+func (q ProviderQuota) IsZero() bool {
+	return q == ProviderQuota{}
+}
+
+// ParseProviderQuota parses a quota written as requests-per-minute:bytes-per-minute:requests-per-day:bytes-per-day,
+// e.g. 600:52428800:100000:0, where 0 means unlimited.
+func ParseProviderQuota(raw string) (ProviderQuota, error) {
+	parts := strings.Split(raw, ":")
+	if len(parts) != 4 {
+		return ProviderQuota{}, errors.New("must be requests-per-minute:bytes-per-minute:requests-per-day:bytes-per-day")
+	}
+	var limits [4]int64
+	for i, part := range parts {
+		limit, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || limit < 0 {
+			return ProviderQuota{}, errors.New("must have positive integer limits, or 0 for unlimited")
+		}
+		limits[i] = limit
+	}
+	return ProviderQuota{QuotaLimits{limits[0], limits[1]}, QuotaLimits{limits[2], limits[3]}}, nil
+}
+
+// QuotaSettings are the default quota of the content providers, which apply to the providers without their own.
+type QuotaSettings struct {
+	Default ProviderQuota
+}
+
+// For returns the quota of the provider: its own, loaded with its key, or the default one.
+func (s QuotaSettings) For(info *ContentProviderInfo) ProviderQuota {
+	if info.quota != nil {
+		return *info.quota
+	}
+	return s.Default
+}
+
+// QuotaCount is the usage of the requests or of the bytes over their most constrained window.
+type QuotaCount struct {
+	Limit     int64
+	Remaining int64
+	Reset     time.Time
+}
+
+// QuotaUsage is the usage of a content provider after counting a request. Requests and Bytes are nil when unlimited.
+type QuotaUsage struct {
+	Requests   *QuotaCount
+	Bytes      *QuotaCount
+	RetryAfter time.Duration // Only set when a limit is exceeded, until the exceeded window resets.
+}
+
+// Exceeded returns whether a limit is exceeded, in which case the request must be rejected.
+func (u *QuotaUsage) Exceeded() bool {
+	return u.RetryAfter > 0
+}
+
+// SetHeaders sets the quota headers of the response.
+func (u *QuotaUsage) SetHeaders(c *gin.Context) {
+	header := c.Writer.Header()
+	for name, count := range map[string]*QuotaCount{"Requests": u.Requests, "Bytes": u.Bytes} {
+		if count == nil {
+			continue
+		}
+		header.Set("X-Quota-"+name+"-Limit", strconv.FormatInt(count.Limit, 10))
+		header.Set("X-Quota-"+name+"-Remaining", strconv.FormatInt(count.Remaining, 10))
+		header.Set("X-Quota-"+name+"-Reset", strconv.FormatInt(count.Reset.Unix(), 10))
+	}
+	if u.Exceeded() {
+		header.Set("Retry-After", strconv.FormatInt(int64((u.RetryAfter+time.Second-1)/time.Second), 10))
+	}
+}
+
+// quotaWindows are the windows over which the usage is counted, with the limits of each window.
+var quotaWindows = []struct {
+	name     string
+	duration time.Duration
+	limits   func(ProviderQuota) QuotaLimits
+}{
+	{"minute", time.Minute, func(q ProviderQuota) QuotaLimits { return q.PerMinute }},
+	{"day", time.Hour * 24, func(q ProviderQuota) QuotaLimits { return q.PerDay }},
+}
+
+// ProviderQuotas enforces the quotas of the content providers with Redis counters, which all the instances share.
+// The counters are over fixed windows, starting on the minute and on the day (UTC).
+type ProviderQuotas struct {
+	settings    QuotaSettings
+	redisClient *redis.Client
+}
+
+// NewProviderQuotas returns the ProviderQuotas of the settings, whose counters are stored on the Redis client.
+func NewProviderQuotas(settings QuotaSettings, client *redis.Client) *ProviderQuotas {
+	return &ProviderQuotas{settings, client}
+}
+
+// QuotaRedisKey returns the Redis key of the counter of the provider over the window starting at start.
+func QuotaRedisKey(providerID int, window string, start time.Time, counter string) string {
+	return fmt.Sprintf("goswift:quota:%d:%s:%d:%s", providerID, window, start.Unix(), counter)
+}
+
+// Count counts the request and its body bytes against the quota of the provider, and returns the usage.
+// The rejected requests are counted too, so that a flooding provider stays throttled.
+func (q *ProviderQuotas) Count(providerID int, quota ProviderQuota, bytes int64, now time.Time) (*QuotaUsage, error) {
+	usage := &QuotaUsage{}
+	for _, window := range quotaWindows {
+		limits := window.limits(quota)
+		start := now.UTC().Truncate(window.duration)
+		reset := start.Add(window.duration)
+		counters := []struct {
+			name  string
+			limit int64
+			incr  int64
+			count **QuotaCount
+		}{{"requests", limits.Requests, 1, &usage.Requests}, {"bytes", limits.Bytes, bytes, &usage.Bytes}}
+		for _, counter := range counters {
+			if counter.limit == 0 {
+				continue
+			}
+			key := QuotaRedisKey(providerID, window.name, start, counter.name)
+			used, err := q.redisClient.IncrBy(key, counter.incr).Result()
+			if err != nil {
+				return nil, err
+			}
+			if used == counter.incr {
+				// This is the first use of the window. The counter is kept a bit longer than the window for the clock skew.
+				q.redisClient.Expire(key, window.duration+time.Minute)
+			}
+			if used > counter.limit && reset.Sub(now) > usage.RetryAfter {
+				usage.RetryAfter = reset.Sub(now)
+			}
+			remaining := counter.limit - used
+			if remaining < 0 {
+				remaining = 0
+			}
+			if *counter.count == nil || remaining < (*counter.count).Remaining {
+				*counter.count = &QuotaCount{counter.limit, remaining, reset}
+			}
+		}
+	}
+	return usage, nil
+}
+
+// Enforce counts the request of the provider, sets the quota headers, and rejects it with a 429 if it is over quota.
+// It returns whether the request may proceed. If Redis fails, the request is let through rather than
+// blocking all the ingestion.
+func (q *ProviderQuotas) Enforce(c *gin.Context, info *ContentProviderInfo, bytes int64) bool {
+	quota := q.settings.For(info)
+	if quota.IsZero() {
+		return true
+	}
+	providerID := info.id
+	usage, err := q.Count(providerID, quota, bytes, time.Now())
+	if err != nil {
+		log.Error("could not count the quota of the provider %d: %s", providerID, err)
+		return true
+	}
+	usage.SetHeaders(c)
+	if usage.Exceeded() {
+		quotaRejections.Inc(strconv.Itoa(providerID))
+		log.Warning("the provider %d exceeded its quota.", providerID)
+		StatusQuotaExceeded.Respond(c, nil)
+		c.Abort()
+		return false
+	}
+	return true
+}
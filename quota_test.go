@@ -0,0 +1,148 @@
+package main
+
+import (
+	"github.com/ChristopherRabotin/gin-contrib-headerauth"
+	"github.com/Sparrho/goswift/client"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestQuota tests the quotas of the content providers.
+func TestQuota(t *testing.T) {
+	Convey("The quota tests, ", t, func() {
+		redisServer := newFakeRedis()
+		defer redisServer.Close()
+		redisClient := redisServer.Client()
+		defer redisClient.Close()
+
+		Convey("Quotas are parsed", func() {
+			quota, err := ParseProviderQuota("600:1024:0:1048576")
+			So(err, ShouldBeNil)
+			So(quota, ShouldResemble, ProviderQuota{QuotaLimits{600, 1024}, QuotaLimits{0, 1048576}})
+			for _, invalid := range []string{"", "1:2:3", "1:2:3:4:5", "1:2:-3:4", "a:b:c:d"} {
+				_, err = ParseProviderQuota(invalid)
+				So(err, ShouldNotBeNil)
+			}
+
+			values := testConfigValues()
+			values["PROVIDER_QUOTA"] = "10:0:0:0"
+			cfg, err := ParseConfig(values)
+			So(err, ShouldBeNil)
+			So(cfg.Quotas.For(&ContentProviderInfo{id: 1}).PerMinute.Requests, ShouldEqual, 10)
+			unlimited := ProviderQuota{}
+			So(cfg.Quotas.For(&ContentProviderInfo{id: 2, quota: &unlimited}).IsZero(), ShouldBeTrue)
+		})
+
+		Convey("The requests and the bytes are counted over each window", func() {
+			quotas := NewProviderQuotas(QuotaSettings{}, redisClient)
+			quota := ProviderQuota{QuotaLimits{2, 0}, QuotaLimits{10, 100}}
+			now := time.Date(2026, 10, 19, 12, 30, 15, 0, time.UTC)
+			usage, err := quotas.Count(1, quota, 40, now)
+			So(err, ShouldBeNil)
+			So(usage.Exceeded(), ShouldBeFalse)
+			So(*usage.Requests, ShouldResemble, QuotaCount{2, 1, time.Date(2026, 10, 19, 12, 31, 0, 0, time.UTC)})
+			So(*usage.Bytes, ShouldResemble, QuotaCount{100, 60, time.Date(2026, 10, 20, 0, 0, 0, 0, time.UTC)})
+
+			usage, _ = quotas.Count(1, quota, 40, now)
+			So(usage.Exceeded(), ShouldBeFalse)
+			So(usage.Requests.Remaining, ShouldEqual, 0)
+			usage, _ = quotas.Count(1, quota, 0, now)
+			So(usage.Exceeded(), ShouldBeTrue)
+			So(usage.RetryAfter, ShouldEqual, time.Second*45)
+
+			// The minute window resets, but the bytes of the day are exhausted.
+			usage, _ = quotas.Count(1, quota, 40, now.Add(time.Minute))
+			So(usage.Exceeded(), ShouldBeTrue)
+			So(usage.Bytes.Remaining, ShouldEqual, 0)
+			So(usage.RetryAfter, ShouldEqual, time.Hour*11+time.Minute*28+time.Second*45)
+
+			// The counters are per provider.
+			usage, _ = quotas.Count(2, quota, 40, now)
+			So(usage.Exceeded(), ShouldBeFalse)
+		})
+
+		Convey("The content provider auth rejects the providers over quota with the quota headers", func() {
+			providerCache.Set("quotaAccessKey", &ContentProviderInfo{id: 7, secret: "quotaSecret",
+				quota: &ProviderQuota{PerMinute: QuotaLimits{1, 0}}}, 0)
+			defer providerCache.Delete("quotaAccessKey")
+			quotas := NewProviderQuotas(QuotaSettings{}, redisClient)
+			m := ContentProviderMgr{Quotas: quotas}
+			engine := gin.New()
+			engine.PUT("/content", func(c *gin.Context) {
+				m.PostAuth(c, &headerauth.AuthInfo{AccessKey: "quotaAccessKey"}, nil)
+			}, func(c *gin.Context) {
+				c.String(http.StatusAccepted, "")
+			})
+
+			req := performRequest(engine, "PUT", "/content", nil, strings.NewReader("content"))
+			So(req.Code, ShouldEqual, 202)
+			So(req.Header().Get("X-Quota-Requests-Limit"), ShouldEqual, "1")
+			So(req.Header().Get("X-Quota-Requests-Remaining"), ShouldEqual, "0")
+			So(req.Header().Get("X-Quota-Bytes-Limit"), ShouldBeBlank)
+
+			req = performRequest(engine, "PUT", "/content", nil, strings.NewReader("content"))
+			So(req.Code, ShouldEqual, 429)
+			So(req.Body.String(), ShouldContainSubstring, "quota_exceeded")
+			So(req.Header().Get("Retry-After"), ShouldNotBeBlank)
+			So(req.Header().Get("X-Quota-Requests-Reset"), ShouldNotBeBlank)
+		})
+
+		Convey("The content route enforces the quota loaded with the provider", func() {
+			store := newMemoryProviderStore(3, 4)
+			store.quotas[3] = ProviderQuota{PerMinute: QuotaLimits{1, 0}}
+			store.CreateKey(&ProviderKey{ProviderID: 3, AccessKey: "limitedAccessKey", SecretKey: "limitedSecret"})
+			store.CreateKey(&ProviderKey{ProviderID: 4, AccessKey: "defaultAccessKey", SecretKey: "defaultSecret"})
+			defer providerCache.Delete("limitedAccessKey")
+			defer providerCache.Delete("defaultAccessKey")
+			cfg, err := ParseConfig(testConfigValues())
+			So(err, ShouldBeNil)
+			server, err := NewServer(cfg, Dependencies{Redis: redisClient, Bucket: newMemoryBucket(), Providers: store})
+			So(err, ShouldBeNil)
+			defer server.Close()
+			put := func(signer *client.Signer) *httptest.ResponseRecorder {
+				req, _ := signedProviderRequest(signer, `{"title": "some content"}`)
+				w := httptest.NewRecorder()
+				server.Engine.ServeHTTP(w, req)
+				server.persisterWg.Wait()
+				return w
+			}
+
+			limited := client.NewSigner("limitedAccessKey", "limitedSecret")
+			w := put(limited)
+			So(w.Code, ShouldEqual, 202)
+			So(w.Header().Get("X-Quota-Requests-Remaining"), ShouldEqual, "0")
+			w = put(limited)
+			So(w.Code, ShouldEqual, 429)
+			So(w.Header().Get("Retry-After"), ShouldNotBeBlank)
+
+			// Without its own quota, the provider has the default one, which is unlimited here.
+			unlimited := client.NewSigner("defaultAccessKey", "defaultSecret")
+			for i := 0; i < 2; i++ {
+				w = put(unlimited)
+				So(w.Code, ShouldEqual, 202)
+				So(w.Header().Get("X-Quota-Requests-Limit"), ShouldBeBlank)
+			}
+		})
+
+		Convey("The requests are let through when Redis fails", func() {
+			// The client only connects when first used, so the server is already down by then.
+			down := newFakeRedis()
+			downClient := down.Client()
+			defer downClient.Close()
+			down.Close()
+			quotas := NewProviderQuotas(QuotaSettings{Default: ProviderQuota{PerMinute: QuotaLimits{1, 0}}}, downClient)
+			engine := gin.New()
+			engine.PUT("/content", func(c *gin.Context) {
+				if quotas.Enforce(c, &ContentProviderInfo{id: 1}, 0) {
+					c.String(http.StatusAccepted, "")
+				}
+			})
+			So(performRequest(engine, "PUT", "/content", nil, nil).Code, ShouldEqual, 202)
+		})
+	})
+}
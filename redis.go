@@ -4,21 +4,23 @@ import (
 	"fmt"
 	"gopkg.in/redis.v3"
 	"net/url"
-	"os"
 	"strconv"
 	"time"
 )
 
-// redisClient returns a pointer to the Redis client.
-func redisClient() *redis.Client {
-	envvar := os.Getenv("REDIS_URL")
-	redisURL, err := url.Parse(envvar)
-	if err != nil {
-		panic(fmt.Errorf("could not parse REDIS_URL `%s`", envvar))
+// NewRedisClient returns a Redis client for the provided URL, e.g. redis://:password@host:6379.
+// The client only connects when it is first used.
+func NewRedisClient(rawURL string) (*redis.Client, error) {
+	redisURL, err := url.Parse(rawURL)
+	if err != nil || redisURL.Host == "" {
+		return nil, fmt.Errorf("could not parse the Redis URL `%s`", rawURL)
+	}
+	var pwd string
+	if redisURL.User != nil {
+		pwd, _ = redisURL.User.Password()
 	}
-	pwd, _ := redisURL.User.Password()
 
-	return redis.NewClient(&redis.Options{Addr: redisURL.Host, Password: pwd, DB: 0})
+	return redis.NewClient(&redis.Options{Addr: redisURL.Host, Password: pwd, DB: 0}), nil
 }
 
 // getTokenHits returns whether the token exists and its value if so.
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
 	"gopkg.in/redis.v3"
-	"os"
 	"testing"
 	"time"
 )
@@ -12,16 +11,25 @@ import (
 // TestRedis tests all of features of the redis interface.
 func TestRedis(t *testing.T) {
 	Convey("The Redis interface tests, ", t, func() {
-		Convey("Without a REDIS_URL", func() {
-			curVal := os.Getenv("REDIS_URL")
-			os.Setenv("REDIS_URL", "//not.a.user@%66%6f%6f.com/just/a/path/also")
-			So(func() { redisClient() }, ShouldPanic)
-			os.Setenv("REDIS_URL", curVal)
+		Convey("With an invalid Redis URL", func() {
+			for _, redisURL := range []string{"//not.a.user@%66%6f%6f.com/just/a/path/also", "localhost:6379", ""} {
+				client, err := NewRedisClient(redisURL)
+				So(client, ShouldBeNil)
+				So(err, ShouldNotBeNil)
+			}
+		})
+
+		Convey("A Redis URL without a password is valid", func() {
+			_, err := NewRedisClient("redis://localhost:6379")
+			So(err, ShouldBeNil)
 		})
 
 		Convey("With a valid REDIS_URL", func() {
 			token := "testing"
-			client := redisClient()
+			server := newFakeRedis()
+			defer server.Close()
+			client := server.Client()
+			defer client.Close()
 			Convey("The expected token Redis key is correct", func() {
 				So(PerishableRedisKey(token), ShouldEqual, "goswift:perishabletoken:testing")
 			})
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Content types of the supported response encodings.
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeMsgpack  = "application/msgpack"
+	ContentTypeProtobuf = "application/x-protobuf"
+)
+
+// acceptedTypes maps each accepted media type to the encoding used.
+var acceptedTypes = map[string]string{
+	"application/json":       ContentTypeJSON,
+	"application/msgpack":    ContentTypeMsgpack,
+	"application/x-msgpack":  ContentTypeMsgpack,
+	"application/protobuf":   ContentTypeProtobuf,
+	"application/x-protobuf": ContentTypeProtobuf,
+}
+
+// NegotiateContentType returns the response encoding preferred by the Accept header, which defaults to JSON.
+func NegotiateContentType(accept string) string {
+	best, bestQ := ContentTypeJSON, 0.0
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+		contentType, supported := acceptedTypes[mediaType]
+		if !supported {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if val, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = val
+				}
+			}
+		}
+		// JSON wins ties because it is the default.
+		if q > bestQ || (q == bestQ && contentType == ContentTypeJSON) {
+			best, bestQ = contentType, q
+		}
+	}
+	return best
+}
+
+// Render writes the payload in the encoding negotiated from the Accept header.
+// The payload is first converted to its JSON form so that all encodings carry the same fields.
+func Render(c *gin.Context, status int, payload interface{}) {
+	contentType := NegotiateContentType(c.Request.Header.Get("Accept"))
+	c.Writer.Header().Add("Vary", "Accept")
+	if contentType == ContentTypeJSON {
+		c.JSON(status, payload)
+		return
+	}
+	generic, err := toGeneric(payload)
+	if err != nil {
+		log.Error("could not convert the payload %+v: %s", payload, err)
+		c.JSON(500, Status500.JSON(c))
+		return
+	}
+	var buf bytes.Buffer
+	if contentType == ContentTypeMsgpack {
+		encodeMsgpack(&buf, generic)
+	} else {
+		obj, isObj := generic.(map[string]interface{})
+		if !isObj {
+			// The protobuf schema is a google.protobuf.Struct, so the payload must be an object.
+			obj = map[string]interface{}{"value": generic}
+		}
+		encodeProtoStruct(&buf, obj)
+	}
+	c.Data(status, contentType, buf.Bytes())
+}
+
+// toGeneric returns the JSON form of the payload, made of maps, slices, strings, numbers, booleans and nil.
+func toGeneric(payload interface{}) (interface{}, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var generic interface{}
+	err = decoder.Decode(&generic)
+	return generic, err
+}
+
+// sortedMapKeys returns the keys of a map sorted, so that the encodings are deterministic.
+func sortedMapKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// encodeMsgpack writes a generic value in the MessagePack format (https://github.com/msgpack/msgpack/blob/master/spec.md).
+func encodeMsgpack(buf *bytes.Buffer, val interface{}) {
+	switch v := val.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			encodeMsgpackInt(buf, i)
+		} else if f, err := v.Float64(); err == nil {
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		} else {
+			encodeMsgpack(buf, v.String())
+		}
+	case string:
+		l := len(v)
+		switch {
+		case l < 32:
+			buf.WriteByte(0xa0 | byte(l))
+		case l <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(l))
+		case l <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(l))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(l))
+		}
+		buf.WriteString(v)
+	case []interface{}:
+		l := len(v)
+		switch {
+		case l < 16:
+			buf.WriteByte(0x90 | byte(l))
+		case l <= math.MaxUint16:
+			buf.WriteByte(0xdc)
+			binary.Write(buf, binary.BigEndian, uint16(l))
+		default:
+			buf.WriteByte(0xdd)
+			binary.Write(buf, binary.BigEndian, uint32(l))
+		}
+		for _, item := range v {
+			encodeMsgpack(buf, item)
+		}
+	case map[string]interface{}:
+		l := len(v)
+		switch {
+		case l < 16:
+			buf.WriteByte(0x80 | byte(l))
+		case l <= math.MaxUint16:
+			buf.WriteByte(0xde)
+			binary.Write(buf, binary.BigEndian, uint16(l))
+		default:
+			buf.WriteByte(0xdf)
+			binary.Write(buf, binary.BigEndian, uint32(l))
+		}
+		for _, key := range sortedMapKeys(v) {
+			encodeMsgpack(buf, key)
+			encodeMsgpack(buf, v[key])
+		}
+	default:
+		// toGeneric only returns the types above.
+		panic(fmt.Errorf("cannot encode %T in msgpack", val))
+	}
+}
+
+// encodeMsgpackInt writes an integer in its most compact MessagePack form: the non-negative integers use the
+// unsigned forms, and the negative ones the signed forms.
+func encodeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i <= 127:
+		buf.WriteByte(byte(i))
+	case i < 0 && i >= -32:
+		buf.WriteByte(byte(i))
+	case i > 0 && i <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(i))
+	case i > 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(i))
+	case i > 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(i))
+	case i > 0:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, uint64(i))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(i))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+// Protobuf wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+// encodeProtoStruct writes an object as a google.protobuf.Struct message, i.e.:
+//
+//	message Struct { map<string, Value> fields = 1; }
+//	message Value { oneof kind { NullValue null_value = 1; double number_value = 2; string string_value = 3;
+//	                bool bool_value = 4; Struct struct_value = 5; ListValue list_value = 6; } }
+//	message ListValue { repeated Value values = 1; }
+//
+// Clients can therefore decode the responses with the well-known types of any protobuf library.
+func encodeProtoStruct(buf *bytes.Buffer, obj map[string]interface{}) {
+	for _, key := range sortedMapKeys(obj) {
+		var entry, value bytes.Buffer
+		writeProtoBytes(&entry, 1, []byte(key))
+		encodeProtoValue(&value, obj[key])
+		writeProtoBytes(&entry, 2, value.Bytes())
+		writeProtoBytes(buf, 1, entry.Bytes())
+	}
+}
+
+// encodeProtoValue writes a generic value as the fields of a google.protobuf.Value message.
+func encodeProtoValue(buf *bytes.Buffer, val interface{}) {
+	switch v := val.(type) {
+	case nil:
+		writeProtoTag(buf, 1, protoVarint)
+		writeProtoVarint(buf, 0)
+	case json.Number:
+		f, _ := v.Float64()
+		writeProtoTag(buf, 2, protoFixed64)
+		binary.Write(buf, binary.LittleEndian, math.Float64bits(f))
+	case string:
+		writeProtoBytes(buf, 3, []byte(v))
+	case bool:
+		writeProtoTag(buf, 4, protoVarint)
+		if v {
+			writeProtoVarint(buf, 1)
+		} else {
+			writeProtoVarint(buf, 0)
+		}
+	case map[string]interface{}:
+		var nested bytes.Buffer
+		encodeProtoStruct(&nested, v)
+		writeProtoBytes(buf, 5, nested.Bytes())
+	case []interface{}:
+		var list bytes.Buffer
+		for _, item := range v {
+			var value bytes.Buffer
+			encodeProtoValue(&value, item)
+			writeProtoBytes(&list, 1, value.Bytes())
+		}
+		writeProtoBytes(buf, 6, list.Bytes())
+	default:
+		// toGeneric only returns the types above.
+		panic(fmt.Errorf("cannot encode %T in protobuf", val))
+	}
+}
+
+// writeProtoTag writes the key of a field.
+func writeProtoTag(buf *bytes.Buffer, field int, wireType int) {
+	writeProtoVarint(buf, uint64(field<<3|wireType))
+}
+
+// writeProtoVarint writes an unsigned varint.
+func writeProtoVarint(buf *bytes.Buffer, v uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	buf.Write(tmp[:n])
+}
+
+// writeProtoBytes writes a length delimited field.
+func writeProtoBytes(buf *bytes.Buffer, field int, data []byte) {
+	writeProtoTag(buf, field, protoBytes)
+	writeProtoVarint(buf, uint64(len(data)))
+	buf.Write(data)
+}
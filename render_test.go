@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+// TestRender tests the content negotiation and the binary encodings.
+func TestRender(t *testing.T) {
+	Convey("The rendering tests, ", t, func() {
+		Convey("JSON is the default", func() {
+			So(NegotiateContentType(""), ShouldEqual, ContentTypeJSON)
+			So(NegotiateContentType("*/*"), ShouldEqual, ContentTypeJSON)
+			So(NegotiateContentType("text/html"), ShouldEqual, ContentTypeJSON)
+		})
+
+		Convey("The preferred supported type is used", func() {
+			So(NegotiateContentType("application/msgpack"), ShouldEqual, ContentTypeMsgpack)
+			So(NegotiateContentType("application/json;q=0.5, application/x-protobuf"), ShouldEqual, ContentTypeProtobuf)
+			So(NegotiateContentType("application/x-msgpack;q=0.9, application/json;q=0.9"), ShouldEqual, ContentTypeJSON)
+		})
+
+		Convey("Objects are encoded in msgpack with sorted keys", func() {
+			generic, err := toGeneric(gin.H{"b": "x", "a": 1})
+			So(err, ShouldBeNil)
+			var buf bytes.Buffer
+			encodeMsgpack(&buf, generic)
+			So(buf.Bytes(), ShouldResemble, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0xa1, 'x'})
+		})
+
+		Convey("Integers use the most compact msgpack form", func() {
+			var buf bytes.Buffer
+			encodeMsgpackInt(&buf, -1)
+			encodeMsgpackInt(&buf, 200)
+			encodeMsgpackInt(&buf, 300)
+			encodeMsgpackInt(&buf, 70000)
+			encodeMsgpackInt(&buf, -100)
+			encodeMsgpackInt(&buf, -200)
+			So(buf.Bytes(), ShouldResemble, []byte{0xff, 0xcc, 0xc8, 0xcd, 0x01, 0x2c, 0xce, 0x00, 0x01, 0x11, 0x70,
+				0xd0, 0x9c, 0xd1, 0xff, 0x38})
+		})
+
+		Convey("Objects are encoded as a google.protobuf.Struct", func() {
+			generic, _ := toGeneric(gin.H{"a": "x"})
+			var buf bytes.Buffer
+			encodeProtoStruct(&buf, generic.(map[string]interface{}))
+			So(buf.Bytes(), ShouldResemble, []byte{0x0a, 0x08, 0x0a, 0x01, 'a', 0x12, 0x03, 0x1a, 0x01, 'x'})
+		})
+
+		Convey("Responses honour the Accept header", func() {
+			engine := gin.New()
+			engine.GET("/success", SuccessJSON)
+			req := performRequest(engine, "GET", "/success", map[string][]string{"Accept": {"application/msgpack"}}, nil)
+			So(req.Code, ShouldEqual, 200)
+			So(req.Header().Get("Content-Type"), ShouldStartWith, ContentTypeMsgpack)
+			So(req.Body.Bytes(), ShouldResemble, []byte{0x81, 0xa6, 'm', 'e', 't', 'h', 'o', 'd', 0xa3, 'G', 'E', 'T'})
+		})
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"strings"
+	"sync"
+)
+
+// UnmatchedRoute is the route label of the requests which match no registered route.
+const UnmatchedRoute = "unmatched"
+
+// RouteTable stores the patterns of the registered routes, e.g. /admin/tokens/:token, so that the metrics
+// are labeled with the route rather than with the path, which may contain tokens or keys, and is unbounded.
+// This gin does not tell which route matched, so the patterns are recorded at registration.
+type RouteTable struct {
+	mu       sync.RWMutex
+	patterns [][]string
+}
+
+// splitRoute returns the segments of a path or of a pattern, ignoring the leading and trailing slashes.
+func splitRoute(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// Add records the pattern of a route.
+func (t *RouteTable) Add(pattern string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.patterns = append(t.patterns, splitRoute(pattern))
+}
+
+// Match returns the pattern of the route of the path, or UnmatchedRoute. As in gin, the static segments
+// take precedence over the parameters.
+func (t *RouteTable) Match(path string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	segments := splitRoute(path)
+	var best []string
+	bestStatic := -1
+	for _, pattern := range t.patterns {
+		if static, ok := matchRoute(pattern, segments); ok && static > bestStatic {
+			best, bestStatic = pattern, static
+		}
+	}
+	if best == nil {
+		return UnmatchedRoute
+	}
+	return "/" + strings.Join(best, "/")
+}
+
+// matchRoute returns whether the segments match the pattern, and how many static segments matched.
+func matchRoute(pattern []string, segments []string) (int, bool) {
+	static := 0
+	for i, part := range pattern {
+		switch {
+		case strings.HasPrefix(part, "*"):
+			return static, true
+		case i >= len(segments):
+			return 0, false
+		case strings.HasPrefix(part, ":"):
+			if segments[i] == "" {
+				return 0, false
+			}
+		case part != segments[i]:
+			return 0, false
+		default:
+			static++
+		}
+	}
+	return static, len(pattern) == len(segments)
+}
+
+// RouteGroup is a gin router group which records the full pattern of its routes in a RouteTable.
+type RouteGroup struct {
+	*gin.RouterGroup
+	base   string
+	routes *RouteTable
+}
+
+// NewRouteGroup returns the RouteGroup of the engine, whose routes are recorded in the table.
+func NewRouteGroup(engine *gin.Engine, routes *RouteTable) *RouteGroup {
+	return &RouteGroup{&engine.RouterGroup, "", routes}
+}
+
+// Group returns a new RouteGroup under the relative path.
+func (g *RouteGroup) Group(relativePath string, handlers ...gin.HandlerFunc) *RouteGroup {
+	return &RouteGroup{g.RouterGroup.Group(relativePath, handlers...), g.base + relativePath, g.routes}
+}
+
+// Handle registers the route and records its pattern.
+func (g *RouteGroup) Handle(method string, relativePath string, handlers ...gin.HandlerFunc) {
+	g.routes.Add(g.base + relativePath)
+	g.RouterGroup.Handle(method, relativePath, handlers...)
+}
+
+// GET registers a GET route.
+func (g *RouteGroup) GET(relativePath string, handlers ...gin.HandlerFunc) {
+	g.Handle("GET", relativePath, handlers...)
+}
+
+// POST registers a POST route.
+func (g *RouteGroup) POST(relativePath string, handlers ...gin.HandlerFunc) {
+	g.Handle("POST", relativePath, handlers...)
+}
+
+// PUT registers a PUT route.
+func (g *RouteGroup) PUT(relativePath string, handlers ...gin.HandlerFunc) {
+	g.Handle("PUT", relativePath, handlers...)
+}
+
+// DELETE registers a DELETE route.
+func (g *RouteGroup) DELETE(relativePath string, handlers ...gin.HandlerFunc) {
+	g.Handle("DELETE", relativePath, handlers...)
+}
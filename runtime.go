@@ -7,26 +7,12 @@ import (
 	"github.com/op/go-logging"
 	"os"
 	"runtime"
-	"strconv"
 )
 
-// CheckEnvVars checks that all the environment variables required are set, without checking their value. It will panic if one is missing.
-func CheckEnvVars() {
-	envvars := []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_STORAGE_BUCKET_NAME", "REDIS_URL", "DATABASE_URL"}
-	for _, envvar := range envvars {
-		if os.Getenv(envvar) == "" {
-			panic(fmt.Errorf("environment variable `%s` is missing or empty", envvar))
-		}
-	}
-}
-
 // ConfigureRuntime configures the server runtime, including the number of CPUs to use.
-func ConfigureRuntime() {
-	// Note that we're using os instead of syscall because we'll be parsing the int anyway, so there is no need to check if the envvar was found.
-	useNumCPUsStr := os.Getenv("MAX_CPUS")
-	useNumCPUsInt, err := strconv.ParseInt(useNumCPUsStr, 10, 0)
-	useNumCPUs := int(useNumCPUsInt)
-	if err != nil {
+func ConfigureRuntime(cfg *Config) {
+	useNumCPUs := cfg.MaxCPUs
+	if useNumCPUs == 0 {
 		useNumCPUs = runtime.NumCPU()
 	}
 	runtime.GOMAXPROCS(useNumCPUs)
@@ -34,28 +20,23 @@ func ConfigureRuntime() {
 }
 
 // ConfigureLogger configures the default logger (named "gofetch").
-func ConfigureLogger() {
-	// From https://github.com/op/go-logging/blob/master/examples/example.go.
-	logFormat := logging.MustStringFormatter("%{color}%{time:15:04:05.000} %{shortfunc} ▶ %{level}%{color:reset} %{message}")
-	logging.SetBackend(logging.NewBackendFormatter(logging.NewLogBackend(os.Stderr, "", 0), logFormat))
-	// Let's grab the log level from the environment, or set it to INFO.
-	envlvl := os.Getenv("LOG_LEVEL")
-	if envlvl != "" {
-		lvl, err := logging.LogLevel(envlvl)
-		if err != nil {
-			lvl = logging.INFO
-		}
-		log.Notice("Set logging level to %s.\n", lvl)
-		logging.SetLevel(lvl, "")
+// The format may be "json" for one JSON object per line, otherwise the colored text format is used.
+func ConfigureLogger(cfg *Config) {
+	if cfg.LogFormat == "json" {
+		logging.SetBackend(NewJSONBackend(os.Stderr))
 	} else {
-		log.Notice("No log level defined in environment. Defaulting to INFO.\n")
-		logging.SetLevel(logging.INFO, "")
+		// From https://github.com/op/go-logging/blob/master/examples/example.go.
+		logFormat := logging.MustStringFormatter("%{color}%{time:15:04:05.000} %{shortfunc} ▶ %{level}%{color:reset} %{message}")
+		logging.SetBackend(logging.NewBackendFormatter(logging.NewLogBackend(os.Stderr, "", 0), logFormat))
 	}
+	// The configuration defaults the log level to INFO.
+	log.Notice("Set logging level to %s.\n", cfg.LogLevel)
+	logging.SetLevel(cfg.LogLevel, "")
 }
 
 // GetDBConn returns a database connection. Note that database/sql handles a connection pool by itself.
-func GetDBConn() *sql.DB {
-	db, err := sql.Open("postgres", os.Getenv("DATABASE_URL"))
+func GetDBConn(databaseURL string) *sql.DB {
+	db, err := sql.Open("postgres", databaseURL)
 	if err != nil {
 		panic(fmt.Errorf("could not connect to database `%s`", err))
 	}
@@ -1,9 +1,12 @@
 package main
 
 import (
-	"fmt"
-	"strconv"
-	"syscall"
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
 )
 
 const (
@@ -13,29 +16,102 @@ const (
 	DefaultServerMode = "debug"
 )
 
-// ServerConfig returns the Gin server config as per environment or default.
-func ServerConfig() string {
-	addr, _ := syscall.Getenv("SERVER_ADDR")
-	var port string
-	if portStr, ok := syscall.Getenv("SERVER_PORT"); !ok {
-		port = DefaultPort
-	} else {
-		portUInt, err := strconv.ParseUint(portStr, 10, 16)
-		if err != nil || portUInt > 65535 {
-			log.Notice("Invalid port \"%s\", using %s instead.", portStr, DefaultPort)
-			port = DefaultPort
+// Default HTTP server settings, which can be overridden with the SERVER_* configuration keys.
+const (
+	DefaultReadTimeout       = time.Second * 30
+	DefaultReadHeaderTimeout = time.Second * 5
+	DefaultWriteTimeout      = time.Second * 30
+	DefaultIdleTimeout       = time.Second * 120
+	DefaultMaxHeaderBytes    = 1 << 16
+	DefaultMaxConns          = 10000
+	DefaultKeepAlivePeriod   = time.Minute * 3
+)
+
+// ServerSettings stores the configuration of the HTTP server and of its listener.
+type ServerSettings struct {
+	Addr              string
+	ReadTimeout       time.Duration
+	ReadHeaderTimeout time.Duration // Keeps slowloris clients from holding connections open.
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	MaxConns          int // The maximum number of concurrent connections, or 0 for no limit.
+	KeepAlive         bool
+	KeepAlivePeriod   time.Duration
+	Socket            string // The Unix socket path, which is used instead of Addr if set.
+	SocketMode        os.FileMode
+}
+
+// HTTPServer returns the HTTP server of these settings, serving the provided handler.
+func (s ServerSettings) HTTPServer(handler http.Handler) *http.Server {
+	server := &http.Server{Addr: s.Addr, Handler: handler, ReadTimeout: s.ReadTimeout,
+		ReadHeaderTimeout: s.ReadHeaderTimeout, WriteTimeout: s.WriteTimeout, IdleTimeout: s.IdleTimeout,
+		MaxHeaderBytes: s.MaxHeaderBytes}
+	server.SetKeepAlivesEnabled(s.KeepAlive)
+	return server
+}
+
+// Listen returns the listener of these settings, with the connection limit. The listener inherited from the
+// previous process on an upgrade comes first, then the one passed by systemd socket activation, then the Unix
+// socket, and finally the TCP address with its keep-alives.
+func (s ServerSettings) Listen() (net.Listener, error) {
+	ln, err := upgradeListener()
+	if err == nil && ln == nil {
+		ln, err = systemdListener()
+	}
+	if err == nil && ln == nil {
+		if s.Socket != "" {
+			ln, err = listenUnix(s.Socket, s.SocketMode)
 		} else {
-			port = portStr
+			lc := net.ListenConfig{KeepAlive: s.KeepAlivePeriod}
+			if !s.KeepAlive {
+				lc.KeepAlive = -1 // A negative period disables TCP keep-alives.
+			}
+			ln, err = lc.Listen(context.Background(), "tcp", s.Addr)
 		}
 	}
-	return fmt.Sprintf("%s:%s", addr, port)
+	if err != nil {
+		return nil, err
+	}
+	if s.MaxConns > 0 {
+		ln = newLimitListener(ln, s.MaxConns)
+	}
+	return ln, nil
+}
+
+// limitListener is a listener which accepts at most a given number of concurrent connections.
+// Connections above the limit wait in the backlog of the kernel until another one is closed.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+// newLimitListener returns a listener which accepts at most maxConns concurrent connections.
+func newLimitListener(ln net.Listener, maxConns int) *limitListener {
+	return &limitListener{ln, make(chan struct{}, maxConns)}
 }
 
-// ServerMode returns the Gin server mode as per environment or default.
-func ServerMode() string {
-	mode, ok := syscall.Getenv("SERVER_MODE")
-	if !ok {
-		mode = DefaultServerMode
+// Accept waits for a free slot, then for the next connection.
+func (l *limitListener) Accept() (net.Conn, error) {
+	l.sem <- struct{}{}
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		<-l.sem
+		return nil, err
 	}
-	return mode
+	return &limitConn{Conn: conn, release: func() { <-l.sem }}, nil
+}
+
+// limitConn is a connection which frees its slot of the limitListener when closed.
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+// Close closes the connection and frees its slot, only once even if called several times.
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
 }
@@ -1,44 +1,56 @@
 package main
 
 import (
-	"fmt"
 	. "github.com/smartystreets/goconvey/convey"
-	"os"
+	"net"
+	"net/http"
 	"testing"
+	"time"
 )
 
-// TestServer tests stuff from runtime.go
+// TestServer tests stuff from server.go
 func TestServer(t *testing.T) {
-	Convey("The Server configuration tests, ", t, func() {
+	Convey("The Server tests, ", t, func() {
 
-		Convey("Playing with SERVER_ADDR and SERVER_PORT", func() {
-			var serverConfs = []struct {
-				addr string
-				port string
-				expt string
-			}{
-				{"", "", fmt.Sprintf(":%s", DefaultPort)},
-				{"", "1025", ":1025"},
-				{"127.0.0.1", "", fmt.Sprintf("127.0.0.1:%s", DefaultPort)},
-				{"127.0.0.1", "1025", "127.0.0.1:1025"},
+		Convey("The HTTP server has the timeouts and limits of the settings", func() {
+			settings := ServerSettings{Addr: ":1025", ReadHeaderTimeout: time.Second * 2, MaxHeaderBytes: DefaultMaxHeaderBytes}
+			server := settings.HTTPServer(http.NotFoundHandler())
+			So(server.Addr, ShouldEqual, ":1025")
+			So(server.ReadHeaderTimeout, ShouldEqual, time.Second*2)
+			So(server.MaxHeaderBytes, ShouldEqual, DefaultMaxHeaderBytes)
+		})
+
+		Convey("The listener limits the concurrent connections", func() {
+			ln, err := ServerSettings{Addr: "127.0.0.1:0", MaxConns: 1, KeepAlive: true}.Listen()
+			So(err, ShouldBeNil)
+			defer ln.Close()
+			accepted := make(chan net.Conn, 2)
+			go func() {
+				for {
+					conn, err := ln.Accept()
+					if err != nil {
+						return
+					}
+					accepted <- conn
+				}
+			}()
+			for i := 0; i < 2; i++ {
+				client, _ := net.Dial("tcp", ln.Addr().String())
+				defer client.Close()
 			}
-			for _, conf := range serverConfs {
-				os.Setenv("SERVER_ADDR", conf.addr)
-				os.Setenv("SERVER_PORT", conf.port)
-				So(ServerConfig(), ShouldEqual, conf.expt)
+			first := <-accepted
+			select {
+			case <-accepted:
+				So("the second connection was accepted", ShouldBeBlank)
+			case <-time.After(time.Millisecond * 100):
+			}
+			first.Close()
+			select {
+			case second := <-accepted:
+				second.Close()
+			case <-time.After(time.Second):
+				So("the second connection was never accepted", ShouldBeBlank)
 			}
 		})
-
-		envvars := []string{"SERVER_MODE", "SERVER_PORT"}
-		for i := range envvars {
-			envvar := envvars[i]
-			Convey(fmt.Sprintf("Unsetting %s", envvar), func() {
-				curVal := os.Getenv(envvar)
-				os.Unsetenv(envvar)
-				So(func() { ServerMode() }, ShouldNotPanic)
-				So(func() { ServerConfig() }, ShouldNotPanic)
-				os.Setenv(envvar, curVal)
-			})
-		}
 	})
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/Sparrho/goswift/client"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultSigningSkew is how far the date of a signed request may be from the server time by default.
+const DefaultSigningSkew = time.Minute * 5
+
+// SigningSettings are the signing algorithms which the content providers may use, and the allowed clock skew.
+// The providers negotiate their algorithm by signing with any of the algorithms allowed for them.
+type SigningSettings struct {
+	Algorithms []string         // Allowed for all the providers. Empty means all the supported algorithms.
+	Providers  map[int][]string // Allowed for specific providers by ID, instead of Algorithms.
+	MaxSkew    time.Duration
+}
+
+// AllowedAlgorithms returns the signing algorithms allowed for the provider.
+func (s SigningSettings) AllowedAlgorithms(providerID int) []string {
+	if algorithms, exists := s.Providers[providerID]; exists {
+		return algorithms
+	}
+	return s.Algorithms
+}
+
+// Allows returns whether the provider may sign with the algorithm.
+func (s SigningSettings) Allows(providerID int, algorithm string) bool {
+	allowed := s.AllowedAlgorithms(providerID)
+	if len(allowed) == 0 {
+		_, supported := client.Algorithms[algorithm]
+		return supported
+	}
+	for _, candidate := range allowed {
+		if candidate == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAlgorithms parses a list of signing algorithms separated by sep, which must all be supported.
+func ParseAlgorithms(raw string, sep string) ([]string, error) {
+	var algorithms []string
+	for _, algorithm := range strings.Split(raw, sep) {
+		algorithm = strings.ToUpper(strings.TrimSpace(algorithm))
+		if _, supported := client.Algorithms[algorithm]; !supported {
+			return nil, errors.New("must only contain HMAC-SHA256, HMAC-SHA384 or HMAC-SHA512")
+		}
+		algorithms = append(algorithms, algorithm)
+	}
+	return algorithms, nil
+}
+
+// checkSigningDate returns an error unless the date of the signed request is within the allowed skew.
+func (s SigningSettings) checkSigningDate(req *http.Request, now time.Time) error {
+	date, err := time.Parse(client.DateFormat, req.Header.Get(client.DateHeader))
+	if err != nil {
+		return fmt.Errorf("the %s header must be formatted as %s", client.DateHeader, client.DateFormat)
+	}
+	maxSkew := s.MaxSkew
+	if maxSkew == 0 {
+		maxSkew = DefaultSigningSkew
+	}
+	if skew := now.Sub(date); skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("the request date %s is off by %s", date.Format(time.RFC3339), skew)
+	}
+	return nil
+}
+
+// verifySignature returns whether the signature of the string to sign is valid with the current secret,
+// or with the previous secret until it expires, and whether it was the previous secret.
+func (p *ContentProviderInfo) verifySignature(algorithm string, stringToSign string, signature string, now time.Time) (valid bool, previous bool) {
+	if expected, err := client.Signature(algorithm, p.secret, stringToSign); err == nil && hmac.Equal([]byte(signature), []byte(expected)) {
+		return true, false
+	}
+	if p.previousSecret == "" || !now.Before(p.previousExpires) {
+		return false, false
+	}
+	if expected, err := client.Signature(algorithm, p.previousSecret, stringToSign); err == nil && hmac.Equal([]byte(signature), []byte(expected)) {
+		return true, true
+	}
+	return false, false
+}
+
+// hashBody returns the hex hash of the captured body, like client.Hash, but streams the spooled bodies from disk.
+func hashBody(algorithm string, body *CapturedBody) (string, error) {
+	hashFunction, supported := client.Algorithms[algorithm]
+	if !supported {
+		return "", fmt.Errorf("unsupported algorithm `%s`", algorithm)
+	}
+	h := hashFunction()
+	if _, err := io.Copy(h, body.NewReader()); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/Sparrho/goswift/client"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// TestSigning tests the signing algorithms allowed for the content providers.
+func TestSigning(t *testing.T) {
+	Convey("The signing tests, ", t, func() {
+		Convey("All the supported algorithms are allowed by default", func() {
+			cfg, err := ParseConfig(testConfigValues())
+			So(err, ShouldBeNil)
+			So(cfg.Signing.MaxSkew, ShouldEqual, DefaultSigningSkew)
+			for _, algorithm := range []string{"HMAC-SHA256", "HMAC-SHA384", "HMAC-SHA512"} {
+				So(cfg.Signing.Allows(1, algorithm), ShouldBeTrue)
+			}
+			So(cfg.Signing.Allows(1, "HMAC-SHA1"), ShouldBeFalse)
+		})
+
+		Convey("The algorithms are restricted for all the providers or for specific ones", func() {
+			values := testConfigValues()
+			values["SIGNING_ALGORITHMS"] = "hmac-sha384, HMAC-SHA512"
+			values["PROVIDER_SIGNING_ALGORITHMS"] = "2=HMAC-SHA256, 3=HMAC-SHA256|HMAC-SHA512"
+			values["SIGNING_MAX_SKEW"] = "1m"
+			cfg, err := ParseConfig(values)
+			So(err, ShouldBeNil)
+			So(cfg.Signing.AllowedAlgorithms(1), ShouldResemble, []string{"HMAC-SHA384", "HMAC-SHA512"})
+			So(cfg.Signing.Allows(1, "HMAC-SHA256"), ShouldBeFalse)
+			So(cfg.Signing.Allows(2, "HMAC-SHA256"), ShouldBeTrue)
+			So(cfg.Signing.Allows(2, "HMAC-SHA512"), ShouldBeFalse)
+			So(cfg.Signing.Allows(3, "HMAC-SHA512"), ShouldBeTrue)
+			So(cfg.Signing.MaxSkew, ShouldEqual, time.Minute)
+
+			values["PROVIDER_SIGNING_ALGORITHMS"] = "first=HMAC-SHA256"
+			_, err = ParseConfig(values)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The previous secret only verifies until it expires", func() {
+			now := time.Now()
+			info := &ContentProviderInfo{id: 1, secret: "currentSecret", previousSecret: "previousSecret", previousExpires: now.Add(time.Hour)}
+			sign := func(secret string) string {
+				signature, _ := client.Signature("HMAC-SHA384", secret, "string to sign")
+				return signature
+			}
+			valid, previous := info.verifySignature("HMAC-SHA384", "string to sign", sign("currentSecret"), now)
+			So(valid && !previous, ShouldBeTrue)
+			valid, previous = info.verifySignature("HMAC-SHA384", "string to sign", sign("previousSecret"), now)
+			So(valid && previous, ShouldBeTrue)
+			valid, _ = info.verifySignature("HMAC-SHA384", "string to sign", sign("previousSecret"), now.Add(time.Hour))
+			So(valid, ShouldBeFalse)
+			valid, _ = info.verifySignature("HMAC-SHA256", "string to sign", sign("currentSecret"), now)
+			So(valid, ShouldBeFalse)
+		})
+	})
+}
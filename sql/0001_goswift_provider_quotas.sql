@@ -0,0 +1,9 @@
+-- The quotas of specific content providers. The providers without a row have the PROVIDER_QUOTA default.
+-- A limit of 0 is unlimited, as in PROVIDER_QUOTA.
+CREATE TABLE IF NOT EXISTS "goswift_provider_quotas" (
+    "contentprovider_id" integer NOT NULL PRIMARY KEY REFERENCES "apiv2_contentprovider" ("id") ON DELETE CASCADE,
+    "requests_per_minute" bigint NOT NULL DEFAULT 0 CHECK ("requests_per_minute" >= 0),
+    "bytes_per_minute" bigint NOT NULL DEFAULT 0 CHECK ("bytes_per_minute" >= 0),
+    "requests_per_day" bigint NOT NULL DEFAULT 0 CHECK ("requests_per_day" >= 0),
+    "bytes_per_day" bigint NOT NULL DEFAULT 0 CHECK ("bytes_per_day" >= 0)
+);
@@ -0,0 +1,7 @@
+-- The previous secret of the rotated content provider keys, which stays valid until it expires.
+-- It is kept out of apiv2_authkey, whose schema is owned by the Django migrations.
+CREATE TABLE IF NOT EXISTS "goswift_authkey_previous_secrets" (
+    "authkey_id" integer NOT NULL PRIMARY KEY REFERENCES "apiv2_authkey" ("id") ON DELETE CASCADE,
+    "secret_key" varchar(40) NOT NULL,
+    "expires" timestamp with time zone NOT NULL
+);
@@ -1,37 +1,155 @@
 package main
 
 import (
+	"github.com/ChristopherRabotin/gin-contrib-headerauth"
 	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 )
 
-// DefaultStatus is an Enum storing default JSON errors based on the status.
-type DefaultStatus int
+// StatusErr is an entry of the error catalogue: an HTTP status with a machine-readable code and a default detail.
+type StatusErr struct {
+	Status int
+	Code   string
+	Detail string
+}
+
+// statusTexts stores the "error" value of each status, which clients relied upon before codes existed.
+var statusTexts = map[int]string{503: "service unavailable", 400: "client error", 401: "unauthorized", 403: "forbidden",
+	404: "not found", 413: "request entity too large", 415: "unsupported media type", 429: "too many requests",
+	500: "internal server error"}
+
+// errCatalogue stores all the registered errors by code, and errDefaults the default error of each status.
+var (
+	errCatalogueMu sync.RWMutex
+	errCatalogue   = map[string]*StatusErr{}
+	errDefaults    = map[int]*StatusErr{}
+)
+
+// RegisterStatusErr adds an error to the catalogue. The first error registered for a status is its default.
+func RegisterStatusErr(status int, code string, detail string) *StatusErr {
+	errCatalogueMu.Lock()
+	defer errCatalogueMu.Unlock()
+	entry := &StatusErr{status, code, detail}
+	errCatalogue[code] = entry
+	if _, exists := errDefaults[status]; !exists {
+		errDefaults[status] = entry
+	}
+	return entry
+}
 
-const (
+// The default error of each status, followed by the more specific errors.
+var (
 	// Status503 is for service unavailable.
-	Status503 DefaultStatus = 1 + iota
+	Status503 = RegisterStatusErr(503, "service_unavailable", "")
 	// Status400 is for a client error.
-	Status400
+	Status400 = RegisterStatusErr(400, "client_error", "")
 	// Status401 is for an unauthorized access.
-	Status401
+	Status401 = RegisterStatusErr(401, "unauthorized", "")
 	// Status403 is for a forbidden access (and auth'ing won't help).
-	Status403
+	Status403 = RegisterStatusErr(403, "forbidden", "")
 	// Status404 is for a not found link.
-	Status404
+	Status404 = RegisterStatusErr(404, "not_found", "")
+	// Status413 is for a request body which is too large.
+	Status413 = RegisterStatusErr(413, "body_too_large", "")
+	// Status415 is for an unsupported content encoding.
+	Status415 = RegisterStatusErr(415, "unsupported_encoding", "")
+	// Status429 is for too many requests.
+	Status429 = RegisterStatusErr(429, "too_many_requests", "")
+	// Status500 is for an internal error.
+	Status500 = RegisterStatusErr(500, "internal_error", "")
+
+	// StatusValidationFailed is for a request whose fields are invalid.
+	StatusValidationFailed = RegisterStatusErr(400, "validation_failed", "Some fields are invalid.")
+	// StatusTokenUnknown is for a token which does not exist (or not anymore).
+	StatusTokenUnknown = RegisterStatusErr(401, "token_unknown", "This token does not exist, please get a new one.")
+	// StatusTokenExpired is for a token whose TTL has passed.
+	StatusTokenExpired = RegisterStatusErr(401, "token_expired", "This token has expired, please get a new one.")
+	// StatusTokenExhausted is for a token which was used as many times as allowed.
+	StatusTokenExhausted = RegisterStatusErr(401, "token_exhausted", "This token has reached its usage limit, please get a new one.")
+	// StatusSignatureInvalid is for a wrong access key or signature.
+	StatusSignatureInvalid = RegisterStatusErr(403, "signature_invalid", "Wrong access key or signature.")
+	// StatusSignatureExpired is for a signed request whose date is missing or too far from the server time.
+	StatusSignatureExpired = RegisterStatusErr(403, "signature_expired", "The request date is missing or too far from the server time.")
+	// StatusAlgorithmNotAllowed is for a request signed with an algorithm which the provider may not use.
+	StatusAlgorithmNotAllowed = RegisterStatusErr(403, "algorithm_not_allowed", "This signing algorithm is not allowed for this provider.")
+	// StatusQuotaExceeded is for a content provider which has exceeded its quota.
+	StatusQuotaExceeded = RegisterStatusErr(429, "quota_exceeded", "This provider has exceeded its quota, please retry later.")
 )
 
-var jsonStatus = [...]interface{}{ // This is in the same order as the DefaultStatus const.
-	gin.H{"error": "service unavailable"},
-	gin.H{"error": "client error"},
-	gin.H{"error": "unauthorized"},
-	gin.H{"error": "forbidden"},
-	gin.H{"error": "not found"},
+// StatusFor returns the default error of the provided status. Every status goswift responds with is registered,
+// but statuses which are not in the catalogue still get the stable http_<status> code, so this never fails.
+func StatusFor(status int) *StatusErr {
+	errCatalogueMu.RLock()
+	entry, exists := errDefaults[status]
+	errCatalogueMu.RUnlock()
+	if exists {
+		return entry
+	}
+	return &StatusErr{status, "http_" + strconv.Itoa(status), ""}
+}
+
+// StatusForCode returns the error of the provided code, and whether it is in the catalogue.
+func StatusForCode(code string) (*StatusErr, bool) {
+	errCatalogueMu.RLock()
+	defer errCatalogueMu.RUnlock()
+	entry, exists := errCatalogue[code]
+	return entry, exists
+}
+
+// JSON returns the error JSON, with the request ID of the context if there is one.
+func (e *StatusErr) JSON(c *gin.Context) gin.H {
+	return e.JSONWith(c, nil)
+}
+
+// JSONWith returns the error JSON with additional details.
+func (e *StatusErr) JSONWith(c *gin.Context, details gin.H) gin.H {
+	text, exists := statusTexts[e.Status]
+	if !exists {
+		text = strings.ToLower(http.StatusText(e.Status))
+	}
+	resp := gin.H{"error": text, "code": e.Code}
+	if e.Detail != "" {
+		resp["detail"] = e.Detail
+	}
+	if c != nil {
+		if requestID := RequestID(c); requestID != "" {
+			resp["request_id"] = requestID
+		}
+	}
+	for key, val := range details {
+		resp[key] = val
+	}
+	return resp
+}
+
+// Respond writes the error with its status, in the encoding negotiated from the Accept header.
+func (e *StatusErr) Respond(c *gin.Context, details gin.H) {
+	Render(c, e.Status, e.JSONWith(c, details))
 }
 
-// StatusMsg stores the correspondance between the status and the default response.
-var StatusMsg = map[int]DefaultStatus{503: Status503, 400: Status400, 401: Status401, 403: Status403, 404: Status404}
+// catalogueErr is an error which knows its entry in the error catalogue.
+type catalogueErr struct {
+	entry *StatusErr
+	err   error
+}
+
+// Error returns the underlying error, which is meant for the logs.
+func (e *catalogueErr) Error() string {
+	return e.err.Error()
+}
+
+// NewAuthErr returns an AuthErr which carries its catalogue entry, so that PreAbort can respond with the reason.
+func NewAuthErr(entry *StatusErr, err error) *headerauth.AuthErr {
+	return &headerauth.AuthErr{entry.Status, &catalogueErr{entry, err}}
+}
 
-// JSON returns the default JSON error for the provided status.
-func (status DefaultStatus) JSON() interface{} {
-	return jsonStatus[status-1]
+// StatusForAuthErr returns the catalogue entry carried by the AuthErr, or the default error of its status.
+func StatusForAuthErr(err *headerauth.AuthErr) *StatusErr {
+	if coded, ok := err.Err.(*catalogueErr); ok {
+		return coded.entry
+	}
+	return StatusFor(err.Status)
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"github.com/ChristopherRabotin/gin-contrib-headerauth"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+	"time"
+)
+
+// TestStatuses tests the error catalogue.
+func TestStatuses(t *testing.T) {
+	Convey("The error catalogue tests, ", t, func() {
+		Convey("The default error of a status keeps the original error text", func() {
+			So(StatusFor(401), ShouldEqual, Status401)
+			So(StatusFor(401).JSON(nil)["error"], ShouldEqual, "unauthorized")
+			So(StatusFor(401).JSON(nil)["code"], ShouldEqual, "unauthorized")
+		})
+
+		Convey("A status which is not in the catalogue does not panic", func() {
+			So(func() { StatusFor(418).JSON(nil) }, ShouldNotPanic)
+			So(StatusFor(418).Code, ShouldEqual, "http_418")
+		})
+
+		Convey("Every status goswift responds with has a registered code", func() {
+			for _, status := range []int{400, 401, 403, 404, 413, 415, 429, 500, 503} {
+				entry, exists := StatusForCode(StatusFor(status).Code)
+				So(exists, ShouldBeTrue)
+				So(entry.Status, ShouldEqual, status)
+			}
+		})
+
+		Convey("Errors can be found by code", func() {
+			entry, exists := StatusForCode("token_expired")
+			So(exists, ShouldEqual, true)
+			So(entry.Status, ShouldEqual, 401)
+			_, exists = StatusForCode("not_a_code")
+			So(exists, ShouldEqual, false)
+		})
+
+		Convey("Specific errors are not the default of their status", func() {
+			So(StatusFor(403), ShouldEqual, Status403)
+			resp := StatusSignatureInvalid.JSONWith(nil, map[string]interface{}{"extra": 1})
+			So(resp["code"], ShouldEqual, "signature_invalid")
+			So(resp["detail"], ShouldNotBeBlank)
+			So(resp["extra"], ShouldEqual, 1)
+		})
+
+		Convey("An AuthErr carries its catalogue entry", func() {
+			So(StatusForAuthErr(NewAuthErr(StatusTokenExhausted, errors.New("used up"))), ShouldEqual, StatusTokenExhausted)
+			So(StatusForAuthErr(&headerauth.AuthErr{403, errors.New("no header")}), ShouldEqual, Status403)
+		})
+
+		Convey("A perishable token tells why it is invalid", func() {
+			So(newPerishableInfo(NonceLimit).rejection(), ShouldEqual, StatusTokenExhausted)
+			expired := newPerishableInfo(0)
+			expired.Expires = expired.Expires.Add(-time.Minute)
+			So(expired.rejection(), ShouldEqual, StatusTokenExpired)
+		})
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// DefaultTLSMinVersion is the minimum TLS version accepted by default.
+const DefaultTLSMinVersion = "1.2"
+
+// tlsVersions maps the values of TLS_MIN_VERSION to the TLS versions.
+var tlsVersions = map[string]uint16{"1.0": tls.VersionTLS10, "1.1": tls.VersionTLS11, "1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13}
+
+// CertReloader stores the server certificate and reloads it from its files, so that renewed certificates
+// are used without restarting the server.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// NewCertReloader returns a CertReloader with the certificate loaded from the provided files.
+func NewCertReloader(certFile string, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate from its files. On error, the current certificate is kept.
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load the certificate %s and key %s: %s", r.certFile, r.keyFile, err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ReloadOnSIGHUP reloads the certificate every time the process receives a SIGHUP.
+func (r *CertReloader) ReloadOnSIGHUP() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	go func() {
+		for range sigChan {
+			if err := r.Reload(); err != nil {
+				log.Error("%s, still using the previous certificate.", err)
+			} else {
+				log.Notice("Reloaded the certificate %s.", r.certFile)
+			}
+		}
+	}()
+}
+
+// TLSSettings stores the TLS configuration. TLS is enabled when both the certificate and key files are set.
+type TLSSettings struct {
+	CertFile     string
+	KeyFile      string
+	MinVersion   uint16
+	CipherSuites []uint16 // Only up to TLS 1.2, the TLS 1.3 suites are not configurable.
+	HTTP2        bool
+}
+
+// Enabled returns whether TLS is enabled.
+func (s TLSSettings) Enabled() bool {
+	return s.CertFile != "" && s.KeyFile != ""
+}
+
+// TLSConfig returns the TLS configuration along with the certificate reloader.
+func (s TLSSettings) TLSConfig() (*tls.Config, *CertReloader, error) {
+	reloader, err := NewCertReloader(s.CertFile, s.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	conf := &tls.Config{GetCertificate: reloader.GetCertificate, MinVersion: s.MinVersion, CipherSuites: s.CipherSuites}
+	return conf, reloader, nil
+}
+
+// parseCipherSuites returns the IDs of the comma separated cipher suite names. Insecure suites are refused.
+func parseCipherSuites(names string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0)
+	for _, name := range splitList(names) {
+		id, exists := known[strings.ToUpper(name)]
+		if !exists {
+			return nil, fmt.Errorf("unknown or insecure cipher suite `%s` in TLS_CIPHER_SUITES", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Serve starts the HTTP server of the provided settings, with TLS (and HTTP/2) if it is enabled.
+// The certificate is reloaded on SIGHUP. This returns nil once the server was shut down or upgraded, and its
+// requests drained.
+func Serve(handler http.Handler, settings ServerSettings, tlsSettings TLSSettings) error {
+	server := settings.HTTPServer(handler)
+	var reloader *CertReloader
+	if tlsSettings.Enabled() {
+		tlsConf, tlsReloader, err := tlsSettings.TLSConfig()
+		if err != nil {
+			return err
+		}
+		server.TLSConfig, reloader = tlsConf, tlsReloader
+		if !tlsSettings.HTTP2 {
+			// A non-nil TLSNextProto disables the automatic HTTP/2 support of net/http.
+			server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		}
+	}
+	ln, err := settings.Listen()
+	if err != nil {
+		return err
+	}
+	// If this process is an upgrade, the previous one can now stop accepting connections.
+	notifyUpgraded()
+	upgraded := HandleUpgradeSignal(server, ln)
+	stopped := HandleShutdownSignals(server)
+	if reloader == nil {
+		log.Notice("Listening on %s without TLS.", ln.Addr())
+		err = server.Serve(ln)
+	} else {
+		reloader.ReloadOnSIGHUP()
+		log.Notice("Listening on %s with TLS (HTTP/2: %t).", ln.Addr(), tlsSettings.HTTP2)
+		// The certificate comes from the GetCertificate of the reloader, hence no files here.
+		err = server.ServeTLS(ln, "", "")
+	}
+	if err == http.ErrServerClosed {
+		// The server was shut down or upgraded: the in-flight requests must be done before returning.
+		select {
+		case <-stopped:
+		case <-upgraded:
+		}
+		return nil
+	}
+	return err
+}
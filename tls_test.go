@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	. "github.com/smartystreets/goconvey/convey"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestTLS tests the TLS settings and the certificate reload.
+func TestTLS(t *testing.T) {
+	Convey("The TLS tests, ", t, func() {
+		dir, _ := ioutil.TempDir("", "goswift-tls-")
+		defer os.RemoveAll(dir)
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		writeTestCert(certFile, keyFile, "first")
+		values := testConfigValues()
+		values["TLS_CERT_FILE"] = certFile
+		values["TLS_KEY_FILE"] = keyFile
+
+		Convey("TLS is disabled without a certificate", func() {
+			So(TLSSettings{}.Enabled(), ShouldBeFalse)
+		})
+
+		Convey("A certificate without its key is an error", func() {
+			delete(values, "TLS_KEY_FILE")
+			_, err := ParseConfig(values)
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("The defaults are TLS 1.2, the Go cipher suites and HTTP/2", func() {
+			cfg, err := ParseConfig(values)
+			So(err, ShouldBeNil)
+			So(cfg.TLS.Enabled(), ShouldBeTrue)
+			So(cfg.TLS.HTTP2, ShouldBeTrue)
+			conf, _, err := cfg.TLS.TLSConfig()
+			So(err, ShouldBeNil)
+			So(conf.MinVersion, ShouldEqual, tls.VersionTLS12)
+			So(conf.CipherSuites, ShouldBeNil)
+			cert, _ := conf.GetCertificate(nil)
+			So(certCommonName(cert), ShouldEqual, "first")
+		})
+
+		Convey("The minimum version and cipher suites are configurable", func() {
+			values["TLS_MIN_VERSION"] = "1.3"
+			values["TLS_CIPHER_SUITES"] = "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls_ecdhe_ecdsa_with_aes_128_gcm_sha256"
+			values["HTTP2"] = "false"
+			cfg, err := ParseConfig(values)
+			So(err, ShouldBeNil)
+			So(cfg.TLS.MinVersion, ShouldEqual, tls.VersionTLS13)
+			So(cfg.TLS.CipherSuites, ShouldResemble, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256})
+			So(cfg.TLS.HTTP2, ShouldBeFalse)
+		})
+
+		Convey("Invalid versions, insecure cipher suites and invalid certificates are all reported", func() {
+			values["TLS_MIN_VERSION"] = "1.4"
+			values["TLS_CIPHER_SUITES"] = "TLS_RSA_WITH_RC4_128_SHA"
+			values["TLS_CERT_FILE"] = keyFile
+			_, err := ParseConfig(values)
+			So(err, ShouldNotBeNil)
+			So(len(err.(ConfigErrors)), ShouldEqual, 3)
+		})
+
+		Convey("The certificate is reloaded, unless the new one is invalid", func() {
+			conf, reloader, _ := TLSSettings{CertFile: certFile, KeyFile: keyFile}.TLSConfig()
+			writeTestCert(certFile, keyFile, "second")
+			So(reloader.Reload(), ShouldBeNil)
+			cert, _ := conf.GetCertificate(nil)
+			So(certCommonName(cert), ShouldEqual, "second")
+
+			ioutil.WriteFile(certFile, []byte("not a certificate"), 0600)
+			So(reloader.Reload(), ShouldNotBeNil)
+			cert, _ = conf.GetCertificate(nil)
+			So(certCommonName(cert), ShouldEqual, "second")
+		})
+	})
+}
+
+// writeTestCert writes a self-signed certificate with the provided common name, and its key.
+func writeTestCert(certFile string, keyFile string, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(time.Now().UnixNano()), Subject: pkix.Name{CommonName: commonName},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), DNSNames: []string{"localhost"}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// certCommonName returns the common name of the leaf of the certificate.
+func certCommonName(cert *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	return leaf.Subject.CommonName
+}
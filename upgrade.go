@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// UpgradeTimeout is the maximum time the new process may take to start listening on an upgrade.
+const UpgradeTimeout = time.Second * 30
+
+// The environment variables which tell the new process where its inherited files are.
+const (
+	upgradeListenFDEnv = "UPGRADE_LISTEN_FD"
+	upgradeReadyFDEnv  = "UPGRADE_READY_FD"
+)
+
+// upgradeListener returns the listener inherited from the previous process on an upgrade, or nil if there is none.
+func upgradeListener() (net.Listener, error) {
+	fdStr := os.Getenv(upgradeListenFDEnv)
+	if fdStr == "" {
+		return nil, nil
+	}
+	os.Unsetenv(upgradeListenFDEnv)
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s `%s`", upgradeListenFDEnv, fdStr)
+	}
+	log.Notice("Using the listener inherited on upgrade.")
+	return fileListener(fd)
+}
+
+// notifyUpgraded tells the previous process that this one is listening, if this process is an upgrade.
+func notifyUpgraded() {
+	fdStr := os.Getenv(upgradeReadyFDEnv)
+	if fdStr == "" {
+		return
+	}
+	os.Unsetenv(upgradeReadyFDEnv)
+	fd, err := strconv.Atoi(fdStr)
+	if err != nil {
+		log.Error("Invalid %s `%s`, the previous process will not stop.", upgradeReadyFDEnv, fdStr)
+		return
+	}
+	ready := os.NewFile(uintptr(fd), "upgrade-ready")
+	defer ready.Close()
+	if _, err := ready.Write([]byte{1}); err != nil {
+		log.Error("Could not notify the previous process: %s", err)
+	}
+}
+
+// HandleUpgradeSignal upgrades the binary on SIGUSR2: a new process is started from the executable, inheriting the
+// listener. Once it listens, this server stops accepting connections and drains its requests for up to
+// DrainGracePeriod, and the returned channel is closed. The pending persistences must then be awaited, as on a
+// graceful shutdown.
+// If the new process fails to start listening, it is killed and this server keeps serving.
+// Note that the new process has a new PID, so a supervisor must not expect the PID to stay the same.
+func HandleUpgradeSignal(server *http.Server, ln net.Listener) <-chan struct{} {
+	done := make(chan struct{})
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigChan {
+			log.Notice("Received %s, upgrading.", sig)
+			if err := startUpgrade(ln); err != nil {
+				log.Error("Upgrade failed, still serving: %s", err)
+				continue
+			}
+			signal.Stop(sigChan)
+			// The socket file now belongs to the new process, so closing the listener must not remove it.
+			if unixLn, ok := unwrapListener(ln).(*net.UnixListener); ok {
+				unixLn.SetUnlinkOnClose(false)
+			}
+			log.Notice("The new process is listening, draining the requests.")
+			drainServer(server)
+			close(done)
+			return
+		}
+	}()
+	return done
+}
+
+// startUpgrade starts the new process with the listener, and waits until it listens.
+func startUpgrade(ln net.Listener) error {
+	lnFile, err := listenerFile(ln)
+	if err != nil {
+		return err
+	}
+	defer lnFile.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	executable, err := os.Executable()
+	if err != nil {
+		readyW.Close()
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// The extra files start at the descriptor 3.
+	cmd.ExtraFiles = []*os.File{lnFile, readyW}
+	cmd.Env = append(os.Environ(), upgradeListenFDEnv+"=3", upgradeReadyFDEnv+"=4")
+	err = cmd.Start()
+	readyW.Close() // Only the new process must hold the write end, so that its exit closes the pipe.
+	if err != nil {
+		return err
+	}
+	ready := make(chan error, 1)
+	go func() {
+		var buf [1]byte
+		_, err := readyR.Read(buf[:])
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(UpgradeTimeout):
+		err = fmt.Errorf("timed out after %s", UpgradeTimeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("the new process did not start listening: %s", err)
+	}
+	// Reaps the new process if it exits before this one.
+	go cmd.Wait()
+	return nil
+}
+
+// unwrapListener returns the underlying listener of a limitListener.
+func unwrapListener(ln net.Listener) net.Listener {
+	if limited, ok := ln.(*limitListener); ok {
+		return limited.Listener
+	}
+	return ln
+}
+
+// listenerFile returns a duplicate of the file descriptor of the listener, to be inherited by the new process.
+func listenerFile(ln net.Listener) (*os.File, error) {
+	filer, ok := unwrapListener(ln).(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("cannot hand over a %T listener", ln)
+	}
+	return filer.File()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	. "github.com/smartystreets/goconvey/convey"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// TestUpgrade tests the listener handoff between the previous and the new process.
+func TestUpgrade(t *testing.T) {
+	Convey("The upgrade tests, ", t, func() {
+		previous, _ := net.Listen("tcp", "127.0.0.1:0")
+		defer previous.Close()
+
+		Convey("The listener file is taken from under the connection limit", func() {
+			file, err := listenerFile(newLimitListener(previous, 10))
+			So(err, ShouldBeNil)
+			file.Close()
+		})
+
+		Convey("The new process uses the inherited listener", func() {
+			file, _ := listenerFile(previous)
+			defer file.Close()
+			// The inherited descriptor is closed once used, so the new process gets its own.
+			fd, err := syscall.Dup(int(file.Fd()))
+			So(err, ShouldBeNil)
+			os.Setenv(upgradeListenFDEnv, strconv.Itoa(fd))
+			ln, err := ServerSettings{Addr: "127.0.0.1:0"}.Listen()
+			So(err, ShouldBeNil)
+			defer ln.Close()
+			So(ln.Addr().String(), ShouldEqual, previous.Addr().String())
+			So(os.Getenv(upgradeListenFDEnv), ShouldBeBlank)
+		})
+
+		Convey("The new process notifies the previous one once it listens", func() {
+			readyR, readyW, _ := os.Pipe()
+			defer readyR.Close()
+			defer readyW.Close()
+			// notifyUpgraded closes the descriptor it writes to, so it gets its own.
+			fd, err := syscall.Dup(int(readyW.Fd()))
+			So(err, ShouldBeNil)
+			os.Setenv(upgradeReadyFDEnv, strconv.Itoa(fd))
+			notifyUpgraded()
+			var buf [1]byte
+			n, err := readyR.Read(buf[:])
+			So(err, ShouldBeNil)
+			So(n, ShouldEqual, 1)
+			So(os.Getenv(upgradeReadyFDEnv), ShouldBeBlank)
+		})
+
+		Convey("Without upgrade, nothing is inherited nor notified", func() {
+			ln, err := upgradeListener()
+			So(ln, ShouldBeNil)
+			So(err, ShouldBeNil)
+			So(notifyUpgraded, ShouldNotPanic)
+		})
+	})
+}